@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/martinezmoises/Test3/internal/data"
+	"github.com/martinezmoises/Test3/internal/validator"
+)
+
+// What happens to a user's reviews and reading lists when they delete their
+// account. Set with the -account-deletion-policy flag
+const deletionPolicyCascade = "cascade"     // delete them along with the user
+const deletionPolicyAnonymize = "anonymize" // keep them under an anonymized user
+
+// Show the current user their own account
+func (a *applicationDependencies) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userModel.GetByID(a.contextGetUser(r).ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	roles, err := a.permissionModel.GetRolesForUser(user.ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"user":  user,
+		"roles": roles,
+	}
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// Update the current user's username and/or password. Changing the password
+// needs the current one and logs the user out of every other session
+func (a *applicationDependencies) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userModel.GetByID(a.contextGetUser(r).ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var incomingData struct {
+		Username        *string `json:"username"`
+		CurrentPassword *string `json:"current_password"`
+		NewPassword     *string `json:"new_password"`
+	}
+
+	err = a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if incomingData.Username != nil {
+		user.Username = *incomingData.Username
+	}
+
+	passwordChanged := false
+	if incomingData.NewPassword != nil {
+		v.Check(incomingData.CurrentPassword != nil, "current_password", "must be provided to change your password")
+		if !v.IsEmpty() {
+			a.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		match, err := user.Password.Matches(*incomingData.CurrentPassword)
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+		if !match {
+			a.audit(r, data.AuditPasswordChange, user.ID, data.AuditFailure, map[string]any{"reason": "wrong_password"})
+			v.AddError("current_password", "is incorrect")
+			a.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		err = a.validateNewPassword(v, "new_password", *incomingData.NewPassword, user)
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+		if !v.IsEmpty() {
+			a.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		err = a.userModel.SetPassword(user, *incomingData.NewPassword)
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+		passwordChanged = true
+	}
+
+	data.ValidateUser(v, user)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = a.userModel.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflictResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if passwordChanged {
+		err = a.revokeSessions(r, user.ID, true)
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+		// Outstanding reset links would otherwise still work with the
+		// old password gone
+		err = a.tokenModel.DeleteAllForUser(data.ScopePasswordReset, user.ID)
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+		// and so would an email change requested with it
+		err = a.userModel.ClearPendingEmail(user.ID)
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+
+		a.audit(r, data.AuditPasswordChange, user.ID, data.AuditSuccess, nil)
+	}
+
+	err = a.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// Update the current user's bio, avatar and privacy settings. Fields that
+// are left out keep their current value
+func (a *applicationDependencies) updateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userModel.GetByID(a.contextGetUser(r).ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var incomingData struct {
+		Bio       *string `json:"bio"`
+		AvatarURL *string `json:"avatar_url"`
+		Privacy   *struct {
+			Lists   *string `json:"lists"`
+			Reviews *string `json:"reviews"`
+		} `json:"privacy"`
+	}
+
+	err = a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	if incomingData.Bio != nil {
+		user.Bio = *incomingData.Bio
+	}
+	if incomingData.AvatarURL != nil {
+		user.AvatarURL = *incomingData.AvatarURL
+	}
+	if incomingData.Privacy != nil {
+		if incomingData.Privacy.Lists != nil {
+			user.Privacy.Lists = *incomingData.Privacy.Lists
+		}
+		if incomingData.Privacy.Reviews != nil {
+			user.Privacy.Reviews = *incomingData.Privacy.Reviews
+		}
+	}
+
+	v := validator.New()
+	data.ValidateProfile(v, user)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = a.userModel.UpdateProfile(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflictResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = a.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// Delete the current user's account. The password is required so a stolen
+// token alone can't destroy an account
+func (a *applicationDependencies) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		Password string `json:"password"`
+	}
+
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(incomingData.Password != "", "password", "must be provided")
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := a.userModel.GetByID(a.contextGetUser(r).ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	match, err := user.Password.Matches(incomingData.Password)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		a.audit(r, data.AuditUserDelete, user.ID, data.AuditFailure, map[string]any{"reason": "wrong_password"})
+		a.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	// Log out everywhere first so that signed tokens get denylisted
+	err = a.revokeSessions(r, user.ID, false)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Recorded up front, with the cascade policy the user's ID can't be
+	// referenced any more once the row is gone
+	a.audit(r, data.AuditUserDelete, user.ID, data.AuditSuccess, map[string]any{"policy": a.config.account.deletionPolicy})
+
+	switch a.config.account.deletionPolicy {
+	case deletionPolicyCascade:
+		err = a.userModel.Delete(user.ID)
+	default:
+		err = a.userModel.Anonymize(user.ID)
+	}
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	a.genericResponse(w, r, http.StatusOK, "your account has been deleted")
+}
+
+// Log a user out of their sessions. If keepCurrent is set the session used
+// for this request survives. In jwt mode the revoked families are also
+// denylisted since their signed access tokens are still valid otherwise
+func (a *applicationDependencies) revokeSessions(r *http.Request, userID int64, keepCurrent bool) error {
+	var keepToken, keepFamily string
+	if keepCurrent {
+		keepToken = a.contextGetToken(r)
+		claims := a.contextGetClaims(r)
+		if claims != nil {
+			keepFamily = claims.Family
+		}
+	}
+
+	families, err := a.tokenModel.DeleteSessionsForUser(userID, keepToken, keepFamily)
+	if err != nil {
+		return err
+	}
+
+	if a.config.auth.mode == authModeJWT {
+		for _, family := range families {
+			err = a.denylistSignedToken(family, time.Now().Add(a.config.auth.accessTokenTTL))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/martinezmoises/Test3/internal/data"
+	"github.com/martinezmoises/Test3/internal/validator"
+)
+
+// listUserRolesHandler shows the roles assigned to a user along with the
+// permissions those roles (and any direct grants) give them
+func (a *applicationDependencies) listUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	_, err = a.userModel.GetByID(id)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			a.notFoundResponse(w, r)
+		} else {
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	roles, err := a.permissionModel.GetRolesForUser(id)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := a.permissionModel.GetAllForUser(id)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"roles":       roles,
+		"permissions": permissions,
+	}
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+func (a *applicationDependencies) grantUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	var incomingData struct {
+		Role string `json:"role"`
+	}
+
+	err = a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateRole(v, incomingData.Role)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = a.userModel.GetByID(id)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			a.notFoundResponse(w, r)
+		} else {
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = a.permissionModel.GrantRole(id, incomingData.Role)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			v.AddError("role", "role does not exist")
+			a.failedValidationResponse(w, r, v.Errors)
+		} else {
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	a.audit(r, data.AuditAdminGrantRole, id, data.AuditSuccess, map[string]any{"role": incomingData.Role})
+
+	a.genericResponse(w, r, http.StatusOK, "role successfully granted")
+}
+
+func (a *applicationDependencies) revokeUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	var incomingData struct {
+		Role string `json:"role"`
+	}
+
+	err = a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateRole(v, incomingData.Role)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Stop admins from locking themselves out of the admin endpoints
+	user := a.contextGetUser(r)
+	if user.ID == id && incomingData.Role == data.RoleAdmin {
+		v.AddError("role", "you cannot revoke your own admin role")
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = a.permissionModel.RevokeRole(id, incomingData.Role)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			a.notFoundResponse(w, r)
+		} else {
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	a.audit(r, data.AuditAdminRevokeRole, id, data.AuditSuccess, map[string]any{"role": incomingData.Role})
+
+	a.genericResponse(w, r, http.StatusOK, "role successfully revoked")
+}
+
+// Clear the failed login count and lockout for a user's email address
+func (a *applicationDependencies) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	user, err := a.userModel.GetByID(id)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			a.notFoundResponse(w, r)
+		} else {
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = a.loginThrottleModel.Clear(data.LoginThrottleEmailKey(user.Email))
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	a.audit(r, data.AuditAdminUnlockUser, id, data.AuditSuccess, nil)
+
+	a.genericResponse(w, r, http.StatusOK, "account successfully unlocked")
+}
+
+// List and search users. q matches the username or email address and
+// status picks one account state
+func (a *applicationDependencies) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var queryParams struct {
+		Search  string
+		Status  string
+		Filters data.Filters
+	}
+
+	v := validator.New()
+
+	query := r.URL.Query()
+	queryParams.Search = a.getSingleQueryParameter(query, "q", "")
+	queryParams.Status = a.getSingleQueryParameter(query, "status", "")
+	queryParams.Filters.Page = a.getSingleIntegerParameter(query, "page", 1, v)
+	queryParams.Filters.PageSize = a.getSingleIntegerParameter(query, "page_size", 20, v)
+	queryParams.Filters.Sort = a.getSingleQueryParameter(query, "sort", "id")
+	queryParams.Filters.SortSafeList = []string{"id", "username", "email", "created_at", "-id", "-username", "-email", "-created_at"}
+
+	data.ValidateFilters(v, queryParams.Filters)
+	data.ValidateUserStatus(v, queryParams.Status)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := a.userModel.GetAll(queryParams.Search, queryParams.Status, queryParams.Filters)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"users":     users,
+		"@metadata": metadata,
+	}
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// Show everything an admin needs to know about one user
+func (a *applicationDependencies) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.readAdminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	roles, err := a.permissionModel.GetRolesForUser(user.ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	twoFactorEnabled, err := a.twoFactorModel.IsEnabled(user.ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"user":               user,
+		"roles":              roles,
+		"two_factor_enabled": twoFactorEnabled,
+	}
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// Deactivate an account and log it out everywhere
+func (a *applicationDependencies) deactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.readAdminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	if !a.checkNotSelf(w, r, user.ID, "deactivate") {
+		return
+	}
+
+	err := a.userModel.Deactivate(user.ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = a.revokeSessions(r, user.ID, false)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	// Otherwise an old activation link would switch the account back on
+	err = a.tokenModel.DeleteAllForUser(data.ScopeActivation, user.ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	a.audit(r, data.AuditAdminDeactivateUser, user.ID, data.AuditSuccess, nil)
+
+	a.genericResponse(w, r, http.StatusOK, "user successfully deactivated")
+}
+
+func (a *applicationDependencies) reactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.readAdminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := a.userModel.Reactivate(user.ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	a.audit(r, data.AuditAdminReactivateUser, user.ID, data.AuditSuccess, nil)
+
+	a.genericResponse(w, r, http.StatusOK, "user successfully reactivated")
+}
+
+// Ban a user. They are logged out everywhere, can't log in again and
+// their API keys stop working, but their reviews and lists stay
+func (a *applicationDependencies) banUserHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		Reason string `json:"reason"`
+	}
+
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(incomingData.Reason != "", "reason", "must be provided")
+	v.Check(len(incomingData.Reason) <= 500, "reason", "must not be more than 500 bytes long")
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, ok := a.readAdminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	if !a.checkNotSelf(w, r, user.ID, "ban") {
+		return
+	}
+
+	err = a.userModel.Ban(user.ID, incomingData.Reason)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = a.revokeSessions(r, user.ID, false)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	a.audit(r, data.AuditAdminBanUser, user.ID, data.AuditSuccess, map[string]any{"reason": incomingData.Reason})
+
+	a.genericResponse(w, r, http.StatusOK, "user successfully banned")
+}
+
+func (a *applicationDependencies) unbanUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.readAdminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := a.userModel.Unban(user.ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	a.audit(r, data.AuditAdminUnbanUser, user.ID, data.AuditSuccess, nil)
+
+	a.genericResponse(w, r, http.StatusOK, "user successfully unbanned")
+}
+
+// Force a password reset. The current password stops working, every
+// session is logged out and the user is mailed a reset token
+func (a *applicationDependencies) forcePasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.readAdminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := a.setRandomPassword(user)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = a.userModel.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflictResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = a.revokeSessions(r, user.ID, false)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	err = a.userModel.ClearPendingEmail(user.ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = a.tokenModel.DeleteAllForUser(data.ScopePasswordReset, user.ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	token, err := a.tokenModel.New(user.ID, 24*time.Hour, data.ScopePasswordReset)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	a.background(func() {
+		emailData := map[string]any{
+			"passwordResetToken": token.Plaintext,
+		}
+
+		err := a.mailer.Send(user.Email, "password_reset_required.tmpl", emailData)
+		if err != nil {
+			a.logger.Error("failed to send password reset required email",
+				"email", user.Email,
+				"error", err.Error(),
+			)
+		}
+	})
+
+	a.audit(r, data.AuditAdminResetPassword, user.ID, data.AuditSuccess, nil)
+
+	a.genericResponse(w, r, http.StatusOK, "the user must now reset their password")
+}
+
+// Log a user out of every session
+func (a *applicationDependencies) revokeUserTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.readAdminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := a.revokeSessions(r, user.ID, false)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	a.audit(r, data.AuditAdminRevokeTokens, user.ID, data.AuditSuccess, nil)
+
+	a.genericResponse(w, r, http.StatusOK, "all of the user's sessions have been revoked")
+}
+
+// Load the user named by the :id parameter. If ok is false a response has
+// already been sent
+func (a *applicationDependencies) readAdminTargetUser(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user, err := a.userModel.GetByID(id)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			a.notFoundResponse(w, r)
+		} else {
+			a.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
+
+// Stop admins from locking themselves out
+func (a *applicationDependencies) checkNotSelf(w http.ResponseWriter, r *http.Request, id int64, action string) bool {
+	if a.contextGetUser(r).ID == id {
+		a.failedValidationResponse(w, r, map[string]string{"user": "you cannot " + action + " your own account"})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/martinezmoises/Test3/internal/data"
+	"github.com/martinezmoises/Test3/internal/validator"
+)
+
+// Create an API key for the current user. The response is the only time
+// the secret is shown, after that only its prefix is
+func (a *applicationDependencies) createApiKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		Name        string     `json:"name"`
+		Permissions []string   `json:"permissions"`
+		Expiry      *time.Time `json:"expiry"`
+	}
+
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := a.contextGetUser(r)
+
+	granted, err := a.permissionModel.GetAllForUser(user.ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	key := &data.ApiKey{
+		UserID:      user.ID,
+		Name:        incomingData.Name,
+		Permissions: incomingData.Permissions,
+		Expiry:      incomingData.Expiry,
+	}
+
+	v := validator.New()
+	data.ValidateApiKey(v, key, granted)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = a.apiKeyModel.New(key)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateApiKeyName):
+			v.AddError("name", "you already have a key with this name")
+			a.failedValidationResponse(w, r, v.Errors)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	a.audit(r, data.AuditApiKeyCreate, user.ID, data.AuditSuccess, map[string]any{
+		"api_key_id":  key.ID,
+		"name":        key.Name,
+		"permissions": key.Permissions,
+	})
+
+	err = a.writeJSON(w, http.StatusCreated, envelope{"api_key": key}, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// List the current user's API keys without their secrets
+func (a *applicationDependencies) listApiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := a.apiKeyModel.GetAllForUser(a.contextGetUser(r).ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = a.writeJSON(w, http.StatusOK, envelope{"api_keys": keys}, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// Revoke one of the current user's API keys
+func (a *applicationDependencies) deleteApiKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	err = a.apiKeyModel.Delete(id, a.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	a.audit(r, data.AuditApiKeyDelete, a.contextGetUser(r).ID, data.AuditSuccess, map[string]any{"api_key_id": id})
+
+	a.genericResponse(w, r, http.StatusOK, "API key successfully revoked")
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/martinezmoises/Test3/internal/data"
+	"github.com/martinezmoises/Test3/internal/validator"
+)
+
+// Record an event in the audit log. The actor is whoever is logged in on
+// this request. targetID is the user the action was done to, or 0 if
+// there isn't one. The action has already happened by the time we get
+// here, so a failure to record it is logged rather than sent to the client
+func (a *applicationDependencies) audit(r *http.Request, action string, targetID int64, outcome string, details map[string]any) {
+	a.insertAuditEvent(a.newAuditEvent(r, action, targetID, outcome, details))
+}
+
+// Like audit(), for failures that anyone can cause without an account,
+// e.g. by sending a made-up token. Repeats from the same IP are counted
+// rather than recorded one by one, see auditSampler
+func (a *applicationDependencies) auditSampled(r *http.Request, action string, details map[string]any) {
+	event := a.newAuditEvent(r, action, 0, data.AuditFailure, details)
+	if a.auditSampler.hold(event) {
+		return
+	}
+	a.insertAuditEvent(event)
+}
+
+func (a *applicationDependencies) newAuditEvent(r *http.Request, action string, targetID int64, outcome string, details map[string]any) *data.AuditEvent {
+	event := &data.AuditEvent{
+		Action:    action,
+		Outcome:   outcome,
+		IPAddress: a.clientIP(r),
+		UserAgent: r.UserAgent(),
+		Details:   details,
+	}
+
+	user, ok := r.Context().Value(userContextKey).(*data.User)
+	if ok && !user.IsAnonymous() {
+		event.ActorID = &user.ID
+	}
+	if targetID > 0 {
+		event.TargetUserID = &targetID
+	}
+
+	// Note which key a script used so a leaked key can be traced
+	if key := a.contextGetApiKey(r); key != nil {
+		if event.Details == nil {
+			event.Details = map[string]any{}
+		}
+		event.Details["api_key_id"] = key.ID
+	}
+
+	return event
+}
+
+func (a *applicationDependencies) insertAuditEvent(event *data.AuditEvent) {
+	err := a.auditModel.Insert(event)
+	if err != nil {
+		var targetID int64
+		if event.TargetUserID != nil {
+			targetID = *event.TargetUserID
+		}
+		a.logger.Error("failed to record audit event",
+			"action", event.Action,
+			"target_user_id", targetID,
+			"error", err.Error(),
+		)
+	}
+}
+
+// auditSampler keeps the audit log from growing with every request an
+// anonymous client makes. The first event of each action from an IP is
+// recorded straight away. Repeats are only counted, and once a minute the
+// count is written as a single event with "repeated" in its details
+type auditSampler struct {
+	mu   sync.Mutex
+	held map[string]*heldAuditEvent
+	// Closed to stop the background flush
+	done chan struct{}
+}
+
+type heldAuditEvent struct {
+	event    data.AuditEvent
+	repeated int
+}
+
+// How often the repeats are written out
+const auditSampleInterval = time.Minute
+
+// Report whether event repeats one already recorded since the last flush,
+// in which case it has been counted and shouldn't be recorded itself
+func (s *auditSampler) hold(event *data.AuditEvent) bool {
+	key := event.Action + " " + event.IPAddress
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if held, found := s.held[key]; found {
+		held.repeated++
+		return true
+	}
+	s.held[key] = &heldAuditEvent{event: *event}
+	return false
+}
+
+// Take the counted repeats as events to record, and start counting again
+func (s *auditSampler) take() []*data.AuditEvent {
+	s.mu.Lock()
+	held := s.held
+	s.held = make(map[string]*heldAuditEvent)
+	s.mu.Unlock()
+
+	var events []*data.AuditEvent
+	for _, h := range held {
+		if h.repeated == 0 {
+			continue
+		}
+		event := h.event
+		event.Details = maps.Clone(event.Details)
+		if event.Details == nil {
+			event.Details = map[string]any{}
+		}
+		event.Details["repeated"] = h.repeated
+		events = append(events, &event)
+	}
+	return events
+}
+
+// Write out the counted repeats every auditSampleInterval until
+// stopAuditSampling()
+func (a *applicationDependencies) startAuditSampling() {
+	a.auditSampler.done = make(chan struct{})
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+
+		ticker := time.NewTicker(auditSampleInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-a.auditSampler.done:
+				// Don't lose what was counted since the last tick
+				a.flushAuditSamples()
+				return
+			case <-ticker.C:
+				a.flushAuditSamples()
+			}
+		}
+	}()
+}
+
+func (a *applicationDependencies) flushAuditSamples() {
+	for _, event := range a.auditSampler.take() {
+		a.insertAuditEvent(event)
+	}
+}
+
+// Stop the flush started by startAuditSampling(), if there is one
+func (a *applicationDependencies) stopAuditSampling() {
+	if a.auditSampler.done != nil {
+		close(a.auditSampler.done)
+	}
+}
+
+// Search the audit log
+func (a *applicationDependencies) listAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	query := r.URL.Query()
+	filter := a.readAuditFilter(query, v)
+
+	var filters data.Filters
+	filters.Page = a.getSingleIntegerParameter(query, "page", 1, v)
+	filters.PageSize = a.getSingleIntegerParameter(query, "page_size", 50, v)
+	filters.Sort = a.getSingleQueryParameter(query, "sort", "-id")
+	filters.SortSafeList = []string{"id", "created_at", "-id", "-created_at"}
+
+	data.ValidateFilters(v, filters)
+	data.ValidateAuditFilter(v, filter)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	events, metadata, err := a.auditModel.GetAll(filter, filters)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"audit_events": events,
+		"@metadata":    metadata,
+	}
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// Export the audit log as JSON Lines, one event per line, oldest first.
+// Takes the same filters as the search endpoint but isn't paginated
+func (a *applicationDependencies) exportAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	filter := a.readAuditFilter(r.URL.Query(), v)
+	data.ValidateAuditFilter(v, filter)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// A big export takes longer than the server's write timeout allows
+	err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(5 * time.Minute))
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit_events.jsonl"`)
+
+	// json.Encoder ends every value with a newline, which is exactly the
+	// JSON Lines format
+	encoder := json.NewEncoder(w)
+	err = a.auditModel.Export(filter, func(event *data.AuditEvent) error {
+		return encoder.Encode(event)
+	})
+	if err != nil {
+		// Part of the body may already be on its way, so the status
+		// can't be changed any more. Log it and cut the export short
+		a.logError(r, err)
+	}
+}
+
+// Read the filters shared by the audit search and export endpoints. from
+// and to are RFC 3339 timestamps
+func (a *applicationDependencies) readAuditFilter(query url.Values, v *validator.Validator) data.AuditFilter {
+	filter := data.AuditFilter{
+		Action:    a.getSingleQueryParameter(query, "action", ""),
+		Outcome:   a.getSingleQueryParameter(query, "outcome", ""),
+		IPAddress: a.getSingleQueryParameter(query, "ip", ""),
+	}
+
+	for key, dest := range map[string]*int64{
+		"actor_id":       &filter.ActorID,
+		"target_user_id": &filter.TargetUserID,
+		"user_id":        &filter.UserID,
+	} {
+		if value := query.Get(key); value != "" {
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				v.AddError(key, "must be an integer value")
+				continue
+			}
+			*dest = id
+		}
+	}
+
+	for key, dest := range map[string]**time.Time{
+		"from": &filter.From,
+		"to":   &filter.To,
+	} {
+		if value := query.Get(key); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				v.AddError(key, "must be an RFC 3339 timestamp")
+				continue
+			}
+			*dest = &t
+		}
+	}
+
+	return filter
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/martinezmoises/Test3/internal/data"
+	"github.com/martinezmoises/Test3/internal/validator"
+)
+
+// List authors one page at a time. name matches any part of their name
+func (a *applicationDependencies) listAuthorsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	query := r.URL.Query()
+	name := a.getSingleQueryParameter(query, "name", "")
+
+	var filters data.Filters
+	filters.Page = a.getSingleIntegerParameter(query, "page", 1, v)
+	filters.PageSize = a.getSingleIntegerParameter(query, "page_size", 20, v)
+	filters.Sort = a.getSingleQueryParameter(query, "sort", "name")
+	filters.SortSafeList = []string{"id", "name", "created_at", "-id", "-name", "-created_at"}
+
+	data.ValidateFilters(v, filters)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	authors, metadata, err := a.authorModel.GetAll(name, filters)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"authors":   authors,
+		"@metadata": metadata,
+	}
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+func (a *applicationDependencies) createAuthorHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		Name string `json:"name"`
+		Bio  string `json:"bio"`
+	}
+
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	author := &data.Author{
+		Name: strings.TrimSpace(incomingData.Name),
+		Bio:  incomingData.Bio,
+	}
+
+	v := validator.New()
+	data.ValidateAuthor(v, author)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = a.authorModel.Insert(author)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateAuthor):
+			v.AddError("name", "an author with this name already exists")
+			a.failedValidationResponse(w, r, v.Errors)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := etagHeaders(author.Version)
+	headers.Set("Location", fmt.Sprintf("/api/v1/authors/%d", author.ID))
+
+	err = a.writeJSON(w, http.StatusCreated, envelope{"author": author}, headers)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+func (a *applicationDependencies) showAuthorHandler(w http.ResponseWriter, r *http.Request) {
+	author, ok := a.readAuthor(w, r)
+	if !ok {
+		return
+	}
+
+	err := a.writeJSON(w, http.StatusOK, envelope{"author": author}, etagHeaders(author.Version))
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// Rename an author or change their bio. A new name shows up on all of
+// their books
+func (a *applicationDependencies) updateAuthorHandler(w http.ResponseWriter, r *http.Request) {
+	author, ok := a.readAuthor(w, r)
+	if !ok {
+		return
+	}
+
+	if !a.checkPreconditions(w, r, author.Version) {
+		return
+	}
+
+	var incomingData struct {
+		Name *string `json:"name"`
+		Bio  *string `json:"bio"`
+	}
+
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	if incomingData.Name != nil {
+		author.Name = strings.TrimSpace(*incomingData.Name)
+	}
+	if incomingData.Bio != nil {
+		author.Bio = *incomingData.Bio
+	}
+
+	v := validator.New()
+	data.ValidateAuthor(v, author)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = a.authorModel.Update(author)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateAuthor):
+			v.AddError("name", "an author with this name already exists")
+			a.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflictResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = a.writeJSON(w, http.StatusOK, envelope{"author": author}, etagHeaders(author.Version))
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// Delete an author. They have to be taken off all their books first
+func (a *applicationDependencies) deleteAuthorHandler(w http.ResponseWriter, r *http.Request) {
+	author, ok := a.readAuthor(w, r)
+	if !ok {
+		return
+	}
+
+	if !a.checkPreconditions(w, r, author.Version) {
+		return
+	}
+
+	err := a.authorModel.Delete(author.ID, author.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrAuthorHasBooks):
+			a.authorHasBooksResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflictResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	a.genericResponse(w, r, http.StatusOK, "author successfully deleted")
+}
+
+// List the books an author is credited on, with the part they played
+func (a *applicationDependencies) listAuthorBooksHandler(w http.ResponseWriter, r *http.Request) {
+	author, ok := a.readAuthor(w, r)
+	if !ok {
+		return
+	}
+
+	v := validator.New()
+
+	query := r.URL.Query()
+
+	var filters data.Filters
+	filters.Page = a.getSingleIntegerParameter(query, "page", 1, v)
+	filters.PageSize = a.getSingleIntegerParameter(query, "page_size", 10, v)
+	filters.Sort = a.getSingleQueryParameter(query, "sort", "publication_date")
+	filters.SortSafeList = []string{"id", "title", "publication_date", "average_rating", "-id", "-title", "-publication_date", "-average_rating"}
+
+	data.ValidateFilters(v, filters)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	books, metadata, err := a.authorModel.GetBooks(author.ID, filters)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"books":     books,
+		"@metadata": metadata,
+	}
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// Load the author named by the :id in the URL. If there isn't one the
+// error response has been sent and ok is false
+func (a *applicationDependencies) readAuthor(w http.ResponseWriter, r *http.Request) (*data.Author, bool) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	author, err := a.authorModel.Get(id)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			a.notFoundResponse(w, r)
+		} else {
+			a.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return author, true
+}
@@ -4,51 +4,85 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 
+	"github.com/julienschmidt/httprouter"
 	"github.com/martinezmoises/Test3/internal/data"
 	"github.com/martinezmoises/Test3/internal/validator"
 )
 
+// List books one page at a time. q is a full-text search, and when it is
+// given the best matches come first unless another sort is asked for.
+// facets is a comma separated list of facets (genre, author, decade,
+// rating) to count across all the matching books, not just this page.
+// facet_authors is how many of the top authors to count
 func (a *applicationDependencies) listBooksHandler(w http.ResponseWriter, r *http.Request) {
-	var queryParams struct {
-		Title   string
-		Author  string
-		Genre   string
-		Filters data.Filters
-	}
+	v := validator.New()
 
 	query := r.URL.Query()
-	queryParams.Title = a.getSingleQueryParameter(query, "title", "")
-	queryParams.Author = a.getSingleQueryParameter(query, "author", "")
-	queryParams.Genre = a.getSingleQueryParameter(query, "genre", "")
-	queryParams.Filters.Page = a.getSingleIntegerParameter(query, "page", 1, nil)
-	queryParams.Filters.PageSize = a.getSingleIntegerParameter(query, "page_size", 10, nil)
-	queryParams.Filters.Sort = a.getSingleQueryParameter(query, "sort", "id")
-	queryParams.Filters.SortSafeList = []string{"id", "title", "genre", "-id", "-title", "-genre"}
+	filter := a.readBookFilter(query)
 
-	v := validator.New()
-	data.ValidateFilters(v, queryParams.Filters)
+	defaultSort := "id"
+	if filter.Query != "" {
+		defaultSort = "-relevance"
+	}
+
+	var filters data.Filters
+	filters.Page = a.getSingleIntegerParameter(query, "page", 1, v)
+	filters.PageSize = a.getSingleIntegerParameter(query, "page_size", 10, v)
+	filters.Sort = a.getSingleQueryParameter(query, "sort", defaultSort)
+	filters.SortSafeList = []string{"id", "title", "genre", "average_rating", "ratings_count", "-id", "-title", "-genre", "-average_rating", "-ratings_count", "-relevance"}
+
+	facetNames := a.getCSVParameter(query, "facets", nil)
+	authorLimit := a.getSingleIntegerParameter(query, "facet_authors", 10, v)
+
+	data.ValidateFilters(v, filters)
+	data.ValidateBookFilter(v, filter, filters)
+	data.ValidateFacets(v, facetNames, authorLimit)
 	if !v.IsEmpty() {
 		a.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	books, metadata, err := a.bookModel.GetAll(queryParams.Title, queryParams.Author, queryParams.Genre, queryParams.Filters)
+	books, metadata, err := a.bookModel.GetAll(filter, filters)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 		return
 	}
 
+	var facets data.Facets
+	if len(facetNames) > 0 {
+		facets, err = a.bookModel.GetFacets(filter, facetNames, authorLimit)
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
 	data := envelope{
 		"books":     books,
 		"@metadata": metadata,
 	}
+	if facets != nil {
+		data["@facets"] = facets
+	}
 	err = a.writeJSON(w, http.StatusOK, data, nil)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
 }
 
+// Read the filters for the book list
+func (a *applicationDependencies) readBookFilter(query url.Values) data.BookFilter {
+	return data.BookFilter{
+		Query:  a.getSingleQueryParameter(query, "q", ""),
+		Title:  a.getSingleQueryParameter(query, "title", ""),
+		Author: a.getSingleQueryParameter(query, "author", ""),
+		Genre:  a.getSingleQueryParameter(query, "genre", ""),
+	}
+}
+
 func (a *applicationDependencies) displayBookHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := a.readIDParam(r)
 	if err != nil {
@@ -67,20 +101,76 @@ func (a *applicationDependencies) displayBookHandler(w http.ResponseWriter, r *h
 	}
 
 	data := envelope{"book": book}
-	err = a.writeJSON(w, http.StatusOK, data, nil)
+	err = a.writeJSON(w, http.StatusOK, data, etagHeaders(book.Version, bookDerived(book)...))
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// The parts of a book that change without its version going up. They go
+// into its ETag, see etag()
+func bookDerived(book *data.Book) []any {
+	return []any{book.AverageRating, book.RatingsCount, book.Authors, book.Contributors}
+}
+
+// httprouter won't register /api/v1/books/isbn/:isbn next to
+// /api/v1/books/:id, so GET /api/v1/books/:id/:sub serves both the ISBN
+// lookup and /api/v1/books/:id/reviews and picks one here. "reviews" is
+// never an ISBN, so /api/v1/books/isbn/reviews goes to the reviews
+func (a *applicationDependencies) bookSubresourceHandler(byISBN http.HandlerFunc, reviews http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := httprouter.ParamsFromContext(r.Context())
+		switch {
+		case params.ByName("sub") == "reviews":
+			reviews(w, r)
+		case params.ByName("id") == "isbn":
+			byISBN(w, r)
+		default:
+			a.notFoundResponse(w, r)
+		}
+	}
+}
+
+// Look a book up by ISBN. Either form is accepted, with or without
+// hyphens, since books are stored under the ISBN-13
+func (a *applicationDependencies) displayBookByISBNHandler(w http.ResponseWriter, r *http.Request) {
+	isbn := data.NormalizeISBN(httprouter.ParamsFromContext(r.Context()).ByName("sub"))
+
+	v := validator.New()
+	v.Check(data.ValidISBN13(isbn), "isbn", "must be a valid ISBN-10 or ISBN-13")
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	book, err := a.bookModel.GetByISBN(isbn)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			a.notFoundResponse(w, r)
+		} else {
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	data := envelope{"book": book}
+	err = a.writeJSON(w, http.StatusOK, data, etagHeaders(book.Version, bookDerived(book)...))
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
 }
 
+// Add a book. Its people are given either as authors, a list of names, or
+// as contributors, which can also credit editors and translators
 func (a *applicationDependencies) createBookHandler(w http.ResponseWriter, r *http.Request) {
 	var incomingData struct {
-		Title           string   `json:"title"`
-		Authors         []string `json:"authors"`
-		ISBN            string   `json:"isbn"`
-		PublicationDate string   `json:"publication_date"`
-		Genre           string   `json:"genre"`
-		Description     string   `json:"description"`
+		Title           string             `json:"title"`
+		Authors         []string           `json:"authors"`
+		Contributors    []data.Contributor `json:"contributors"`
+		ISBN            string             `json:"isbn"`
+		PublicationDate string             `json:"publication_date"`
+		Genre           string             `json:"genre"`
+		Description     string             `json:"description"`
 	}
 
 	err := a.readJSON(w, r, &incomingData)
@@ -89,16 +179,17 @@ func (a *applicationDependencies) createBookHandler(w http.ResponseWriter, r *ht
 		return
 	}
 
+	v := validator.New()
+
 	book := &data.Book{
 		Title:           incomingData.Title,
-		Authors:         incomingData.Authors,
-		ISBN:            incomingData.ISBN,
+		Contributors:    readContributors(v, incomingData.Authors, incomingData.Contributors, nil),
+		ISBN:            data.NormalizeISBN(incomingData.ISBN),
 		PublicationDate: incomingData.PublicationDate,
 		Genre:           incomingData.Genre,
 		Description:     incomingData.Description,
 	}
 
-	v := validator.New()
 	data.ValidateBook(v, book)
 	if !v.IsEmpty() {
 		a.failedValidationResponse(w, r, v.Errors)
@@ -107,11 +198,20 @@ func (a *applicationDependencies) createBookHandler(w http.ResponseWriter, r *ht
 
 	err = a.bookModel.Insert(book)
 	if err != nil {
-		a.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrDuplicateISBN):
+			v.AddError("isbn", "a book with this ISBN already exists")
+			a.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrUnknownAuthor):
+			v.AddError("contributors", "no author exists with that author_id")
+			a.failedValidationResponse(w, r, v.Errors)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	headers := make(http.Header)
+	headers := etagHeaders(book.Version, bookDerived(book)...)
 	headers.Set("Location", fmt.Sprintf("/api/v1/books/%d", book.ID))
 
 	data := envelope{"book": book}
@@ -122,6 +222,39 @@ func (a *applicationDependencies) createBookHandler(w http.ResponseWriter, r *ht
 	}
 }
 
+// Work out a book's contributors from a request. authors is a list of
+// names, all credited as authors, and only replaces the book's authors:
+// its editors and translators are kept. contributors replaces everyone,
+// with the role defaulting to author. A nil slice means it wasn't sent,
+// and only one of the two may be
+func readContributors(v *validator.Validator, authors []string, contributors []data.Contributor, current []data.Contributor) []data.Contributor {
+	switch {
+	case authors != nil && contributors != nil:
+		v.AddError("contributors", "must not be given together with authors")
+		return current
+	case contributors != nil:
+		for i := range contributors {
+			contributors[i].Name = strings.TrimSpace(contributors[i].Name)
+			if contributors[i].Role == "" {
+				contributors[i].Role = data.ContributorAuthor
+			}
+		}
+		return contributors
+	case authors != nil:
+		result := []data.Contributor{}
+		for _, name := range authors {
+			result = append(result, data.Contributor{Name: strings.TrimSpace(name), Role: data.ContributorAuthor})
+		}
+		for _, contributor := range current {
+			if contributor.Role != data.ContributorAuthor {
+				result = append(result, contributor)
+			}
+		}
+		return result
+	}
+	return current
+}
+
 func (a *applicationDependencies) updateBookHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := a.readIDParam(r)
 	if err != nil {
@@ -139,13 +272,18 @@ func (a *applicationDependencies) updateBookHandler(w http.ResponseWriter, r *ht
 		return
 	}
 
+	if !a.checkPreconditions(w, r, book.Version, bookDerived(book)...) {
+		return
+	}
+
 	var incomingData struct {
-		Title           *string   `json:"title"`
-		Authors         *[]string `json:"authors"`
-		ISBN            *string   `json:"isbn"`
-		PublicationDate *string   `json:"publication_date"` // Ensure this matches
-		Genre           *string   `json:"genre"`
-		Description     *string   `json:"description"`
+		Title           *string             `json:"title"`
+		Authors         *[]string           `json:"authors"`
+		Contributors    *[]data.Contributor `json:"contributors"`
+		ISBN            *string             `json:"isbn"`
+		PublicationDate *string             `json:"publication_date"` // Ensure this matches
+		Genre           *string             `json:"genre"`
+		Description     *string             `json:"description"`
 	}
 
 	err = a.readJSON(w, r, &incomingData)
@@ -157,12 +295,21 @@ func (a *applicationDependencies) updateBookHandler(w http.ResponseWriter, r *ht
 	if incomingData.Title != nil {
 		book.Title = *incomingData.Title
 	}
+
+	v := validator.New()
+
+	var authors []string
 	if incomingData.Authors != nil {
-		book.Authors = *incomingData.Authors
+		authors = *incomingData.Authors
 	}
+	var contributors []data.Contributor
+	if incomingData.Contributors != nil {
+		contributors = *incomingData.Contributors
+	}
+	book.Contributors = readContributors(v, authors, contributors, book.Contributors)
 
 	if incomingData.ISBN != nil {
-		book.ISBN = *incomingData.ISBN
+		book.ISBN = data.NormalizeISBN(*incomingData.ISBN)
 	}
 	if incomingData.Genre != nil {
 		book.Genre = *incomingData.Genre
@@ -171,7 +318,6 @@ func (a *applicationDependencies) updateBookHandler(w http.ResponseWriter, r *ht
 		book.Description = *incomingData.Description
 	}
 
-	v := validator.New()
 	data.ValidateBook(v, book)
 	if !v.IsEmpty() {
 		a.failedValidationResponse(w, r, v.Errors)
@@ -180,12 +326,23 @@ func (a *applicationDependencies) updateBookHandler(w http.ResponseWriter, r *ht
 
 	err = a.bookModel.Update(book)
 	if err != nil {
-		a.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrDuplicateISBN):
+			v.AddError("isbn", "a book with this ISBN already exists")
+			a.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrUnknownAuthor):
+			v.AddError("contributors", "no author exists with that author_id")
+			a.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflictResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
 	data := envelope{"book": book}
-	err = a.writeJSON(w, http.StatusOK, data, nil)
+	err = a.writeJSON(w, http.StatusOK, data, etagHeaders(book.Version, bookDerived(book)...))
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
@@ -198,7 +355,7 @@ func (a *applicationDependencies) deleteBookHandler(w http.ResponseWriter, r *ht
 		return
 	}
 
-	err = a.bookModel.Delete(id)
+	book, err := a.bookModel.Get(id)
 	if err != nil {
 		if errors.Is(err, data.ErrRecordNotFound) {
 			a.notFoundResponse(w, r)
@@ -208,28 +365,30 @@ func (a *applicationDependencies) deleteBookHandler(w http.ResponseWriter, r *ht
 		return
 	}
 
-	data := envelope{"message": "book successfully deleted"}
-	err = a.writeJSON(w, http.StatusOK, data, nil)
-	if err != nil {
-		a.serverErrorResponse(w, r, err)
+	if !a.checkPreconditions(w, r, book.Version, bookDerived(book)...) {
+		return
 	}
-}
 
-func (a *applicationDependencies) searchBooksHandler(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query()
-	title := a.getSingleQueryParameter(query, "title", "")
-	author := a.getSingleQueryParameter(query, "author", "")
-	genre := a.getSingleQueryParameter(query, "genre", "")
-
-	books, _, err := a.bookModel.GetAll(title, author, genre, data.Filters{Page: 1, PageSize: 100}) // Default pagination
+	err = a.bookModel.Delete(book.ID, book.Version)
 	if err != nil {
-		a.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflictResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	data := envelope{"books": books}
+	data := envelope{"message": "book successfully deleted"}
 	err = a.writeJSON(w, http.StatusOK, data, nil)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
 }
+
+// The search endpoint takes the same parameters as the book list, it is
+// kept for the clients that already use it
+func (a *applicationDependencies) searchBooksHandler(w http.ResponseWriter, r *http.Request) {
+	a.listBooksHandler(w, r)
+}
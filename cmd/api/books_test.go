@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/martinezmoises/Test3/internal/data"
+	"github.com/martinezmoises/Test3/internal/validator"
+)
+
+func TestReadContributors(t *testing.T) {
+	current := []data.Contributor{
+		{AuthorID: 1, Name: "Gabriel García Márquez", Role: data.ContributorAuthor},
+		{AuthorID: 2, Name: "Gregory Rabassa", Role: data.ContributorTranslator},
+		{AuthorID: 3, Name: "Someone", Role: data.ContributorEditor},
+	}
+
+	tests := []struct {
+		name         string
+		authors      []string
+		contributors []data.Contributor
+		want         []data.Contributor
+		valid        bool
+	}{
+		{
+			name:  "neither given",
+			want:  current,
+			valid: true,
+		},
+		{
+			name:         "both given",
+			authors:      []string{"Ursula K. Le Guin"},
+			contributors: []data.Contributor{{Name: "Ursula K. Le Guin"}},
+			want:         current,
+		},
+		{
+			name: "contributors",
+			contributors: []data.Contributor{
+				{Name: "  Ursula K. Le Guin "},
+				{AuthorID: 2, Role: data.ContributorTranslator},
+			},
+			want: []data.Contributor{
+				{Name: "Ursula K. Le Guin", Role: data.ContributorAuthor},
+				{AuthorID: 2, Role: data.ContributorTranslator},
+			},
+			valid: true,
+		},
+		{
+			name:    "authors keep the other contributors",
+			authors: []string{" Ursula K. Le Guin", "Jorge Luis Borges "},
+			want: []data.Contributor{
+				{Name: "Ursula K. Le Guin", Role: data.ContributorAuthor},
+				{Name: "Jorge Luis Borges", Role: data.ContributorAuthor},
+				current[1],
+				current[2],
+			},
+			valid: true,
+		},
+		{
+			name:    "no authors",
+			authors: []string{},
+			want:    []data.Contributor{current[1], current[2]},
+			valid:   true,
+		},
+		{
+			name:         "no contributors",
+			contributors: []data.Contributor{},
+			want:         []data.Contributor{},
+			valid:        true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			got := readContributors(v, tt.authors, tt.contributors, current)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readContributors() = %+v, want %+v", got, tt.want)
+			}
+			if v.IsEmpty() != tt.valid {
+				t.Errorf("readContributors() errors = %v, want valid %t", v.Errors, tt.valid)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/martinezmoises/Test3/internal/data"
+	"github.com/martinezmoises/Test3/internal/jwt"
 )
 
 // we need to create an alias for the 'user' key that we will add to
@@ -20,6 +21,16 @@ type contextKey string
 // also uses the key 'userContextKey' as the name of its key.
 const userContextKey = contextKey("user")
 
+// The plaintext authentication token used for the current request. We need
+// it to log the client out or to tell which of their sessions is this one
+const tokenContextKey = contextKey("token")
+
+// The verified claims of a signed access token (jwt auth mode only)
+const claimsContextKey = contextKey("claims")
+
+// The API key used for the current request, if the client sent one
+const apiKeyContextKey = contextKey("api_key")
+
 // Update the request context with the user information
 // We return the request context with user-info added
 func (a *applicationDependencies) contextSetUser(r *http.Request,
@@ -42,3 +53,60 @@ func (a *applicationDependencies) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+// Store the authentication token used for this request
+func (a *applicationDependencies) contextSetToken(r *http.Request,
+	token string) *http.Request {
+
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// Retrieve the authentication token used for this request. Anonymous
+// requests don't have one so we return an empty string instead of panicking
+func (a *applicationDependencies) contextGetToken(r *http.Request) string {
+	token, ok := r.Context().Value(tokenContextKey).(string)
+	if !ok {
+		return ""
+	}
+
+	return token
+}
+
+// Store the claims of the signed token used for this request
+func (a *applicationDependencies) contextSetClaims(r *http.Request,
+	claims *jwt.Claims) *http.Request {
+
+	ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+	return r.WithContext(ctx)
+}
+
+// Retrieve the claims of the signed token used for this request. Returns
+// nil in opaque mode or for anonymous requests
+func (a *applicationDependencies) contextGetClaims(r *http.Request) *jwt.Claims {
+	claims, ok := r.Context().Value(claimsContextKey).(*jwt.Claims)
+	if !ok {
+		return nil
+	}
+
+	return claims
+}
+
+// Store the API key used for this request
+func (a *applicationDependencies) contextSetApiKey(r *http.Request,
+	key *data.ApiKey) *http.Request {
+
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// Retrieve the API key used for this request. Returns nil when the request
+// was made with a bearer token or anonymously
+func (a *applicationDependencies) contextGetApiKey(r *http.Request) *data.ApiKey {
+	key, ok := r.Context().Value(apiKeyContextKey).(*data.ApiKey)
+	if !ok {
+		return nil
+	}
+
+	return key
+}
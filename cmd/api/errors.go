@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func (a *applicationDependencies) logError(r *http.Request, err error) {
@@ -57,6 +60,17 @@ func (a *applicationDependencies) editConflictResponse(w http.ResponseWriter, r
 
 }
 
+func (a *applicationDependencies) authorHasBooksResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this author is still credited on books, remove them from those books first"
+	a.errorResponseJSON(w, r, http.StatusConflict, message)
+}
+
+// The If-Match header didn't match the record's current ETag
+func (a *applicationDependencies) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the record has been changed since you last fetched it, please fetch it again"
+	a.errorResponseJSON(w, r, http.StatusPreconditionFailed, message)
+}
+
 // We set the WWW-Authenticate header to give a hint to the user as
 // to what they need to provide. Don't want to leave them guessing
 func (a *applicationDependencies) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
@@ -68,6 +82,15 @@ func (a *applicationDependencies) invalidAuthenticationTokenResponse(w http.Resp
 
 }
 
+func (a *applicationDependencies) invalidApiKeyResponse(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("WWW-Authenticate", "ApiKey")
+
+	message := "invalid or expired API key"
+	a.errorResponseJSON(w, r, http.StatusUnauthorized, message)
+
+}
+
 // Note: 401 is Unauthorized (anonymous) and 403 is Forbidden (authenticated
 // but not activated or don't have the right privilege)
 
@@ -80,3 +103,39 @@ func (a *applicationDependencies) inactiveAccountResponse(w http.ResponseWriter,
 	message := "your user account must be activated to access this resource"
 	a.errorResponseJSON(w, r, http.StatusForbidden, message)
 }
+
+func (a *applicationDependencies) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account doesn't have the necessary permissions to access this resource"
+	a.errorResponseJSON(w, r, http.StatusForbidden, message)
+}
+
+func (a *applicationDependencies) accountSuspendedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been suspended"
+	a.errorResponseJSON(w, r, http.StatusForbidden, message)
+}
+
+func (a *applicationDependencies) notOwnerResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you can only modify resources that you own"
+	a.errorResponseJSON(w, r, http.StatusForbidden, message)
+}
+
+// what names the hidden content, e.g. "reviews"
+func (a *applicationDependencies) privateContentResponse(w http.ResponseWriter, r *http.Request, what string) {
+	message := fmt.Sprintf("this user has made their %s private", what)
+	a.errorResponseJSON(w, r, http.StatusForbidden, message)
+}
+
+func (a *applicationDependencies) apiKeyNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource cannot be accessed with an API key"
+	a.errorResponseJSON(w, r, http.StatusForbidden, message)
+}
+
+// Too many failed logins. Retry-After tells the client how many seconds to
+// wait before trying again
+func (a *applicationDependencies) tooManyLoginAttemptsResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+
+	message := fmt.Sprintf("too many failed login attempts, please try again in %d seconds", seconds)
+	a.errorResponseJSON(w, r, http.StatusTooManyRequests, message)
+}
@@ -5,12 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/martinezmoises/Test3/internal/data"
+	"github.com/martinezmoises/Test3/internal/passwords"
 	"github.com/martinezmoises/Test3/internal/validator"
 )
 
@@ -134,6 +137,24 @@ func (a *applicationDependencies) getSingleIntegerParameter(queryParameters url.
 
 }
 
+// Split a comma separated query parameter, e.g. ?facets=genre,author,
+// into its values. Empty values are dropped
+func (a *applicationDependencies) getCSVParameter(queryParameters url.Values, key string, defaultValue []string) []string {
+	result := queryParameters.Get(key)
+	if result == "" {
+		return defaultValue
+	}
+
+	var values []string
+	for _, value := range strings.Split(result, ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
 // genericResponse sends a JSON response with a message
 func (a *applicationDependencies) genericResponse(w http.ResponseWriter, r *http.Request, statusCode int, message string) {
 	response := envelope{"message": message}
@@ -143,3 +164,49 @@ func (a *applicationDependencies) genericResponse(w http.ResponseWriter, r *http
 		a.serverErrorResponse(w, r, err)
 	}
 }
+
+// clientIP returns the IP address of the client that made the request
+func (a *applicationDependencies) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// background runs fn in its own goroutine. serve() waits on the WaitGroup
+// during shutdown so that work such as sending emails gets to finish, and
+// a panic in fn is logged instead of crashing the server
+func (a *applicationDependencies) background(fn func()) {
+	a.wg.Add(1)
+
+	go func() {
+		defer a.wg.Done()
+		defer func() {
+			err := recover()
+			if err != nil {
+				a.logger.Error(fmt.Sprintf("%v", err))
+			}
+		}()
+
+		fn()
+	}()
+}
+
+// Check a new password against the password policy. Errors go into v under
+// key. The returned error means the policy itself failed. The length is
+// checked first so the policy never sees a password we wouldn't store
+func (a *applicationDependencies) validateNewPassword(v *validator.Validator, key string, password string, user *data.User) error {
+	length := validator.New()
+	data.ValidatePasswordPlaintext(length, password)
+	if !length.IsEmpty() {
+		v.AddError(key, length.Errors["password"])
+		return nil
+	}
+
+	account := passwords.Account{
+		Username: user.Username,
+		Email:    user.Email,
+	}
+	return a.passwordPolicy.Validate(v, key, password, account)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+
+	"github.com/martinezmoises/Test3/internal/scheduler"
+)
+
+// Set up the background cleanup jobs. Nothing runs until Start() is called
+func (a *applicationDependencies) newScheduler(db *sql.DB) (*scheduler.Scheduler, error) {
+	s := scheduler.New(db, a.logger)
+
+	interval := a.config.scheduler.tokenInterval
+	jobs := []scheduler.Job{
+		{
+			Name:     "expired-tokens",
+			Interval: interval,
+			Jitter:   interval / 10,
+			Timeout:  time.Minute,
+			Run:      a.deleteExpiredTokensJob,
+		},
+		{
+			Name:     "stale-login-data",
+			Interval: interval,
+			Jitter:   interval / 10,
+			Timeout:  time.Minute,
+			Run:      a.deleteStaleLoginDataJob,
+		},
+	}
+
+	if a.config.account.purgeUnactivated > 0 {
+		jobs = append(jobs, scheduler.Job{
+			Name:     "unactivated-accounts",
+			Interval: time.Hour,
+			Jitter:   5 * time.Minute,
+			Timeout:  time.Minute,
+			Run:      a.purgeUnactivatedAccountsJob,
+		})
+	}
+
+	if a.config.audit.retentionDays > 0 {
+		jobs = append(jobs, scheduler.Job{
+			Name:     "audit-retention",
+			Interval: time.Hour,
+			Jitter:   5 * time.Minute,
+			Timeout:  2 * time.Minute,
+			Run:      a.purgeAuditEventsJob,
+		})
+	}
+
+	for _, job := range jobs {
+		err := s.Add(job)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Delete tokens of every scope that have expired, and denylist entries for
+// signed tokens that have expired anyway
+func (a *applicationDependencies) deleteExpiredTokensJob(ctx context.Context, logger *slog.Logger) error {
+	tokens, err := a.tokenModel.DeleteExpired(ctx)
+	if err != nil {
+		return err
+	}
+
+	denylisted, err := a.denylistModel.DeleteExpired(ctx)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("deleted expired tokens", "tokens", tokens, "denylist_entries", denylisted)
+	return nil
+}
+
+// Delete OIDC logins that were never finished and login throttles that no
+// longer block anything
+func (a *applicationDependencies) deleteStaleLoginDataJob(ctx context.Context, logger *slog.Logger) error {
+	logins, err := a.identityModel.DeleteExpiredLogins(ctx)
+	if err != nil {
+		return err
+	}
+
+	throttles, err := a.loginThrottleModel.DeleteStale(ctx, a.config.login.lockoutDuration)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("deleted stale login data", "oidc_logins", logins, "login_throttles", throttles)
+	return nil
+}
+
+// Delete accounts that were never activated. Users who have already written
+// reviews or reading lists are left alone
+func (a *applicationDependencies) purgeUnactivatedAccountsJob(ctx context.Context, logger *slog.Logger) error {
+	olderThan := time.Duration(a.config.account.purgeUnactivated) * 24 * time.Hour
+
+	count, err := a.userModel.DeleteUnactivated(ctx, olderThan)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("purged unactivated users", "count", count)
+	return nil
+}
+
+// Delete audit events older than the retention period. The log can't be
+// changed otherwise, see purge_audit_events() in the migrations
+func (a *applicationDependencies) purgeAuditEventsJob(ctx context.Context, logger *slog.Logger) error {
+	olderThan := time.Duration(a.config.audit.retentionDays) * 24 * time.Hour
+
+	count, err := a.auditModel.Purge(ctx, olderThan)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("purged old audit events", "count", count)
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/martinezmoises/Test3/internal/data"
+)
+
+// The longest we make a client wait between attempts before the lockout
+// kicks in
+const maxLoginBackoff = 30 * time.Second
+
+// How long the client must wait before trying to log in with this email
+// from this IP again. Zero means they can go ahead
+func (a *applicationDependencies) loginRetryAfter(r *http.Request, email string) (time.Duration, error) {
+	return a.loginThrottleModel.RetryAfter(
+		data.LoginThrottleEmailKey(email),
+		data.LoginThrottleIPKey(a.clientIP(r)),
+	)
+}
+
+// Count a failed login against the email and the IP. Each failure doubles
+// the wait before the next attempt, and after too many failures the key is
+// locked out. user is nil when nobody has that email address
+func (a *applicationDependencies) recordLoginFailure(r *http.Request, email string, user *data.User) error {
+	ip := a.clientIP(r)
+	keys := []struct {
+		key         string
+		maxFailures int
+	}{
+		{data.LoginThrottleEmailKey(email), a.config.login.maxFailures},
+		{data.LoginThrottleIPKey(ip), a.config.login.ipMaxFailures},
+	}
+
+	for i, k := range keys {
+		failures, err := a.loginThrottleModel.RecordFailure(k.key, a.config.login.lockoutDuration)
+		if err != nil {
+			return err
+		}
+
+		if failures < k.maxFailures {
+			backoff := time.Duration(math.Pow(2, float64(failures-1))) * time.Second
+			err = a.loginThrottleModel.Block(k.key, min(backoff, maxLoginBackoff))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = a.loginThrottleModel.Block(k.key, a.config.login.lockoutDuration)
+		if err != nil {
+			return err
+		}
+
+		// Tell the account owner the first time their account gets locked
+		isEmailKey := i == 0
+		if isEmailKey && failures == k.maxFailures && user != nil {
+			a.logger.Warn("account locked after failed logins", "user_id", user.ID, "ip", ip)
+			a.sendLockoutNotice(user, failures, ip)
+		}
+	}
+
+	return nil
+}
+
+// A successful login wipes the slate clean for the email. The IP is left
+// alone, or logging in to an account of your own between guesses at other
+// accounts would get around the per-IP limit. Its failures age out
+func (a *applicationDependencies) clearLoginFailures(email string) error {
+	return a.loginThrottleModel.Clear(data.LoginThrottleEmailKey(email))
+}
+
+func (a *applicationDependencies) sendLockoutNotice(user *data.User, failures int, ip string) {
+	a.background(func() {
+		emailData := map[string]any{
+			"failures":       failures,
+			"ipAddress":      ip,
+			"lockoutMinutes": int(a.config.login.lockoutDuration.Minutes()),
+		}
+
+		err := a.mailer.Send(user.Email, "account_locked.tmpl", emailData)
+		if err != nil {
+			a.logger.Error("failed to send account locked email",
+				"email", user.Email,
+				"error", err.Error(),
+			)
+		}
+	})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/martinezmoises/Test3/internal/data"
+	"github.com/martinezmoises/Test3/internal/validator"
+)
+
+// Email the user a single-use login link. Like the password reset
+// endpoint, the response is the same whether or not the email belongs to
+// an account, so it can't be used to find out who is a member
+func (a *applicationDependencies) createMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		Email string `json:"email"`
+	}
+
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateEmail(v, incomingData.Email)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	message := "an email will be sent to you containing a login link"
+
+	user, err := a.userModel.GetByEmail(incomingData.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.genericResponse(w, r, http.StatusAccepted, message)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Banned and deactivated users couldn't use the link anyway
+	if user.IsBanned() || user.DeactivatedAt != nil {
+		a.genericResponse(w, r, http.StatusAccepted, message)
+		return
+	}
+
+	// Only the most recent link works
+	err = a.tokenModel.DeleteAllForUser(data.ScopeMagicLogin, user.ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := a.tokenModel.New(user.ID, a.config.login.magicLinkTTL, data.ScopeMagicLogin)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	a.audit(r, data.AuditMagicLinkRequest, user.ID, data.AuditSuccess, nil)
+
+	emailData := map[string]any{
+		"magicLoginToken": token.Plaintext,
+		"expiryMinutes":   int(a.config.login.magicLinkTTL.Minutes()),
+	}
+	if a.config.login.magicLinkURL != "" {
+		emailData["magicLoginURL"] = a.config.login.magicLinkURL + "?token=" + url.QueryEscape(token.Plaintext)
+	}
+
+	a.background(func() {
+		err := a.mailer.Send(user.Email, "magic_login.tmpl", emailData)
+		if err != nil {
+			a.logger.Error("failed to send magic login email",
+				"email", user.Email,
+				"error", err.Error(),
+			)
+		}
+	})
+
+	a.genericResponse(w, r, http.StatusAccepted, message)
+}
+
+// Exchange a magic login token for authentication and refresh tokens. The
+// token is used up even if the login doesn't go through
+func (a *applicationDependencies) createMagicLoginTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		Token string `json:"token"`
+	}
+
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, incomingData.Token)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	userID, err := a.tokenModel.Consume(data.ScopeMagicLogin, incomingData.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.audit(r, data.AuditLoginMagicLink, 0, data.AuditFailure, map[string]any{"reason": "invalid_token"})
+			v.AddError("token", "invalid or expired login link")
+			a.failedValidationResponse(w, r, v.Errors)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := a.userModel.GetByID(userID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user.IsBanned() {
+		a.audit(r, data.AuditLoginMagicLink, user.ID, data.AuditFailure, map[string]any{"reason": "banned"})
+		a.accountSuspendedResponse(w, r)
+		return
+	}
+
+	// A link sent before an admin deactivated the account
+	if user.DeactivatedAt != nil {
+		a.audit(r, data.AuditLoginMagicLink, user.ID, data.AuditFailure, map[string]any{"reason": "deactivated"})
+		a.inactiveAccountResponse(w, r)
+		return
+	}
+
+	// The link stands in for the password, not for the second factor
+	enabled, err := a.twoFactorModel.IsEnabled(user.ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	if enabled {
+		a.audit(r, data.AuditLoginMagicLink, user.ID, data.AuditSuccess, map[string]any{"2fa": "pending"})
+		a.writeTwoFactorPendingToken(w, r, user)
+		return
+	}
+
+	a.audit(r, data.AuditLoginMagicLink, user.ID, data.AuditSuccess, nil)
+
+	a.writeLoginTokens(w, r, user)
+}
@@ -5,12 +5,18 @@ import (
 	"database/sql"
 	"flag"
 	"log/slog"
+	"math"
+	"net/http"
 	"os"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/martinezmoises/Test3/internal/jwt"
 	"github.com/martinezmoises/Test3/internal/mailer"
+	"github.com/martinezmoises/Test3/internal/oidc"
+	"github.com/martinezmoises/Test3/internal/passwords"
+	"github.com/martinezmoises/Test3/internal/scheduler"
 
 	_ "github.com/lib/pq"
 	"github.com/martinezmoises/Test3/internal/data"
@@ -41,18 +47,84 @@ type serverConfig struct {
 	cors struct {
 		trustedOrigins []string
 	}
+
+	account struct {
+		deletionPolicy   string
+		purgeUnactivated int
+	}
+
+	password struct {
+		minScore    int
+		breachedDir string
+		hash        string
+		bcryptCost  int
+		argon2      struct {
+			memory      uint
+			iterations  uint
+			parallelism uint
+		}
+	}
+
+	audit struct {
+		retentionDays int
+	}
+
+	scheduler struct {
+		enabled       bool
+		tokenInterval time.Duration
+	}
+
+	login struct {
+		maxFailures     int
+		ipMaxFailures   int
+		lockoutDuration time.Duration
+		magicLinkTTL    time.Duration
+		magicLinkURL    string
+	}
+
+	oidc struct {
+		issuer       string
+		clientID     string
+		clientSecret string
+		redirectURL  string
+	}
+
+	auth struct {
+		mode            string
+		accessTokenTTL  time.Duration
+		refreshTokenTTL time.Duration
+		jwt             struct {
+			algorithm string
+			keys      string
+			activeKey string
+		}
+	}
 }
 
 type applicationDependencies struct {
-	config           serverConfig
-	logger           *slog.Logger
-	bookModel        data.BookModel
-	readingListModel data.ReadingListModel
-	reviewModel      data.ReviewModel // Add reviewModel
-	userModel        data.UserModel
-	mailer           mailer.Mailer
-	wg               sync.WaitGroup
-	tokenModel       data.TokenModel
+	config             serverConfig
+	logger             *slog.Logger
+	bookModel          data.BookModel
+	authorModel        data.AuthorModel
+	readingListModel   data.ReadingListModel
+	reviewModel        data.ReviewModel // Add reviewModel
+	userModel          data.UserModel
+	mailer             mailer.Mailer
+	wg                 sync.WaitGroup
+	tokenModel         data.TokenModel
+	permissionModel    data.PermissionModel
+	denylistModel      data.DenylistModel
+	twoFactorModel     data.TwoFactorModel
+	loginThrottleModel data.LoginThrottleModel
+	apiKeyModel        data.ApiKeyModel
+	identityModel      data.IdentityModel
+	auditModel         data.AuditModel
+	keySet             *jwt.KeySet
+	oidcProvider       *oidc.Provider
+	passwordPolicy     *passwords.Policy
+	denylist           *tokenDenylist
+	auditSampler       *auditSampler
+	scheduler          *scheduler.Scheduler
 }
 
 func main() {
@@ -73,6 +145,33 @@ func main() {
 	flag.Float64Var(&settings.limiter.rps, "limiter-rps", 2, "Rate Limiter maximum requests per second")
 	flag.IntVar(&settings.limiter.burst, "limiter-burst", 5, "Rate Limiter maximum burst")
 	flag.BoolVar(&settings.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	flag.StringVar(&settings.account.deletionPolicy, "account-deletion-policy", deletionPolicyAnonymize, "What happens to reviews and lists of deleted accounts (cascade|anonymize)")
+	flag.IntVar(&settings.account.purgeUnactivated, "purge-unactivated-days", 0, "Delete accounts still unactivated after this many days (0 disables)")
+	flag.IntVar(&settings.audit.retentionDays, "audit-retention-days", 365, "Delete audit events older than this many days, at least 30 (0 keeps them forever)")
+	flag.BoolVar(&settings.scheduler.enabled, "scheduler-enabled", true, "Run background cleanup jobs")
+	flag.DurationVar(&settings.scheduler.tokenInterval, "scheduler-token-interval", time.Hour, "How often expired tokens and login data are deleted")
+	flag.IntVar(&settings.password.minScore, "password-min-score", 2, "Minimum password strength score (0-4)")
+	flag.StringVar(&settings.password.breachedDir, "password-breached-dir", "", "Directory of breached password range files (empty disables the check)")
+	flag.StringVar(&settings.password.hash, "password-hash", data.HashBcrypt, "Password hashing algorithm for new hashes (bcrypt|argon2id)")
+	flag.IntVar(&settings.password.bcryptCost, "bcrypt-cost", 12, "bcrypt cost")
+	flag.UintVar(&settings.password.argon2.memory, "argon2-memory", 64*1024, "argon2id memory in KiB")
+	flag.UintVar(&settings.password.argon2.iterations, "argon2-iterations", 3, "argon2id iterations")
+	flag.UintVar(&settings.password.argon2.parallelism, "argon2-parallelism", 2, "argon2id threads")
+	flag.IntVar(&settings.login.maxFailures, "login-max-failures", 5, "Failed logins for one email before it is locked")
+	flag.IntVar(&settings.login.ipMaxFailures, "login-ip-max-failures", 50, "Failed logins from one IP before it is locked")
+	flag.DurationVar(&settings.login.lockoutDuration, "login-lockout-duration", 15*time.Minute, "How long a locked email or IP stays locked")
+	flag.DurationVar(&settings.login.magicLinkTTL, "magic-link-ttl", 15*time.Minute, "Lifetime of magic login links")
+	flag.StringVar(&settings.login.magicLinkURL, "magic-link-url", "", "Page the magic login link points to, the token is added as ?token= (empty sends just the token)")
+	flag.StringVar(&settings.auth.mode, "auth-mode", authModeOpaque, "Authentication token backend (opaque|jwt)")
+	flag.StringVar(&settings.auth.jwt.algorithm, "jwt-alg", jwt.AlgHS256, "Signing algorithm for jwt auth mode (HS256|EdDSA)")
+	flag.StringVar(&settings.auth.jwt.keys, "jwt-keys", "", "Signing keys for jwt auth mode (space separated kid=base64)")
+	flag.StringVar(&settings.auth.jwt.activeKey, "jwt-active-key", "", "Key ID used to sign new tokens (defaults to the first key)")
+	flag.DurationVar(&settings.auth.accessTokenTTL, "auth-access-token-ttl", 15*time.Minute, "Lifetime of authentication (access) tokens")
+	flag.DurationVar(&settings.auth.refreshTokenTTL, "auth-refresh-token-ttl", 30*24*time.Hour, "Lifetime of refresh tokens")
+	flag.StringVar(&settings.oidc.issuer, "oidc-issuer", "", "OpenID Connect issuer URL (empty disables OIDC login)")
+	flag.StringVar(&settings.oidc.clientID, "oidc-client-id", "", "OpenID Connect client ID")
+	flag.StringVar(&settings.oidc.clientSecret, "oidc-client-secret", "", "OpenID Connect client secret (empty for a public client)")
+	flag.StringVar(&settings.oidc.redirectURL, "oidc-redirect-url", "", "Where the identity provider sends users back to")
 	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)",
 		func(val string) error {
 			settings.cors.trustedOrigins = strings.Fields(val)
@@ -95,15 +194,116 @@ func main() {
 
 	logger.Info("database connection pool established")
 
+	// Both of these are jobs run by the scheduler
+	if !settings.scheduler.enabled && settings.account.purgeUnactivated > 0 {
+		logger.Error("purge-unactivated-days needs the scheduler, which scheduler-enabled=false turns off")
+		os.Exit(1)
+	}
+	if !settings.scheduler.enabled && settings.audit.retentionDays > 0 {
+		logger.Warn("the scheduler is turned off, so old audit events won't be purged", "audit_retention_days", settings.audit.retentionDays)
+	}
+
+	if settings.audit.retentionDays != 0 && settings.audit.retentionDays < 30 {
+		logger.Error("audit events must be kept for at least 30 days", "audit_retention_days", settings.audit.retentionDays)
+		os.Exit(1)
+	}
+
+	hashing := data.PasswordHashing{
+		Algorithm:  settings.password.hash,
+		BcryptCost: settings.password.bcryptCost,
+		Argon2: data.Argon2Params{
+			Memory:      uint32(min(settings.password.argon2.memory, math.MaxUint32)),
+			Iterations:  uint32(min(settings.password.argon2.iterations, math.MaxUint32)),
+			Parallelism: uint8(min(settings.password.argon2.parallelism, math.MaxUint8)),
+		},
+	}
+	err = hashing.Validate()
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
 	appInstance := &applicationDependencies{
-		config:           settings,
-		logger:           logger,
-		bookModel:        data.BookModel{DB: db},        // Initialize BookModel
-		readingListModel: data.ReadingListModel{DB: db}, // Initialize ReadingListModel
-		reviewModel:      data.ReviewModel{DB: db},      // Initialize ReviewModel
-		userModel:        data.UserModel{DB: db},        // Initialize UserModel
-		mailer:           mailer.New(settings.smtp.host, settings.smtp.port, settings.smtp.username, settings.smtp.password, settings.smtp.sender),
-		tokenModel:       data.TokenModel{DB: db}, // Initialize TokenModel
+		config:             settings,
+		logger:             logger,
+		bookModel:          data.BookModel{DB: db},        // Initialize BookModel
+		authorModel:        data.AuthorModel{DB: db},      // Initialize AuthorModel
+		readingListModel:   data.ReadingListModel{DB: db}, // Initialize ReadingListModel
+		reviewModel:        data.ReviewModel{DB: db},      // Initialize ReviewModel
+		userModel:          data.UserModel{DB: db, Hashing: hashing},
+		mailer:             mailer.New(settings.smtp.host, settings.smtp.port, settings.smtp.username, settings.smtp.password, settings.smtp.sender),
+		tokenModel:         data.TokenModel{DB: db}, // Initialize TokenModel
+		permissionModel:    data.PermissionModel{DB: db},
+		denylistModel:      data.DenylistModel{DB: db},
+		twoFactorModel:     data.TwoFactorModel{DB: db},
+		loginThrottleModel: data.LoginThrottleModel{DB: db},
+		apiKeyModel:        data.ApiKeyModel{DB: db},
+		identityModel:      data.IdentityModel{DB: db},
+		auditModel:         data.AuditModel{DB: db},
+		denylist:           &tokenDenylist{entries: make(map[string]time.Time)},
+		auditSampler:       &auditSampler{held: make(map[string]*heldAuditEvent)},
+	}
+
+	if settings.account.deletionPolicy != deletionPolicyCascade && settings.account.deletionPolicy != deletionPolicyAnonymize {
+		logger.Error("invalid account deletion policy", "account_deletion_policy", settings.account.deletionPolicy)
+		os.Exit(1)
+	}
+
+	checkers := []passwords.Checker{
+		passwords.NoPersonalInfo(),
+		passwords.MinStrength(settings.password.minScore),
+	}
+	if settings.password.breachedDir != "" {
+		breached, err := passwords.NewBreached(settings.password.breachedDir)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		checkers = append(checkers, breached)
+	}
+	appInstance.passwordPolicy = passwords.NewPolicy(checkers...)
+
+	if settings.oidc.issuer != "" {
+		if settings.oidc.clientID == "" || settings.oidc.redirectURL == "" {
+			logger.Error("oidc-client-id and oidc-redirect-url are required when oidc-issuer is set")
+			os.Exit(1)
+		}
+		config := oidc.Config{
+			Issuer:       settings.oidc.issuer,
+			ClientID:     settings.oidc.clientID,
+			ClientSecret: settings.oidc.clientSecret,
+			RedirectURL:  settings.oidc.redirectURL,
+		}
+		appInstance.oidcProvider = oidc.NewProvider(config, &http.Client{Timeout: 10 * time.Second})
+	}
+
+	switch settings.auth.mode {
+	case authModeOpaque:
+	case authModeJWT:
+		appInstance.keySet, err = jwt.NewKeySet(settings.auth.jwt.algorithm, signedTokenIssuer, settings.auth.jwt.keys, settings.auth.jwt.activeKey)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		err = appInstance.startDenylistRefresh()
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	default:
+		logger.Error("invalid auth mode", "auth_mode", settings.auth.mode)
+		os.Exit(1)
+	}
+
+	appInstance.startAuditSampling()
+
+	if settings.scheduler.enabled {
+		appInstance.scheduler, err = appInstance.newScheduler(db)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		appInstance.scheduler.Start()
 	}
 
 	//router := http.NewServeMux()
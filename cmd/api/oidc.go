@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/martinezmoises/Test3/internal/data"
+	"github.com/martinezmoises/Test3/internal/oidc"
+	"github.com/martinezmoises/Test3/internal/validator"
+)
+
+// How long a user has to finish logging in at the identity provider
+const oidcLoginTTL = 10 * time.Minute
+
+// Start an OpenID Connect login. The client sends the user to the returned
+// URL. The provider sends them back to the configured redirect URL with a
+// code and the state, which the client posts to /v1/tokens/oidc
+func (a *applicationDependencies) beginOIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if a.oidcProvider == nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	state, err := oidc.RandomString()
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	nonce, err := oidc.RandomString()
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	authURL, err := a.oidcProvider.AuthCodeURL(r.Context(), state, nonce, challenge)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = a.identityModel.SaveLogin(state, data.OIDCLogin{Nonce: nonce, CodeVerifier: verifier}, oidcLoginTTL)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The client should keep the state and check that the provider hands
+	// the same one back before posting the code to us
+	data := envelope{
+		"authorization_url": authURL,
+		"state":             state,
+	}
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// Finish an OpenID Connect login. We trade the code for an ID token, find
+// (or create) the user it belongs to and log them in like a password login
+func (a *applicationDependencies) createOIDCTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if a.oidcProvider == nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	var incomingData struct {
+		Code  string `json:"code"`
+		State string `json:"state"`
+	}
+
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(incomingData.Code != "", "code", "must be provided")
+	v.Check(incomingData.State != "", "state", "must be provided")
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	login, err := a.identityModel.TakeLogin(incomingData.State)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("state", "invalid or expired login")
+			a.failedValidationResponse(w, r, v.Errors)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	idToken, err := a.oidcProvider.Exchange(r.Context(), incomingData.Code, login.CodeVerifier)
+	if err != nil {
+		a.logger.Warn("oidc code exchange failed", "error", err.Error(), "ip", a.clientIP(r))
+		a.audit(r, data.AuditLoginOIDC, 0, data.AuditFailure, map[string]any{"reason": "code_exchange"})
+		a.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	claims, err := a.oidcProvider.Verify(r.Context(), idToken, login.Nonce, time.Now())
+	if err != nil {
+		a.logger.Warn("oidc id token rejected", "error", err.Error(), "ip", a.clientIP(r))
+		a.audit(r, data.AuditLoginOIDC, 0, data.AuditFailure, map[string]any{"reason": "invalid_id_token"})
+		a.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	user, err := a.userForIdentity(r, claims)
+	if err != nil {
+		switch {
+		case errors.Is(err, errUnverifiedIdentityEmail):
+			v.AddError("email", "the identity provider did not supply a verified email address")
+			a.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, errInvalidIdentityProfile):
+			v.AddError("email", "the identity provider supplied a name or email address we can't use")
+			a.failedValidationResponse(w, r, v.Errors)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.IsBanned() {
+		a.audit(r, data.AuditLoginOIDC, user.ID, data.AuditFailure, map[string]any{"reason": "banned"})
+		a.accountSuspendedResponse(w, r)
+		return
+	}
+
+	if user.DeactivatedAt != nil {
+		a.audit(r, data.AuditLoginOIDC, user.ID, data.AuditFailure, map[string]any{"reason": "deactivated"})
+		a.inactiveAccountResponse(w, r)
+		return
+	}
+
+	// The provider replaces the password, not our second factor
+	enabled, err := a.twoFactorModel.IsEnabled(user.ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	if enabled {
+		a.audit(r, data.AuditLoginOIDC, user.ID, data.AuditSuccess, map[string]any{"2fa": "pending"})
+		a.writeTwoFactorPendingToken(w, r, user)
+		return
+	}
+
+	a.audit(r, data.AuditLoginOIDC, user.ID, data.AuditSuccess, nil)
+
+	a.writeLoginTokens(w, r, user)
+}
+
+var errUnverifiedIdentityEmail = errors.New("identity has no verified email address")
+var errInvalidIdentityProfile = errors.New("identity has an unusable name or email address")
+
+// Find the user an external identity belongs to. The first time we see an
+// identity it is linked to the account with the same email address, or a
+// new account is created. Either way we need the provider to vouch for
+// the email address, otherwise anyone could claim someone else's account
+func (a *applicationDependencies) userForIdentity(r *http.Request, claims *oidc.Claims) (*data.User, error) {
+	issuer := a.config.oidc.issuer
+
+	user, err := a.identityModel.GetUser(issuer, claims.Subject)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, errUnverifiedIdentityEmail
+	}
+
+	user, err = a.userModel.GetByEmail(claims.Email)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		user, err = a.createIdentityUser(claims)
+		// Two first logins with the same identity can race. The loser
+		// carries on with the account the winner created
+		if errors.Is(err, data.ErrDuplicateEmail) {
+			user, err = a.userModel.GetByEmail(claims.Email)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The provider has confirmed the address, which is all that activation
+	// does. But anyone can register with an address they don't own, so an
+	// account that was never activated is handed over clean: a new
+	// password, no sessions, API keys or 2FA. Accounts an admin deactivated
+	// aren't activated either, but they are left as they are
+	if !user.Activated && user.DeactivatedAt == nil {
+		err = a.reclaimUser(r, user)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	identity := &data.Identity{
+		UserID:  user.ID,
+		Issuer:  issuer,
+		Subject: claims.Subject,
+		Email:   claims.Email,
+	}
+	err = a.identityModel.Insert(identity)
+	if err != nil {
+		// Another login with the same identity linked it first
+		if errors.Is(err, data.ErrDuplicateIdentity) {
+			return a.identityModel.GetUser(issuer, claims.Subject)
+		}
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Hand an unactivated account to the identity's owner, see
+// UserModel.Reclaim. Signed access tokens are denylisted first
+func (a *applicationDependencies) reclaimUser(r *http.Request, user *data.User) error {
+	err := a.revokeSessions(r, user.ID, false)
+	if err != nil {
+		return err
+	}
+	err = a.setRandomPassword(user)
+	if err != nil {
+		return err
+	}
+
+	err = a.userModel.Reclaim(user)
+	if !errors.Is(err, data.ErrEditConflict) {
+		return err
+	}
+
+	// A login racing with this one may have reclaimed it already. Either
+	// way it is safe to go again with the latest version
+	current, err := a.userModel.GetByID(user.ID)
+	if err != nil {
+		return err
+	}
+	if !current.Activated && current.DeactivatedAt == nil {
+		err = a.setRandomPassword(current)
+		if err != nil {
+			return err
+		}
+		err = a.userModel.Reclaim(current)
+		if err != nil {
+			return err
+		}
+	}
+	*user = *current
+	return nil
+}
+
+// Create an activated account for someone signing in with an identity
+// provider for the first time. They get a random password they can reset
+// later if they want to log in without the provider
+func (a *applicationDependencies) createIdentityUser(claims *oidc.Claims) (*data.User, error) {
+	username := claims.Name
+	if username == "" {
+		username = claims.PreferredUsername
+	}
+	if username == "" {
+		username, _, _ = strings.Cut(claims.Email, "@")
+	}
+	// Usernames are limited to 200 bytes. Cut on a character boundary
+	// rather than through the middle of one
+	for len(username) > 200 {
+		_, size := utf8.DecodeLastRuneInString(username)
+		username = username[:len(username)-size]
+	}
+
+	user := &data.User{
+		Username:  username,
+		Email:     claims.Email,
+		Activated: true,
+	}
+
+	err := a.setRandomPassword(user)
+	if err != nil {
+		return nil, err
+	}
+
+	// The provider's claims are checked like any other registration
+	v := validator.New()
+	data.ValidateUser(v, user)
+	if !v.IsEmpty() {
+		return nil, errInvalidIdentityProfile
+	}
+
+	err = a.userModel.Insert(user, data.RoleMember)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Give a user a password nobody knows. They can reset it if they want to
+// log in without the provider
+func (a *applicationDependencies) setRandomPassword(user *data.User) error {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+	return a.userModel.SetPassword(user, hex.EncodeToString(randomBytes))
+}
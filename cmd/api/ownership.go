@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/martinezmoises/Test3/internal/data"
+)
+
+// Reviews and reading lists belong to the user who created them. Only that
+// user may change or delete them, unless the current user is an admin.
+// ownerID is the user ID stored on the resource (reviews.user_id or
+// reading_lists.created_by)
+func (a *applicationDependencies) canModify(r *http.Request, ownerID int64) (bool, error) {
+	user := a.contextGetUser(r)
+	if user.ID == ownerID {
+		return true, nil
+	}
+
+	// Not the owner, so fall back to the admin override
+	return a.isAdmin(r)
+}
+
+// Report whether the current user is an admin
+func (a *applicationDependencies) isAdmin(r *http.Request) (bool, error) {
+	user := a.contextGetUser(r)
+	if user.IsAnonymous() {
+		return false, nil
+	}
+
+	permissions, err := a.permissionModel.GetAllForUser(user.ID)
+	if err != nil {
+		return false, err
+	}
+
+	return permissions.Include(data.PermissionAdmin), nil
+}
+
+// Reading lists and reviews are public unless their owner has made them
+// private in their privacy settings. Private ones are still visible to the
+// owner and to admins, who can change or delete them anyway. The list
+// endpoints follow the same rule, see ReadingListModel.GetAll() and
+// ReviewModel.GetAll(). Returns data.ErrRecordNotFound if there is no such
+// user
+func (a *applicationDependencies) canSeeLists(r *http.Request, ownerID int64) (bool, error) {
+	privacy, err := a.userModel.GetPrivacy(ownerID)
+	if err != nil {
+		return false, err
+	}
+	if privacy.Lists == data.VisibilityPublic {
+		return true, nil
+	}
+
+	return a.canModify(r, ownerID)
+}
+
+func (a *applicationDependencies) canSeeReviews(r *http.Request, ownerID int64) (bool, error) {
+	privacy, err := a.userModel.GetPrivacy(ownerID)
+	if err != nil {
+		return false, err
+	}
+	if privacy.Reviews == data.VisibilityPublic {
+		return true, nil
+	}
+
+	return a.canModify(r, ownerID)
+}
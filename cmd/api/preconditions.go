@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The ETag of a book, author, reading list or review is its version number,
+// which goes up with every edit. Some of what we send back can change
+// without an edit, e.g. a book's rating is worked out from its reviews and
+// its author names come from the authors table. Those values are passed as
+// derived and a hash of them is added to the ETag, so it still changes
+// whenever the response body does. Reviews can't be fetched on their own,
+// so clients take their ETag from the response to creating or updating one
+func etag(version int, derived ...any) string {
+	tag := strconv.Itoa(version)
+	if len(derived) > 0 {
+		// Only fails for values that can't be JSON, which derived never has
+		js, _ := json.Marshal(derived)
+		sum := sha256.Sum256(js)
+		tag += "-" + hex.EncodeToString(sum[:8])
+	}
+	return strconv.Quote(tag)
+}
+
+func etagHeaders(version int, derived ...any) http.Header {
+	headers := make(http.Header)
+	headers.Set("ETag", etag(version, derived...))
+	return headers
+}
+
+// Check the If-Match and X-Expected-Version headers against the version of
+// the record about to be changed. A client sends one of them to make sure
+// it isn't overwriting an edit it hasn't seen. If either doesn't match a
+// 412 has been sent and false is returned. Without the headers the change
+// goes ahead, but the update itself is still version checked, and an edit
+// that slips in between this check and the update gets a 409 from there.
+// derived is the same as for etag()
+func (a *applicationDependencies) checkPreconditions(w http.ResponseWriter, r *http.Request, version int, derived ...any) bool {
+	if value := r.Header.Get("X-Expected-Version"); value != "" {
+		expected, err := strconv.Atoi(value)
+		if err != nil {
+			a.badRequestResponse(w, r, errors.New("X-Expected-Version header must be an integer"))
+			return false
+		}
+		if expected != version {
+			a.preconditionFailedResponse(w, r)
+			return false
+		}
+	}
+
+	if header := r.Header.Get("If-Match"); header != "" && !etagMatches(header, etag(version, derived...)) {
+		a.preconditionFailedResponse(w, r)
+		return false
+	}
+
+	return true
+}
+
+// If-Match is "*" or a comma separated list of ETags. It uses the strong
+// comparison, so a weak ETag (W/"...") never matches
+func etagMatches(header string, current string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == current {
+			return true
+		}
+	}
+	return false
+}
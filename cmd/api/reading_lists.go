@@ -10,7 +10,13 @@ import (
 )
 
 func (a *applicationDependencies) listReadingListsHandler(w http.ResponseWriter, r *http.Request) {
-	lists, err := a.readingListModel.GetAll()
+	isAdmin, err := a.isAdmin(r)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	lists, err := a.readingListModel.GetAll(a.contextGetUser(r).ID, isAdmin)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 		return
@@ -39,7 +45,17 @@ func (a *applicationDependencies) getReadingListHandler(w http.ResponseWriter, r
 		return
 	}
 
-	err = a.writeJSON(w, http.StatusOK, envelope{"reading_list": list}, nil)
+	visible, err := a.canSeeLists(r, list.CreatedBy)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	if !visible {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	err = a.writeJSON(w, http.StatusOK, envelope{"reading_list": list}, etagHeaders(list.Version))
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
@@ -49,7 +65,6 @@ func (a *applicationDependencies) createReadingListHandler(w http.ResponseWriter
 	var incomingData struct {
 		Name        string  `json:"name"`
 		Description string  `json:"description"`
-		CreatedBy   int64   `json:"created_by"`
 		Books       []int64 `json:"books"`
 		Status      string  `json:"status"`
 	}
@@ -60,10 +75,13 @@ func (a *applicationDependencies) createReadingListHandler(w http.ResponseWriter
 		return
 	}
 
+	// The list always belongs to the user making the request
+	user := a.contextGetUser(r)
+
 	list := &data.ReadingList{
 		Name:        incomingData.Name,
 		Description: incomingData.Description,
-		CreatedBy:   incomingData.CreatedBy,
+		CreatedBy:   user.ID,
 		Books:       incomingData.Books,
 		Status:      incomingData.Status,
 	}
@@ -81,7 +99,7 @@ func (a *applicationDependencies) createReadingListHandler(w http.ResponseWriter
 		return
 	}
 
-	headers := make(http.Header)
+	headers := etagHeaders(list.Version)
 	headers.Set("Location", fmt.Sprintf("/api/v1/lists/%d", list.ID))
 
 	err = a.writeJSON(w, http.StatusCreated, envelope{"reading_list": list}, headers)
@@ -107,6 +125,20 @@ func (a *applicationDependencies) updateReadingListHandler(w http.ResponseWriter
 		return
 	}
 
+	allowed, err := a.canModify(r, list.CreatedBy)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	if !allowed {
+		a.notOwnerResponse(w, r)
+		return
+	}
+
+	if !a.checkPreconditions(w, r, list.Version) {
+		return
+	}
+
 	var incomingData struct {
 		Name        *string  `json:"name"`
 		Description *string  `json:"description"`
@@ -142,11 +174,16 @@ func (a *applicationDependencies) updateReadingListHandler(w http.ResponseWriter
 
 	err = a.readingListModel.Update(list)
 	if err != nil {
-		a.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflictResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	err = a.writeJSON(w, http.StatusOK, envelope{"reading_list": list}, nil)
+	err = a.writeJSON(w, http.StatusOK, envelope{"reading_list": list}, etagHeaders(list.Version))
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
@@ -159,7 +196,7 @@ func (a *applicationDependencies) deleteReadingListHandler(w http.ResponseWriter
 		return
 	}
 
-	err = a.readingListModel.Delete(id)
+	list, err := a.readingListModel.Get(id)
 	if err != nil {
 		if errors.Is(err, data.ErrRecordNotFound) {
 			a.notFoundResponse(w, r)
@@ -169,6 +206,31 @@ func (a *applicationDependencies) deleteReadingListHandler(w http.ResponseWriter
 		return
 	}
 
+	allowed, err := a.canModify(r, list.CreatedBy)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	if !allowed {
+		a.notOwnerResponse(w, r)
+		return
+	}
+
+	if !a.checkPreconditions(w, r, list.Version) {
+		return
+	}
+
+	err = a.readingListModel.Delete(list.ID, list.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflictResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
 	err = a.writeJSON(w, http.StatusOK, envelope{"message": "reading list successfully deleted"}, nil)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
@@ -182,6 +244,30 @@ func (a *applicationDependencies) addBookToListHandler(w http.ResponseWriter, r
 		return
 	}
 
+	list, err := a.readingListModel.Get(id)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			a.notFoundResponse(w, r)
+		} else {
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	allowed, err := a.canModify(r, list.CreatedBy)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	if !allowed {
+		a.notOwnerResponse(w, r)
+		return
+	}
+
+	if !a.checkPreconditions(w, r, list.Version) {
+		return
+	}
+
 	var incomingData struct {
 		BookID int64 `json:"book_id"`
 	}
@@ -192,13 +278,18 @@ func (a *applicationDependencies) addBookToListHandler(w http.ResponseWriter, r
 		return
 	}
 
-	err = a.readingListModel.AddBook(id, incomingData.BookID)
+	err = a.readingListModel.AddBook(list, incomingData.BookID)
 	if err != nil {
-		a.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflictResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	err = a.writeJSON(w, http.StatusOK, envelope{"message": "book successfully added to reading list"}, nil)
+	err = a.writeJSON(w, http.StatusOK, envelope{"message": "book successfully added to reading list"}, etagHeaders(list.Version))
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
@@ -211,6 +302,30 @@ func (a *applicationDependencies) removeBookFromListHandler(w http.ResponseWrite
 		return
 	}
 
+	list, err := a.readingListModel.Get(id)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			a.notFoundResponse(w, r)
+		} else {
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	allowed, err := a.canModify(r, list.CreatedBy)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	if !allowed {
+		a.notOwnerResponse(w, r)
+		return
+	}
+
+	if !a.checkPreconditions(w, r, list.Version) {
+		return
+	}
+
 	var incomingData struct {
 		BookID int64 `json:"book_id"`
 	}
@@ -221,13 +336,18 @@ func (a *applicationDependencies) removeBookFromListHandler(w http.ResponseWrite
 		return
 	}
 
-	err = a.readingListModel.RemoveBook(id, incomingData.BookID)
+	err = a.readingListModel.RemoveBook(list, incomingData.BookID)
 	if err != nil {
-		a.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflictResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	err = a.writeJSON(w, http.StatusOK, envelope{"message": "book successfully removed from reading list"}, nil)
+	err = a.writeJSON(w, http.StatusOK, envelope{"message": "book successfully removed from reading list"}, etagHeaders(list.Version))
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
@@ -16,7 +16,13 @@ func (a *applicationDependencies) listReviewsHandler(w http.ResponseWriter, r *h
 		return
 	}
 
-	reviews, err := a.reviewModel.GetAll(bookID)
+	isAdmin, err := a.isAdmin(r)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	reviews, err := a.reviewModel.GetAll(bookID, a.contextGetUser(r).ID, isAdmin)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 		return
@@ -36,7 +42,6 @@ func (a *applicationDependencies) createReviewHandler(w http.ResponseWriter, r *
 	}
 
 	var incomingData struct {
-		UserID int64   `json:"user_id"`
 		Rating float64 `json:"rating"`
 		Review string  `json:"review"`
 	}
@@ -47,9 +52,12 @@ func (a *applicationDependencies) createReviewHandler(w http.ResponseWriter, r *
 		return
 	}
 
+	// The review always belongs to the user making the request
+	user := a.contextGetUser(r)
+
 	review := &data.Review{
 		BookID: bookID,
-		UserID: incomingData.UserID,
+		UserID: user.ID,
 		Rating: incomingData.Rating,
 		Review: incomingData.Review,
 	}
@@ -67,7 +75,7 @@ func (a *applicationDependencies) createReviewHandler(w http.ResponseWriter, r *
 		return
 	}
 
-	headers := make(http.Header)
+	headers := etagHeaders(review.Version)
 	headers.Set("Location", fmt.Sprintf("/api/v1/reviews/%d", review.ID))
 
 	err = a.writeJSON(w, http.StatusCreated, envelope{"review": review}, headers)
@@ -93,6 +101,20 @@ func (a *applicationDependencies) updateReviewHandler(w http.ResponseWriter, r *
 		return
 	}
 
+	allowed, err := a.canModify(r, review.UserID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	if !allowed {
+		a.notOwnerResponse(w, r)
+		return
+	}
+
+	if !a.checkPreconditions(w, r, review.Version) {
+		return
+	}
+
 	var incomingData struct {
 		Rating *float64 `json:"rating"`
 		Review *string  `json:"review"`
@@ -120,11 +142,16 @@ func (a *applicationDependencies) updateReviewHandler(w http.ResponseWriter, r *
 
 	err = a.reviewModel.Update(review)
 	if err != nil {
-		a.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflictResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	err = a.writeJSON(w, http.StatusOK, envelope{"review": review}, nil)
+	err = a.writeJSON(w, http.StatusOK, envelope{"review": review}, etagHeaders(review.Version))
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
@@ -138,23 +165,38 @@ func (a *applicationDependencies) deleteReviewHandler(w http.ResponseWriter, r *
 		return
 	}
 
-	// Extract the user ID from the request body
-	var incomingData struct {
-		UserID int64 `json:"user_id"`
+	review, err := a.reviewModel.Get(reviewID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			a.notFoundResponse(w, r)
+		} else {
+			a.serverErrorResponse(w, r, err)
+		}
+		return
 	}
 
-	err = a.readJSON(w, r, &incomingData)
+	// Only the author of the review (or an admin) may delete it
+	allowed, err := a.canModify(r, review.UserID)
 	if err != nil {
-		a.badRequestResponse(w, r, err)
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	if !allowed {
+		a.notOwnerResponse(w, r)
 		return
 	}
 
-	// Attempt to delete the review using the ID and user ID
-	err = a.reviewModel.Delete(reviewID, incomingData.UserID)
+	if !a.checkPreconditions(w, r, review.Version) {
+		return
+	}
+
+	// Attempt to delete the review using the ID and the owner's user ID
+	err = a.reviewModel.Delete(review.ID, review.UserID, review.Version)
 	if err != nil {
-		if errors.Is(err, data.ErrRecordNotFound) {
-			a.notFoundResponse(w, r)
-		} else {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflictResponse(w, r)
+		default:
 			a.serverErrorResponse(w, r, err)
 		}
 		return
@@ -4,9 +4,17 @@ import (
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/martinezmoises/Test3/internal/data"
 )
 
 func (a *applicationDependencies) routes() http.Handler {
+	//Updated with Enabling CORS
+	return a.recoverPanic(a.enableCORS(a.rateLimit(a.authenticate(a.router()))))
+}
+
+// The route table on its own, without the middleware that every request
+// goes through
+func (a *applicationDependencies) router() *httprouter.Router {
 	router := httprouter.New()
 	router.NotFound = http.HandlerFunc(a.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(a.methodNotAllowedResponse)
@@ -15,20 +23,33 @@ func (a *applicationDependencies) routes() http.Handler {
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", a.healthCheckHandler)
 
 	// Book Handlers
-	router.HandlerFunc(http.MethodGet, "/api/v1/books", a.requireActivatedUser(a.listBooksHandler))          // List all books
-	router.HandlerFunc(http.MethodGet, "/api/v1/books-search", a.requireActivatedUser(a.searchBooksHandler)) // Search books (new distinct route)
-	router.HandlerFunc(http.MethodPost, "/api/v1/books", a.requireActivatedUser(a.createBookHandler))        // Add new book
-	router.HandlerFunc(http.MethodGet, "/api/v1/books/:id", a.requireActivatedUser(a.displayBookHandler))    // Get book details
-	router.HandlerFunc(http.MethodPut, "/api/v1/books/:id", a.requireActivatedUser(a.updateBookHandler))     // Update book details
-	router.HandlerFunc(http.MethodDelete, "/api/v1/books/:id", a.requireActivatedUser(a.deleteBookHandler))  // Delete book
+	router.HandlerFunc(http.MethodGet, "/api/v1/books", a.requirePermission(data.PermissionBooksRead, a.listBooksHandler))          // List all books
+	router.HandlerFunc(http.MethodGet, "/api/v1/books-search", a.requirePermission(data.PermissionBooksRead, a.searchBooksHandler)) // Search books (new distinct route)
+	router.HandlerFunc(http.MethodPost, "/api/v1/books", a.requirePermission(data.PermissionBooksWrite, a.createBookHandler))       // Add new book
+	router.HandlerFunc(http.MethodGet, "/api/v1/books/:id", a.requirePermission(data.PermissionBooksRead, a.displayBookHandler))    // Get book details
+	router.HandlerFunc(http.MethodPut, "/api/v1/books/:id", a.requirePermission(data.PermissionBooksWrite, a.updateBookHandler))    // Update book details
+	router.HandlerFunc(http.MethodDelete, "/api/v1/books/:id", a.requirePermission(data.PermissionBooksWrite, a.deleteBookHandler)) // Delete book
+
+	// Author Handlers
+	router.HandlerFunc(http.MethodGet, "/api/v1/authors", a.requirePermission(data.PermissionBooksRead, a.listAuthorsHandler))               // List authors
+	router.HandlerFunc(http.MethodPost, "/api/v1/authors", a.requirePermission(data.PermissionBooksWrite, a.createAuthorHandler))            // Add author
+	router.HandlerFunc(http.MethodGet, "/api/v1/authors/:id", a.requirePermission(data.PermissionBooksRead, a.showAuthorHandler))            // Get author details
+	router.HandlerFunc(http.MethodPut, "/api/v1/authors/:id", a.requirePermission(data.PermissionBooksWrite, a.updateAuthorHandler))         // Update author
+	router.HandlerFunc(http.MethodDelete, "/api/v1/authors/:id", a.requirePermission(data.PermissionBooksWrite, a.deleteAuthorHandler))      // Delete author
+	router.HandlerFunc(http.MethodGet, "/api/v1/authors/:id/books", a.requirePermission(data.PermissionBooksRead, a.listAuthorBooksHandler)) // List an author's books
 
 	// User Handlers
-	router.HandlerFunc(http.MethodPost, "/v1/users", a.registerUserHandler)                                             // Register new user
-	router.HandlerFunc(http.MethodPut, "/v1/users/activated", a.activateUserHandler)                                    // Activate user
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", a.createAuthenticationTokenHandler)                // Authenticate token
-	router.HandlerFunc(http.MethodGet, "/api/v1/users/:id", a.requireActivatedUser(a.getUserProfileHandler))            // Get user profile
-	router.HandlerFunc(http.MethodGet, "/api/v1/users/:id/lists", a.requireActivatedUser(a.getUserReadingListsHandler)) // Get user's reading lists
-	router.HandlerFunc(http.MethodGet, "/api/v1/users/:id/reviews", a.requireActivatedUser(a.getUserReviewsHandler))    // Get user's reviews
+	router.HandlerFunc(http.MethodPost, "/v1/users", a.registerUserHandler)                                                            // Register new user
+	router.HandlerFunc(http.MethodPut, "/v1/users/activated", a.activateUserHandler)                                                   // Activate user
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", a.createActivationTokenHandler)                                       // Resend activation email
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", a.createAuthenticationTokenHandler)                               // Authenticate token
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", a.requireAuthenticatedUser(a.deleteAuthenticationTokenHandler)) // Log out
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", a.refreshAuthenticationTokenHandler)                                     // Rotate a refresh token
+	router.HandlerFunc(http.MethodGet, "/v1/tokens", a.requireAuthenticatedUser(a.listSessionsHandler))                                // List active sessions
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/sessions/:id", a.requireAuthenticatedUser(a.deleteSessionHandler))               // Revoke a session
+	router.HandlerFunc(http.MethodGet, "/api/v1/users/:id", a.requireActivatedUser(a.getUserProfileHandler))                           // Get user profile
+	router.HandlerFunc(http.MethodGet, "/api/v1/users/:id/lists", a.requireActivatedUser(a.getUserReadingListsHandler))                // Get user's reading lists
+	router.HandlerFunc(http.MethodGet, "/api/v1/users/:id/reviews", a.requireActivatedUser(a.getUserReviewsHandler))                   // Get user's reviews
 
 	// Reading_lists handlers
 	router.HandlerFunc(http.MethodGet, "/api/v1/lists", a.requireActivatedUser(a.listReadingListsHandler))
@@ -41,7 +62,10 @@ func (a *applicationDependencies) routes() http.Handler {
 
 	//Reviews handlers
 
-	router.HandlerFunc(http.MethodGet, "/api/v1/books/:id/reviews", a.requireActivatedUser(a.listReviewsHandler))   // List reviews
+	router.HandlerFunc(http.MethodGet, "/api/v1/books/:id/:sub", a.bookSubresourceHandler(
+		a.requirePermission(data.PermissionBooksRead, a.displayBookByISBNHandler), // Get book by ISBN-10 or ISBN-13 (/api/v1/books/isbn/:isbn)
+		a.requireActivatedUser(a.listReviewsHandler),                              // List reviews (/api/v1/books/:id/reviews)
+	))
 	router.HandlerFunc(http.MethodPost, "/api/v1/books/:id/reviews", a.requireActivatedUser(a.createReviewHandler)) // Add review
 	router.HandlerFunc(http.MethodPut, "/api/v1/reviews/:id", a.requireActivatedUser(a.updateReviewHandler))        // Update review
 	router.HandlerFunc(http.MethodDelete, "/api/v1/reviews/:id", a.requireActivatedUser(a.deleteReviewHandler))     // Delete review
@@ -50,7 +74,50 @@ func (a *applicationDependencies) routes() http.Handler {
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", a.createPasswordResetTokenHandler) // Generate password reset token
 	router.HandlerFunc(http.MethodPut, "/v1/users/password", a.updateUserPasswordHandler)               // Reset password
 
-	//Updated with Enabling CORS
-	return a.recoverPanic(a.enableCORS(a.rateLimit(a.authenticate(router))))
+	// Current User Endpoints
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", a.requireAuthenticatedUser(a.showCurrentUserHandler))      // Show my account
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", a.requireActivatedUser(a.updateCurrentUserHandler))      // Update username or password
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", a.requireAuthenticatedUser(a.deleteCurrentUserHandler)) // Delete my account
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me/profile", a.requireActivatedUser(a.updateProfileHandler))  // Update my profile and privacy settings
+
+	// Email Change Endpoints
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/email", a.requireActivatedUser(a.requestEmailChangeHandler)) // Request an email change
+	router.HandlerFunc(http.MethodPut, "/v1/users/email", a.confirmEmailChangeHandler)                             // Confirm an email change
+
+	// Two-Factor Authentication
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/2fa", a.requireActivatedUser(a.enrollTwoFactorHandler))    // Start TOTP enrollment
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/2fa", a.requireActivatedUser(a.confirmTwoFactorHandler))    // Confirm enrollment with a first code
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/2fa", a.requireActivatedUser(a.disableTwoFactorHandler)) // Disable 2FA
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/2fa", a.createTwoFactorTokenHandler)                         // Second login step
+
+	// Magic Link Login
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link", a.createMagicLinkTokenHandler)   // Email a login link
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-login", a.createMagicLoginTokenHandler) // Exchange the link's token for authentication tokens
+
+	// OpenID Connect Login
+	router.HandlerFunc(http.MethodGet, "/v1/oidc/authorize", a.beginOIDCLoginHandler) // Start a login at the identity provider
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/oidc", a.createOIDCTokenHandler)  // Finish the login with the returned code
+
+	// API Keys
+	router.HandlerFunc(http.MethodPost, "/v1/api-keys", a.requireActivatedUser(a.createApiKeyHandler))       // Create an API key
+	router.HandlerFunc(http.MethodGet, "/v1/api-keys", a.requireActivatedUser(a.listApiKeysHandler))         // List my API keys
+	router.HandlerFunc(http.MethodDelete, "/v1/api-keys/:id", a.requireActivatedUser(a.deleteApiKeyHandler)) // Revoke an API key
+
+	// Admin Handlers
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/roles", a.requirePermission(data.PermissionAdmin, a.listUserRolesHandler))                // List a user's roles and permissions
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/roles", a.requirePermission(data.PermissionAdmin, a.grantUserRoleHandler))               // Grant a role
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/roles", a.requirePermission(data.PermissionAdmin, a.revokeUserRoleHandler))            // Revoke a role
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/lock", a.requirePermission(data.PermissionAdmin, a.unlockUserHandler))                 // Clear a login lockout
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", a.requirePermission(data.PermissionAdmin, a.listUsersHandler))                              // List and search users
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", a.requirePermission(data.PermissionAdmin, a.showUserHandler))                           // Show a user
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/deactivate", a.requirePermission(data.PermissionAdmin, a.deactivateUserHandler))         // Deactivate a user
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/reactivate", a.requirePermission(data.PermissionAdmin, a.reactivateUserHandler))         // Reactivate a user
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/password-reset", a.requirePermission(data.PermissionAdmin, a.forcePasswordResetHandler)) // Force a password reset
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/tokens", a.requirePermission(data.PermissionAdmin, a.revokeUserTokensHandler))         // Log a user out everywhere
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/ban", a.requirePermission(data.PermissionAdmin, a.banUserHandler))                        // Ban a user
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/ban", a.requirePermission(data.PermissionAdmin, a.unbanUserHandler))                   // Lift a ban
+	router.HandlerFunc(http.MethodGet, "/v1/admin/audit-events", a.requirePermission(data.PermissionAdmin, a.listAuditEventsHandler))                 // Search the audit log
+	router.HandlerFunc(http.MethodGet, "/v1/admin/audit-events/export", a.requirePermission(data.PermissionAdmin, a.exportAuditEventsHandler))        // Export the audit log as JSON Lines
 
+	return router
 }
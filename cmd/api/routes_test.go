@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/martinezmoises/Test3/internal/data"
+)
+
+// A stand-in database. Permission lookups return the codes in grants for
+// the user asked about, every other query comes back empty
+type fakeDB struct {
+	grants map[int64][]string
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return f, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return nil }
+
+func (f *fakeDB) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: f, query: query}, nil
+}
+func (f *fakeDB) Close() error              { return nil }
+func (f *fakeDB) Begin() (driver.Tx, error) { return nil, driver.ErrSkip }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(0), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if strings.Contains(s.query, "SELECT permissions.code") {
+		return &fakeRows{values: s.db.grants[args[0].(int64)]}, nil
+	}
+	return &fakeRows{}, nil
+}
+
+type fakeRows struct {
+	values []string
+}
+
+func (r *fakeRows) Columns() []string { return []string{"value"} }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0] = r.values[0]
+	r.values = r.values[1:]
+	return nil
+}
+
+// The users the route tests log in as
+var (
+	reader      = &data.User{ID: 1, Activated: true}
+	member      = &data.User{ID: 2, Activated: true}
+	unactivated = &data.User{ID: 3}
+)
+
+func newTestApplication(t *testing.T) *applicationDependencies {
+	t.Helper()
+
+	db := sql.OpenDB(&fakeDB{grants: map[int64][]string{
+		reader.ID: {data.PermissionBooksRead},
+	}})
+	t.Cleanup(func() { db.Close() })
+
+	return &applicationDependencies{
+		logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+		bookModel:       data.BookModel{DB: db},
+		reviewModel:     data.ReviewModel{DB: db},
+		permissionModel: data.PermissionModel{DB: db},
+		auditModel:      data.AuditModel{DB: db},
+		auditSampler:    &auditSampler{held: make(map[string]*heldAuditEvent)},
+	}
+}
+
+// GET /api/v1/books/:id/:sub is one route for both the ISBN lookup and a
+// book's reviews, so check that each request ends up where it should with
+// the right permission check in front of it
+func TestBookSubresourceRoutes(t *testing.T) {
+	const (
+		authRequired  = "you must be authenticated to access this resource"
+		inactive      = "your user account must be activated to access this resource"
+		notPermitted  = "your user account doesn't have the necessary permissions to access this resource"
+		notFound      = "the requested resource could not be found"
+		invalidISBN   = "must be a valid ISBN-10 or ISBN-13"
+		reviewsListed = `"reviews":`
+	)
+
+	tests := []struct {
+		name   string
+		path   string
+		user   *data.User
+		status int
+		body   string
+	}{
+		// The ISBN lookup needs books:read. A malformed ISBN gets as far as
+		// the handler, which refuses it without a database
+		{name: "isbn, anonymous", path: "/api/v1/books/isbn/123", user: data.AnonymousUser, status: http.StatusUnauthorized, body: authRequired},
+		{name: "isbn, not activated", path: "/api/v1/books/isbn/123", user: unactivated, status: http.StatusForbidden, body: inactive},
+		{name: "isbn, without books:read", path: "/api/v1/books/isbn/123", user: member, status: http.StatusForbidden, body: notPermitted},
+		{name: "isbn, with books:read", path: "/api/v1/books/isbn/123", user: reader, status: http.StatusUnprocessableEntity, body: invalidISBN},
+		{name: "isbn, not found", path: "/api/v1/books/isbn/9780306406157", user: reader, status: http.StatusNotFound, body: notFound},
+
+		// Reviews only need an activated account
+		{name: "reviews, anonymous", path: "/api/v1/books/1/reviews", user: data.AnonymousUser, status: http.StatusUnauthorized, body: authRequired},
+		{name: "reviews, not activated", path: "/api/v1/books/1/reviews", user: unactivated, status: http.StatusForbidden, body: inactive},
+		{name: "reviews, without books:read", path: "/api/v1/books/1/reviews", user: member, status: http.StatusOK, body: reviewsListed},
+		{name: "reviews, with books:read", path: "/api/v1/books/1/reviews", user: reader, status: http.StatusOK, body: reviewsListed},
+		// Goes to the reviews, where isbn isn't a book ID. The ISBN lookup would
+		// have refused member
+		{name: "reviews of a book called isbn", path: "/api/v1/books/isbn/reviews", user: member, status: http.StatusNotFound, body: notFound},
+
+		// Anything else is not found, whoever asks
+		{name: "other, anonymous", path: "/api/v1/books/1/other", user: data.AnonymousUser, status: http.StatusNotFound, body: notFound},
+		{name: "other, with books:read", path: "/api/v1/books/1/other", user: reader, status: http.StatusNotFound, body: notFound},
+		{name: "isbn used as a book id", path: "/api/v1/books/1/9780306406157", user: reader, status: http.StatusNotFound, body: notFound},
+	}
+
+	app := newTestApplication(t)
+	router := app.router()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			r = app.contextSetUser(r, tt.user)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if !strings.Contains(w.Body.String(), tt.body) {
+				t.Errorf("body = %s, want it to contain %s", w.Body.String(), tt.body)
+			}
+		})
+	}
+}
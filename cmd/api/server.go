@@ -29,11 +29,23 @@ func (a *applicationDependencies) serve() error {
 		a.logger.Info("shutting down server", "signal", s.String())
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
-		shutdownError <- apiServer.Shutdown(ctx)
 		err := apiServer.Shutdown(ctx)
 		if err != nil {
 			shutdownError <- err
+			return
 		}
+		// Cancel a scheduled job that is halfway through and wait for it to
+		// return before the database pool is closed
+		if a.scheduler != nil {
+			a.logger.Info("stopping scheduled jobs")
+			err = a.scheduler.Stop(ctx)
+			if err != nil {
+				shutdownError <- err
+				return
+			}
+		}
+		a.stopDenylistRefresh()
+		a.stopAuditSampling()
 		// Wait for background tasks to complete
 		a.logger.Info("completing background tasks", "address", apiServer.Addr)
 		a.wg.Wait()
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/martinezmoises/Test3/internal/data"
+	"github.com/martinezmoises/Test3/internal/jwt"
+)
+
+// The authentication backends selectable with the -auth-mode flag. In
+// opaque mode every request looks its token up in the tokens table. In
+// jwt mode access tokens are signed JWTs that we verify locally
+const authModeOpaque = "opaque"
+const authModeJWT = "jwt"
+
+// The iss claim of our signed tokens. Tokens naming anyone else are refused
+const signedTokenIssuer = "bookclub"
+
+// tokenDenylist is an in-memory copy of the token_denylist table so that
+// checking a signed token for revocation doesn't need the database
+type tokenDenylist struct {
+	mu      sync.RWMutex
+	entries map[string]time.Time
+	// Closed to stop the background refresh
+	done chan struct{}
+}
+
+func (d *tokenDenylist) contains(ids ...string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, id := range ids {
+		expiry, found := d.entries[id]
+		if found && time.Now().Before(expiry) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *tokenDenylist) add(id string, expiry time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries[id] = expiry
+}
+
+func (d *tokenDenylist) replace(entries map[string]time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries = entries
+}
+
+// Load the denylist and keep reloading it so that revocations made by
+// other instances of the API are picked up, until stopDenylistRefresh()
+func (a *applicationDependencies) startDenylistRefresh() error {
+	entries, err := a.denylistModel.GetAll()
+	if err != nil {
+		return err
+	}
+	a.denylist.replace(entries)
+	a.denylist.done = make(chan struct{})
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-a.denylist.done:
+				return
+			case <-ticker.C:
+			}
+
+			entries, err := a.denylistModel.GetAll()
+			if err != nil {
+				a.logger.Error("failed to refresh token denylist", "error", err.Error())
+				continue
+			}
+			a.denylist.replace(entries)
+		}
+	}()
+
+	return nil
+}
+
+// Stop the refresh started by startDenylistRefresh(), if there is one
+func (a *applicationDependencies) stopDenylistRefresh() {
+	if a.denylist.done != nil {
+		close(a.denylist.done)
+	}
+}
+
+// Revoke a signed token (or a whole family) until it would have expired
+func (a *applicationDependencies) denylistSignedToken(id string, expiry time.Time) error {
+	if id == "" {
+		return nil
+	}
+	err := a.denylistModel.Insert(id, expiry)
+	if err != nil {
+		return err
+	}
+	a.denylist.add(id, expiry)
+	return nil
+}
+
+// Create a signed access token for the user. It is not stored anywhere
+func (a *applicationDependencies) newSignedToken(user *data.User, family string) (*data.Token, error) {
+	id, err := data.NewTokenFamily()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	claims := jwt.Claims{
+		Subject:   strconv.FormatInt(user.ID, 10),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(a.config.auth.accessTokenTTL).Unix(),
+		ID:        id,
+		Family:    family,
+		Username:  user.Username,
+		Activated: user.Activated,
+	}
+
+	plaintext, err := a.keySet.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &data.Token{
+		Plaintext: plaintext,
+		UserID:    user.ID,
+		Expiry:    claims.Expiry(),
+		Scope:     data.ScopeAuthentication,
+		Family:    family,
+	}
+	return token, nil
+}
+
+// Verify a signed access token and build the user from its claims. The
+// token is rejected if either its ID or its family has been revoked
+func (a *applicationDependencies) authenticateSignedToken(token string) (*data.User, *jwt.Claims, error) {
+	claims, err := a.keySet.Verify(token, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if a.denylist.contains(claims.ID, claims.Family) {
+		return nil, nil, jwt.ErrInvalidToken
+	}
+
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || userID < 1 {
+		return nil, nil, jwt.ErrInvalidToken
+	}
+
+	user := &data.User{
+		ID:        userID,
+		Username:  claims.Username,
+		Activated: claims.Activated,
+	}
+	return user, claims, nil
+}
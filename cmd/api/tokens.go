@@ -34,11 +34,45 @@ func (a *applicationDependencies) createAuthenticationTokenHandler(w http.Respon
 		a.failedValidationResponse(w, r, v.Errors)
 		return
 	}
+	// Is this email or IP still waiting out a backoff or a lockout? We
+	// check before looking the user up so the answer is the same whether
+	// or not the account exists
+	retryAfter, err := a.loginRetryAfter(r, incomingData.Email)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	if retryAfter > 0 {
+		// The audit log is kept for a long time and can't be edited, so
+		// the email only goes in if it belongs to an account. Otherwise it
+		// is whatever the caller typed, a password in the wrong box included
+		var targetID int64
+		details := map[string]any{"reason": "throttled"}
+		throttledUser, err := a.userModel.GetByEmail(incomingData.Email)
+		switch {
+		case err == nil:
+			targetID = throttledUser.ID
+			details["email"] = throttledUser.Email
+		case !errors.Is(err, data.ErrRecordNotFound):
+			a.logError(r, err)
+		}
+		a.audit(r, data.AuditLogin, targetID, data.AuditFailure, details)
+		a.tooManyLoginAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
 	// Is there an associated user for the provided email?
 	user, err := a.userModel.GetByEmail(incomingData.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			err = a.recordLoginFailure(r, incomingData.Email, nil)
+			if err != nil {
+				a.serverErrorResponse(w, r, err)
+				return
+			}
+			// No email in the log here either, see above
+			a.audit(r, data.AuditLogin, 0, data.AuditFailure, map[string]any{"reason": "unknown_email"})
 			a.invalidCredentialsResponse(w, r)
 		default:
 			a.serverErrorResponse(w, r, err)
@@ -55,10 +89,103 @@ func (a *applicationDependencies) createAuthenticationTokenHandler(w http.Respon
 	// Wrong password
 	// We will define invalidCredentialsResponse() later
 	if !match {
+		err = a.recordLoginFailure(r, incomingData.Email, user)
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+		a.audit(r, data.AuditLogin, user.ID, data.AuditFailure, map[string]any{"reason": "wrong_password"})
 		a.invalidCredentialsResponse(w, r)
 		return
 	}
-	token, err := a.tokenModel.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+
+	// Only tell someone the account is banned once they've proven it's theirs
+	if user.IsBanned() {
+		a.audit(r, data.AuditLogin, user.ID, data.AuditFailure, map[string]any{"reason": "banned"})
+		a.accountSuspendedResponse(w, r)
+		return
+	}
+
+	if user.DeactivatedAt != nil {
+		a.audit(r, data.AuditLogin, user.ID, data.AuditFailure, map[string]any{"reason": "deactivated"})
+		a.inactiveAccountResponse(w, r)
+		return
+	}
+
+	// This is the only time we see the plaintext, so take the chance to
+	// move the hash to the current algorithm and cost
+	if a.userModel.PasswordNeedsRehash(user) {
+		a.rehashPassword(r, user, incomingData.Password)
+	}
+
+	// Users with two-factor authentication get a short-lived pending token
+	// instead. They exchange it, along with a code, at /v1/tokens/2fa
+	enabled, err := a.twoFactorModel.IsEnabled(user.ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	if enabled {
+		a.audit(r, data.AuditLogin, user.ID, data.AuditSuccess, map[string]any{"2fa": "pending"})
+		a.writeTwoFactorPendingToken(w, r, user)
+		return
+	}
+
+	// Only a complete login clears the failures. Otherwise someone who knows
+	// the password could reset the counter between guesses at the 2FA code
+	err = a.clearLoginFailures(incomingData.Email)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	a.audit(r, data.AuditLogin, user.ID, data.AuditSuccess, nil)
+
+	a.writeLoginTokens(w, r, user)
+}
+
+// Replace a user's password hash. A failure here shouldn't stop them from
+// logging in, they'll get rehashed next time, so we only log it
+func (a *applicationDependencies) rehashPassword(r *http.Request, user *data.User, plaintext string) {
+	err := a.userModel.SetPassword(user, plaintext)
+	if err == nil {
+		err = a.userModel.Update(user)
+	}
+	if err != nil {
+		a.logError(r, err)
+	}
+}
+
+// Send a user who still has to enter a 2FA code a short-lived pending
+// token. They exchange it, along with a code, at /v1/tokens/2fa
+func (a *applicationDependencies) writeTwoFactorPendingToken(w http.ResponseWriter, r *http.Request, user *data.User) {
+	pendingToken, err := a.tokenModel.New(user.ID, 5*time.Minute, data.ScopeTwoFactorPending)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"2fa_pending_token": pendingToken,
+		"message":           "a two-factor authentication code is required to complete the login",
+	}
+	err = a.writeJSON(w, http.StatusAccepted, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// Start a new token family for a user who has just proven who they are and
+// send them their access and refresh tokens
+func (a *applicationDependencies) writeLoginTokens(w http.ResponseWriter, r *http.Request, user *data.User) {
+	// This login starts a new token family
+	family, err := data.NewTokenFamily()
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, refreshToken, err := a.issueTokenPair(r, user, family)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 		return
@@ -66,6 +193,7 @@ func (a *applicationDependencies) createAuthenticationTokenHandler(w http.Respon
 
 	data := envelope{
 		"authentication_token": token,
+		"refresh_token":        refreshToken,
 	}
 
 	// Return the bearer token
@@ -75,6 +203,252 @@ func (a *applicationDependencies) createAuthenticationTokenHandler(w http.Respon
 	}
 }
 
+// Exchange a refresh token for a new access token and a new refresh token.
+// Refresh tokens are single use. Presenting one that has already been
+// rotated means it was stolen (or replayed), so we revoke its whole family
+// and the client has to log in again
+func (a *applicationDependencies) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, incomingData.RefreshToken)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	refreshToken, err := a.tokenModel.GetRefreshToken(incomingData.RefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.invalidAuthenticationTokenResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if refreshToken.UsedAt == nil {
+		err = a.tokenModel.MarkUsed(refreshToken.ID)
+	} else {
+		err = data.ErrTokenReused
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTokenReused):
+			a.logger.Warn("refresh token reuse detected, revoking token family",
+				"user_id", refreshToken.UserID, "ip", a.clientIP(r))
+			err = a.revokeTokenFamily(refreshToken.Family)
+			if err != nil {
+				a.serverErrorResponse(w, r, err)
+				return
+			}
+			a.audit(r, data.AuditTokenRefresh, refreshToken.UserID, data.AuditFailure, map[string]any{"reason": "reused"})
+			a.invalidAuthenticationTokenResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The access token issued alongside the old refresh token is replaced
+	// by the new one
+	err = a.tokenModel.DeleteFamilyScope(refreshToken.Family, data.ScopeAuthentication)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Load the user again so that a signed access token carries their
+	// current details
+	user, err := a.userModel.GetByID(refreshToken.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.invalidAuthenticationTokenResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if user.IsBanned() {
+		a.audit(r, data.AuditTokenRefresh, user.ID, data.AuditFailure, map[string]any{"reason": "banned"})
+		a.accountSuspendedResponse(w, r)
+		return
+	}
+
+	token, newRefreshToken, err := a.issueTokenPair(r, user, refreshToken.Family)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	a.audit(r, data.AuditTokenRefresh, user.ID, data.AuditSuccess, nil)
+
+	data := envelope{
+		"authentication_token": token,
+		"refresh_token":        newRefreshToken,
+	}
+
+	err = a.writeJSON(w, http.StatusCreated, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// Issue a short-lived access token and a refresh token in the same family.
+// In jwt mode the access token is signed instead of stored
+func (a *applicationDependencies) issueTokenPair(r *http.Request, user *data.User, family string) (*data.Token, *data.Token, error) {
+	metadata := data.TokenMetadata{
+		Family:    family,
+		UserAgent: r.UserAgent(),
+		IPAddress: a.clientIP(r),
+	}
+
+	var token *data.Token
+	var err error
+	if a.config.auth.mode == authModeJWT {
+		token, err = a.newSignedToken(user, family)
+	} else {
+		token, err = a.tokenModel.NewWithMetadata(user.ID, a.config.auth.accessTokenTTL, data.ScopeAuthentication, metadata)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refreshToken, err := a.tokenModel.NewWithMetadata(user.ID, a.config.auth.refreshTokenTTL, data.ScopeRefresh, metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return token, refreshToken, nil
+}
+
+// Revoke every token in a family. Signed access tokens can't be deleted so
+// the family also goes on the denylist until they would have expired
+func (a *applicationDependencies) revokeTokenFamily(family string) error {
+	if a.config.auth.mode == authModeJWT {
+		err := a.denylistSignedToken(family, time.Now().Add(a.config.auth.accessTokenTTL))
+		if err != nil {
+			return err
+		}
+	}
+	return a.tokenModel.DeleteFamily(family)
+}
+
+// In jwt mode sessions are tracked through refresh tokens since access
+// tokens aren't stored
+func (a *applicationDependencies) sessionScope() string {
+	if a.config.auth.mode == authModeJWT {
+		return data.ScopeRefresh
+	}
+	return data.ScopeAuthentication
+}
+
+// Log out by revoking the token that was used to make this request
+func (a *applicationDependencies) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	claims := a.contextGetClaims(r)
+	if claims != nil {
+		// A signed token: revoke the token itself and the family it
+		// belongs to so its refresh token stops working too
+		err := a.denylistSignedToken(claims.ID, claims.Expiry())
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+		if claims.Family != "" {
+			err = a.revokeTokenFamily(claims.Family)
+			if err != nil {
+				a.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		a.audit(r, data.AuditLogout, a.contextGetUser(r).ID, data.AuditSuccess, nil)
+
+		a.genericResponse(w, r, http.StatusOK, "you have been logged out")
+		return
+	}
+
+	token := a.contextGetToken(r)
+
+	err := a.tokenModel.DeleteByPlaintext(data.ScopeAuthentication, token)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	a.audit(r, data.AuditLogout, a.contextGetUser(r).ID, data.AuditSuccess, nil)
+
+	a.genericResponse(w, r, http.StatusOK, "you have been logged out")
+}
+
+// List the active sessions for the current user
+func (a *applicationDependencies) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := a.contextGetUser(r)
+
+	sessions, err := a.tokenModel.GetSessionsForUser(user.ID, a.sessionScope(), a.contextGetToken(r))
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// A signed token isn't in the tokens table so match it by family
+	claims := a.contextGetClaims(r)
+	if claims != nil {
+		for _, session := range sessions {
+			session.Current = session.Family != "" && session.Family == claims.Family
+		}
+	}
+
+	err = a.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// Revoke one of the current user's sessions, e.g. a forgotten login on
+// another device
+func (a *applicationDependencies) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	user := a.contextGetUser(r)
+
+	family, err := a.tokenModel.DeleteSession(id, user.ID, a.sessionScope())
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			a.notFoundResponse(w, r)
+		} else {
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The session's signed access token is still valid until it expires
+	if a.config.auth.mode == authModeJWT && family != "" {
+		err = a.denylistSignedToken(family, time.Now().Add(a.config.auth.accessTokenTTL))
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	a.audit(r, data.AuditSessionRevoke, user.ID, data.AuditSuccess, map[string]any{"session_id": id})
+
+	a.genericResponse(w, r, http.StatusOK, "session successfully revoked")
+}
+
 // Return a 401 status code
 func (a *applicationDependencies) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
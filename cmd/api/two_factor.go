@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/martinezmoises/Test3/internal/data"
+	"github.com/martinezmoises/Test3/internal/totp"
+	"github.com/martinezmoises/Test3/internal/validator"
+)
+
+// The issuer shown next to the account in authenticator apps
+const totpIssuer = "Book Club"
+
+// Start enrolling in two-factor authentication. We return the secret and an
+// otpauth:// URI (for a QR code). 2FA is not enforced until the user
+// confirms it with a first code
+func (a *applicationDependencies) enrollTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	// Load the full user record, we need the email for the account label
+	user, err := a.userModel.GetByID(a.contextGetUser(r).ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = a.twoFactorModel.Begin(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			a.failedValidationResponse(w, r, map[string]string{"2fa": "two-factor authentication is already enabled"})
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	data := envelope{
+		"secret":      secret,
+		"otpauth_uri": totp.URI(totpIssuer, user.Email, secret),
+	}
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// Confirm the enrollment with a first code from the authenticator app.
+// This turns 2FA on and returns the recovery codes, which are never shown
+// again
+func (a *applicationDependencies) confirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		Code string `json:"code"`
+	}
+
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateTOTPCode(v, incomingData.Code)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := a.contextGetUser(r)
+
+	tf, err := a.twoFactorModel.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("2fa", "two-factor enrollment has not been started")
+			a.failedValidationResponse(w, r, v.Errors)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if tf.Confirmed {
+		v.AddError("2fa", "two-factor authentication is already enabled")
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ok, err := a.verifySecondFactor(tf, incomingData.Code, "")
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		v.AddError("code", "invalid code")
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	recoveryCodes, err := data.GenerateRecoveryCodes()
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = a.twoFactorModel.Confirm(user.ID, recoveryCodes)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	a.audit(r, data.AuditTwoFactorEnable, user.ID, data.AuditSuccess, nil)
+
+	data := envelope{
+		"message":        "two-factor authentication is now enabled",
+		"recovery_codes": recoveryCodes,
+	}
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// Turn 2FA off. The user has to prove they still have the second factor,
+// either with a current code or with a recovery code
+func (a *applicationDependencies) disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(incomingData.Code != "" || incomingData.RecoveryCode != "", "code", "a code or recovery code must be provided")
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := a.contextGetUser(r)
+
+	tf, err := a.twoFactorModel.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// An unconfirmed enrollment has no recovery codes and protects nothing,
+	// so it can be dropped without a code
+	if tf.Confirmed {
+		ok, err := a.verifySecondFactor(tf, incomingData.Code, incomingData.RecoveryCode)
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+		if !ok {
+			v.AddError("code", "invalid code")
+			a.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	err = a.twoFactorModel.Delete(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	a.audit(r, data.AuditTwoFactorDisable, user.ID, data.AuditSuccess, nil)
+
+	a.genericResponse(w, r, http.StatusOK, "two-factor authentication has been disabled")
+}
+
+// The second login step. Exchange the pending token from
+// createAuthenticationTokenHandler plus a code (or a recovery code) for
+// normal authentication and refresh tokens
+func (a *applicationDependencies) createTwoFactorTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		Token        string `json:"token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, incomingData.Token)
+	v.Check(incomingData.Code != "" || incomingData.RecoveryCode != "", "code", "a code or recovery code must be provided")
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := a.userModel.GetForToken(data.ScopeTwoFactorPending, incomingData.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired token")
+			a.failedValidationResponse(w, r, v.Errors)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Guessing codes counts as a failed login, the same as a wrong password
+	retryAfter, err := a.loginRetryAfter(r, user.Email)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	if retryAfter > 0 {
+		a.audit(r, data.AuditLoginTwoFactor, user.ID, data.AuditFailure, map[string]any{"reason": "throttled"})
+		a.tooManyLoginAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
+	// Deactivated since the password step
+	if user.DeactivatedAt != nil {
+		a.audit(r, data.AuditLoginTwoFactor, user.ID, data.AuditFailure, map[string]any{"reason": "deactivated"})
+		a.inactiveAccountResponse(w, r)
+		return
+	}
+
+	tf, err := a.twoFactorModel.Get(user.ID)
+	if err != nil {
+		switch {
+		// 2FA was turned off after the pending token was issued
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.invalidCredentialsResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// An enrollment that was never confirmed isn't a second factor yet,
+	// even though its codes would check out
+	if !tf.Confirmed {
+		a.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	ok, err := a.verifySecondFactor(tf, incomingData.Code, incomingData.RecoveryCode)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		err = a.recordLoginFailure(r, user.Email, user)
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+		a.audit(r, data.AuditLoginTwoFactor, user.ID, data.AuditFailure, map[string]any{"reason": "wrong_code"})
+		a.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	err = a.clearLoginFailures(user.Email)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The pending token has done its job
+	err = a.tokenModel.DeleteAllForUser(data.ScopeTwoFactorPending, user.ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	a.audit(r, data.AuditLoginTwoFactor, user.ID, data.AuditSuccess, map[string]any{"recovery_code": incomingData.Code == ""})
+
+	a.writeLoginTokens(w, r, user)
+}
+
+// Check a TOTP code, or a recovery code if no TOTP code was given. A TOTP
+// code is only accepted once
+func (a *applicationDependencies) verifySecondFactor(tf *data.TwoFactor, code string, recoveryCode string) (bool, error) {
+	if code != "" {
+		step, ok := totp.Validate(tf.Secret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		return a.twoFactorModel.UseStep(tf.UserID, step)
+	}
+
+	if !tf.Confirmed {
+		return false, nil
+	}
+	return a.twoFactorModel.UseRecoveryCode(tf.UserID, recoveryCode)
+}
@@ -32,22 +32,35 @@ func (a *applicationDependencies) registerUserHandler(w http.ResponseWriter,
 		Activated: false,
 	}
 
+	// Check the length before hashing or scoring the password, both of
+	// which get slow on long input
+	v := validator.New()
+	data.ValidatePasswordPlaintext(v, incomingData.Password)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	// hash the password and store it along with the cleartext version
-	err = user.Password.Set(incomingData.Password)
+	err = a.userModel.SetPassword(user, incomingData.Password)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 		return
 	}
 	// Perform validation for the User
-	v := validator.New()
-
 	data.ValidateUser(v, user)
+	err = a.validateNewPassword(v, "password", incomingData.Password, user)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
 	if !v.IsEmpty() {
 		a.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	err = a.userModel.Insert(user) // we will add userModel to main later
+	// Every new account starts out as a member
+	err = a.userModel.Insert(user, data.RoleMember)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
@@ -60,6 +73,8 @@ func (a *applicationDependencies) registerUserHandler(w http.ResponseWriter,
 
 	}
 
+	a.audit(r, data.AuditUserRegister, user.ID, data.AuditSuccess, nil)
+
 	token, err := a.tokenModel.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
@@ -136,6 +151,8 @@ func (a *applicationDependencies) activateUserHandler(w http.ResponseWriter, r *
 		return
 	}
 
+	a.audit(r, data.AuditUserActivate, user.ID, data.AuditSuccess, nil)
+
 	// Send a response
 	data := envelope{
 		"user": user,
@@ -149,6 +166,8 @@ func (a *applicationDependencies) activateUserHandler(w http.ResponseWriter, r *
 
 //new handlers
 
+// Show a user's profile. Other members get the public profile, the user
+// themselves and admins also get the full account
 func (a *applicationDependencies) getUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := a.readIDParam(r)
 	if err != nil {
@@ -156,7 +175,7 @@ func (a *applicationDependencies) getUserProfileHandler(w http.ResponseWriter, r
 		return
 	}
 
-	user, err := a.userModel.GetByID(id)
+	profile, err := a.userModel.GetProfile(id)
 	if err != nil {
 		if errors.Is(err, data.ErrRecordNotFound) {
 			a.notFoundResponse(w, r)
@@ -166,7 +185,25 @@ func (a *applicationDependencies) getUserProfileHandler(w http.ResponseWriter, r
 		return
 	}
 
-	err = a.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	fullView, err := a.canModify(r, id)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := envelope{"profile": profile}
+	if fullView {
+		user, err := a.userModel.GetByID(id)
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+		data["user"] = user
+	} else {
+		profile.HidePrivate()
+	}
+
+	err = a.writeJSON(w, http.StatusOK, data, nil)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
@@ -179,6 +216,20 @@ func (a *applicationDependencies) getUserReadingListsHandler(w http.ResponseWrit
 		return
 	}
 
+	visible, err := a.canSeeLists(r, id)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			a.notFoundResponse(w, r)
+		} else {
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if !visible {
+		a.privateContentResponse(w, r, "reading lists")
+		return
+	}
+
 	lists, err := a.readingListModel.GetByUserID(id)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
@@ -198,6 +249,20 @@ func (a *applicationDependencies) getUserReviewsHandler(w http.ResponseWriter, r
 		return
 	}
 
+	visible, err := a.canSeeReviews(r, id)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			a.notFoundResponse(w, r)
+		} else {
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if !visible {
+		a.privateContentResponse(w, r, "reviews")
+		return
+	}
+
 	reviews, err := a.reviewModel.GetByUserID(id)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
@@ -210,6 +275,79 @@ func (a *applicationDependencies) getUserReviewsHandler(w http.ResponseWriter, r
 	}
 }
 
+// Send a fresh activation token, e.g. when the welcome email got lost. Any
+// older activation tokens stop working. Like the password reset endpoint,
+// the response is the same whether or not the email belongs to an account
+// waiting to be activated
+func (a *applicationDependencies) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		Email string `json:"email"`
+	}
+
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateEmail(v, incomingData.Email)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	message := "an email will be sent to you containing activation instructions"
+
+	user, err := a.userModel.GetByEmail(incomingData.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.genericResponse(w, r, http.StatusAccepted, message)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Nothing to do, but don't reveal that the account is already active.
+	// Accounts deactivated by an admin can't reactivate themselves
+	if user.Activated || user.DeactivatedAt != nil {
+		a.genericResponse(w, r, http.StatusAccepted, message)
+		return
+	}
+
+	err = a.tokenModel.DeleteAllForUser(data.ScopeActivation, user.ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := a.tokenModel.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Send in the background so the response time doesn't give away that
+	// the account exists
+	a.background(func() {
+		emailData := map[string]any{
+			"activationToken": token.Plaintext,
+		}
+
+		err := a.mailer.Send(user.Email, "token_activation.tmpl", emailData)
+		if err != nil {
+			a.logger.Error("failed to send activation email",
+				slog.String("email", user.Email),
+				slog.String("error", err.Error()),
+			)
+		}
+	})
+
+	a.genericResponse(w, r, http.StatusAccepted, message)
+}
+
 // Create a password reset token
 func (a *applicationDependencies) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var incomingData struct {
@@ -254,6 +392,8 @@ func (a *applicationDependencies) createPasswordResetTokenHandler(w http.Respons
 		return
 	}
 
+	a.audit(r, data.AuditPasswordResetRequest, user.ID, data.AuditSuccess, nil)
+
 	// Send reset email
 	emailData := map[string]any{
 		"passwordResetToken": token.Plaintext,
@@ -300,6 +440,7 @@ func (a *applicationDependencies) updateUserPasswordHandler(w http.ResponseWrite
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			a.audit(r, data.AuditPasswordReset, 0, data.AuditFailure, map[string]any{"reason": "invalid_token"})
 			a.failedValidationResponse(w, r, map[string]string{"token": "invalid or expired token"})
 		default:
 			a.serverErrorResponse(w, r, err)
@@ -307,8 +448,18 @@ func (a *applicationDependencies) updateUserPasswordHandler(w http.ResponseWrite
 		return
 	}
 
+	err = a.validateNewPassword(v, "password", incomingData.Password, user)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	// Update user's password
-	err = user.Password.Set(incomingData.Password)
+	err = a.userModel.SetPassword(user, incomingData.Password)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 		return
@@ -327,5 +478,186 @@ func (a *applicationDependencies) updateUserPasswordHandler(w http.ResponseWrite
 		return
 	}
 
+	// Whoever knew the old password may still be logged in, or waiting to
+	// confirm an email change they requested with it
+	err = a.revokeSessions(r, user.ID, false)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	err = a.userModel.ClearPendingEmail(user.ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	a.audit(r, data.AuditPasswordReset, user.ID, data.AuditSuccess, nil)
+
 	a.genericResponse(w, r, http.StatusOK, "your password was successfully reset")
 }
+
+// Start changing the current user's email address. The change is only made
+// once the confirmation token mailed to the new address is used. The old
+// address gets a notice in case the account has been compromised
+func (a *applicationDependencies) requestEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateEmail(v, incomingData.Email)
+	data.ValidatePasswordPlaintext(v, incomingData.Password)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := a.userModel.GetByID(a.contextGetUser(r).ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Changing the email is as sensitive as changing the password, so make
+	// sure it is really the account owner
+	match, err := user.Password.Matches(incomingData.Password)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		a.audit(r, data.AuditEmailChangeRequest, user.ID, data.AuditFailure, map[string]any{"reason": "wrong_password"})
+		a.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	if incomingData.Email == user.Email {
+		v.AddError("email", "must be different from your current email address")
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = a.userModel.GetByEmail(incomingData.Email)
+	if err == nil {
+		v.AddError("email", "a user with this email address already exists")
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	} else if !errors.Is(err, data.ErrRecordNotFound) {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = a.userModel.SetPendingEmail(user.ID, incomingData.Email)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Only the most recent request can be confirmed
+	err = a.tokenModel.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := a.tokenModel.New(user.ID, 24*time.Hour, data.ScopeEmailChange)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	a.audit(r, data.AuditEmailChangeRequest, user.ID, data.AuditSuccess, map[string]any{"new_email": incomingData.Email})
+
+	oldEmail := user.Email
+	a.background(func() {
+		err := a.mailer.Send(incomingData.Email, "email_change_confirm.tmpl", map[string]any{
+			"emailChangeToken": token.Plaintext,
+		})
+		if err != nil {
+			a.logger.Error("failed to send email change confirmation",
+				slog.String("email", incomingData.Email),
+				slog.String("error", err.Error()),
+			)
+		}
+
+		err = a.mailer.Send(oldEmail, "email_change_notice.tmpl", map[string]any{
+			"newEmail": incomingData.Email,
+		})
+		if err != nil {
+			a.logger.Error("failed to send email change notice",
+				slog.String("email", oldEmail),
+				slog.String("error", err.Error()),
+			)
+		}
+	})
+
+	a.genericResponse(w, r, http.StatusAccepted, "an email will be sent to your new address containing confirmation instructions")
+}
+
+// Confirm an email change with the token that was mailed to the new address
+func (a *applicationDependencies) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, incomingData.TokenPlaintext)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := a.userModel.GetForToken(data.ScopeEmailChange, incomingData.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			a.failedValidationResponse(w, r, v.Errors)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	oldEmail := user.Email
+	err = a.userModel.ConfirmPendingEmail(user)
+	if err != nil {
+		switch {
+		// Someone else registered the address after the change was requested
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			a.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflictResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = a.tokenModel.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	a.audit(r, data.AuditEmailChange, user.ID, data.AuditSuccess, map[string]any{"old_email": oldEmail, "new_email": user.Email})
+
+	err = a.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,49 @@
+// Command backfill-ratings recalculates every book's average rating and
+// ratings count from its reviews. The reviews trigger normally keeps them
+// up to date, so this is only needed to repair them, e.g. after reviews
+// were loaded with the trigger disabled
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"log/slog"
+	"os"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/martinezmoises/Test3/internal/data"
+)
+
+func main() {
+	var dsn string
+	flag.StringVar(&dsn, "db-dsn", os.Getenv("BOOKCLUB_DB_DSN"), "PostgreSQL DSN")
+	flag.Parse()
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = db.PingContext(ctx)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	books := data.BookModel{DB: db}
+	count, err := books.RecalculateRatings()
+	if err != nil {
+		logger.Error("failed to recalculate ratings", "error", err.Error())
+		os.Exit(1)
+	}
+
+	logger.Info("recalculated book ratings", "books_updated", count)
+}
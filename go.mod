@@ -3,6 +3,7 @@ module github.com/martinezmoises/Test3
 go 1.23.3
 
 require (
+	github.com/go-mail/mail/v2 v2.3.0
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/lib/pq v1.10.9
 	github.com/martinezmoises/comments v0.0.0-20241116061238-038ac5e0a73e
@@ -11,6 +12,6 @@ require (
 )
 
 require (
-	github.com/go-mail/mail/v2 v2.3.0 // indirect
+	golang.org/x/sys v0.27.0 // indirect
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 )
@@ -0,0 +1,237 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/martinezmoises/Test3/internal/validator"
+)
+
+// Every API key starts with this so it is easy to spot in config files and
+// easy to tell apart from a bearer token
+const ApiKeyPrefix = "bck_"
+
+// How many characters of the key we keep in the clear to identify it
+const apiKeyDisplayLength = len(ApiKeyPrefix) + 6
+
+var ErrDuplicateApiKeyName = errors.New("duplicate api key name")
+
+// An ApiKey is a long-lived credential for scripts and bots. The secret is
+// only available in Plaintext right after the key is created
+type ApiKey struct {
+	ID          int64       `json:"id"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Prefix      string      `json:"prefix"`
+	Plaintext   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	Expiry      *time.Time  `json:"expiry"`
+	CreatedAt   time.Time   `json:"created_at"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+}
+
+// Check a new key. granted holds the permissions of the user creating the
+// key, a key can't be given anything its owner doesn't have
+func ValidateApiKey(v *validator.Validator, key *ApiKey, granted Permissions) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(key.Permissions) > 0, "permissions", "must contain at least one permission")
+	for _, code := range key.Permissions {
+		v.Check(granted.Include(code), "permissions", "can only contain permissions you hold")
+	}
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+// Validate a key the client sends us before we look it up
+func ValidateApiKeyPlaintext(v *validator.Validator, plaintext string) {
+	v.Check(plaintext != "", "key", "must be provided")
+	v.Check(strings.HasPrefix(plaintext, ApiKeyPrefix), "key", "must be an API key")
+	v.Check(len(plaintext) == len(ApiKeyPrefix)+32, "key", "must be 36 bytes long")
+}
+
+// The part of a key that is safe to show or log. The key must already have
+// passed ValidateApiKeyPlaintext()
+func ApiKeyDisplayPrefix(plaintext string) string {
+	return plaintext[:apiKeyDisplayLength]
+}
+
+type ApiKeyModel struct {
+	DB *sql.DB
+}
+
+// New generates a key for the user and stores its hash. The returned key
+// is the only place the plaintext secret ever appears
+func (m ApiKeyModel) New(key *ApiKey) error {
+	randomBytes := make([]byte, 20)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+	key.Plaintext = ApiKeyPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	key.Prefix = ApiKeyDisplayPrefix(key.Plaintext)
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+
+	query := `
+        INSERT INTO api_keys (user_id, name, prefix, hash, permissions, expiry)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING id, created_at`
+	args := []any{key.UserID, key.Name, key.Prefix, key.Hash, pq.Array(key.Permissions), key.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "api_keys_user_name_key" {
+			return ErrDuplicateApiKeyName
+		}
+		return err
+	}
+
+	return nil
+}
+
+// GetForKey looks up an unexpired key by its plaintext and returns it
+// along with its owner
+func (m ApiKeyModel) GetForKey(plaintext string) (*ApiKey, *User, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+        SELECT api_keys.id, api_keys.name, api_keys.prefix, api_keys.permissions,
+               api_keys.expiry, api_keys.created_at, api_keys.last_used_at,
+               users.id, users.created_at, users.username, users.email,
+               users.password_hash, users.activated, users.version
+        FROM api_keys
+        INNER JOIN users ON users.id = api_keys.user_id
+        WHERE api_keys.hash = $1
+        AND (api_keys.expiry IS NULL OR api_keys.expiry > $2)
+        AND users.banned_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var key ApiKey
+	var user User
+	err := m.DB.QueryRowContext(ctx, query, hash[:], time.Now()).Scan(
+		&key.ID,
+		&key.Name,
+		&key.Prefix,
+		pq.Array(&key.Permissions),
+		&key.Expiry,
+		&key.CreatedAt,
+		&key.LastUsedAt,
+		&user.ID,
+		&user.CreatedAt,
+		&user.Username,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	key.UserID = user.ID
+
+	return &key, &user, nil
+}
+
+// GetAllForUser lists a user's keys, newest first. Expired keys are
+// included so the owner can see why a script stopped working
+func (m ApiKeyModel) GetAllForUser(userID int64) ([]*ApiKey, error) {
+	query := `
+        SELECT id, name, prefix, permissions, expiry, created_at, last_used_at
+        FROM api_keys
+        WHERE user_id = $1
+        ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*ApiKey{}
+	for rows.Next() {
+		key := ApiKey{UserID: userID}
+		err := rows.Scan(
+			&key.ID,
+			&key.Name,
+			&key.Prefix,
+			pq.Array(&key.Permissions),
+			&key.Expiry,
+			&key.CreatedAt,
+			&key.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Touch records that a key was just used
+func (m ApiKeyModel) Touch(id int64) error {
+	query := `
+        UPDATE api_keys
+        SET last_used_at = now()
+        WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// Delete revokes a key. The user ID is part of the WHERE clause so that
+// users can only revoke their own keys
+func (m ApiKeyModel) Delete(id int64, userID int64) error {
+	query := `
+        DELETE FROM api_keys
+        WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,255 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/martinezmoises/Test3/internal/validator"
+)
+
+// Outcomes of an audited action
+const AuditSuccess = "success"
+const AuditFailure = "failure"
+
+// Authentication
+const AuditLogin = "auth.login"
+const AuditLoginTwoFactor = "auth.login.2fa"
+const AuditLoginOIDC = "auth.login.oidc"
+const AuditLoginMagicLink = "auth.login.magic_link"
+const AuditMagicLinkRequest = "auth.magic_link.request"
+const AuditLogout = "auth.logout"
+const AuditTokenRefresh = "auth.token.refresh"
+const AuditTokenInvalid = "auth.token.invalid"
+const AuditApiKeyInvalid = "auth.api_key.invalid"
+const AuditPermissionDenied = "auth.permission.denied"
+const AuditSessionRevoke = "auth.session.revoke"
+
+// Account actions done by the user themselves
+const AuditUserRegister = "user.register"
+const AuditUserActivate = "user.activate"
+const AuditPasswordResetRequest = "user.password_reset.request"
+const AuditPasswordReset = "user.password_reset"
+const AuditPasswordChange = "user.password.change"
+const AuditEmailChangeRequest = "user.email_change.request"
+const AuditEmailChange = "user.email_change"
+const AuditTwoFactorEnable = "user.2fa.enable"
+const AuditTwoFactorDisable = "user.2fa.disable"
+const AuditUserDelete = "user.delete"
+const AuditApiKeyCreate = "user.api_key.create"
+const AuditApiKeyDelete = "user.api_key.delete"
+
+// Admin actions
+const AuditAdminDeactivateUser = "admin.user.deactivate"
+const AuditAdminReactivateUser = "admin.user.reactivate"
+const AuditAdminBanUser = "admin.user.ban"
+const AuditAdminUnbanUser = "admin.user.unban"
+const AuditAdminResetPassword = "admin.user.password_reset"
+const AuditAdminRevokeTokens = "admin.user.revoke_tokens"
+const AuditAdminGrantRole = "admin.role.grant"
+const AuditAdminRevokeRole = "admin.role.revoke"
+const AuditAdminUnlockUser = "admin.user.unlock"
+
+// An AuditEvent records who did what to whom, from where, and whether it
+// worked. ActorID and TargetUserID are nil when there is no such user
+type AuditEvent struct {
+	ID           int64          `json:"id"`
+	CreatedAt    time.Time      `json:"created_at"`
+	ActorID      *int64         `json:"actor_id"`
+	TargetUserID *int64         `json:"target_user_id"`
+	Action       string         `json:"action"`
+	Outcome      string         `json:"outcome"`
+	IPAddress    string         `json:"ip_address"`
+	UserAgent    string         `json:"user_agent"`
+	Details      map[string]any `json:"details"`
+}
+
+type AuditModel struct {
+	DB *sql.DB
+}
+
+// Insert appends an event to the audit log
+func (m AuditModel) Insert(event *AuditEvent) error {
+	details := event.Details
+	if details == nil {
+		details = map[string]any{}
+	}
+	detailsJSON, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+
+	query := `
+        INSERT INTO audit_events (actor_id, target_user_id, action, outcome, ip_address, user_agent, details)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING id, created_at`
+	args := []any{event.ActorID, event.TargetUserID, event.Action, event.Outcome, event.IPAddress, event.UserAgent, detailsJSON}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+}
+
+// Purge deletes events older than olderThan through purge_audit_events(),
+// the only way the append-only trigger lets them go. olderThan has to be
+// at least 30 days
+func (m AuditModel) Purge(ctx context.Context, olderThan time.Duration) (int64, error) {
+	query := `SELECT purge_audit_events(make_interval(secs => $1))`
+
+	// A long time between purges can leave a lot to delete
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	var purged int64
+	err := m.DB.QueryRowContext(ctx, query, olderThan.Seconds()).Scan(&purged)
+	return purged, err
+}
+
+// AuditFilter narrows down a search of the audit log. Zero values match
+// everything. An Action ending in ".*" matches every action starting with
+// what comes before the "*", e.g. "auth.*". UserID matches events where the
+// user was either the actor or the target
+type AuditFilter struct {
+	Action       string
+	Outcome      string
+	ActorID      int64
+	TargetUserID int64
+	UserID       int64
+	IPAddress    string
+	From         *time.Time
+	To           *time.Time
+}
+
+func ValidateAuditFilter(v *validator.Validator, filter AuditFilter) {
+	v.Check(filter.Outcome == "" || validator.PermittedValue(filter.Outcome, AuditSuccess, AuditFailure), "outcome", "must be success or failure")
+	v.Check(filter.ActorID >= 0, "actor_id", "must be a positive integer")
+	v.Check(filter.TargetUserID >= 0, "target_user_id", "must be a positive integer")
+	v.Check(filter.UserID >= 0, "user_id", "must be a positive integer")
+	if filter.From != nil && filter.To != nil {
+		v.Check(!filter.From.After(*filter.To), "from", "must not be after to")
+	}
+}
+
+// The WHERE clause shared by GetAll() and Export(). The filter values are
+// passed as $1 to $8. created_at is a local time in the database's time
+// zone (it defaults to now()), so from and to are read with their offset
+// and converted to that zone. A plain ::timestamp would drop the offset
+const auditFilterClause = `
+        WHERE ($1 = '' OR action = $1
+               OR (right($1, 2) = '.*' AND starts_with(action, left($1, -1))))
+        AND ($2 = '' OR outcome = $2)
+        AND ($3 = 0 OR actor_id = $3)
+        AND ($4 = 0 OR target_user_id = $4)
+        AND ($5 = 0 OR actor_id = $5 OR target_user_id = $5)
+        AND ($6 = '' OR ip_address = $6)
+        AND ($7::timestamptz IS NULL OR created_at >= $7::timestamptz::timestamp)
+        AND ($8::timestamptz IS NULL OR created_at < $8::timestamptz::timestamp)`
+
+func (f AuditFilter) args() []any {
+	return []any{f.Action, f.Outcome, f.ActorID, f.TargetUserID, f.UserID, f.IPAddress, f.From, f.To}
+}
+
+// GetAll searches the audit log one page at a time
+func (m AuditModel) GetAll(filter AuditFilter, filters Filters) ([]*AuditEvent, Metadata, error) {
+	query := fmt.Sprintf(`
+        SELECT COUNT(*) OVER(), id, created_at, actor_id, target_user_id, action,
+               outcome, ip_address, user_agent, details
+        FROM audit_events
+        %s
+        ORDER BY %s %s, id DESC
+        LIMIT $9 OFFSET $10`, auditFilterClause, filters.sortColumn(), filters.sortDirection())
+	args := append(filter.args(), filters.limit(), filters.offset())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	var totalRecords int
+	events := []*AuditEvent{}
+
+	for rows.Next() {
+		var event AuditEvent
+		err := scanAuditEvent(rows, &event, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		events = append(events, &event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+	return events, metadata, nil
+}
+
+// Export calls fn for every matching event, oldest first, without holding
+// them all in memory. It stops at the first error fn returns
+func (m AuditModel) Export(filter AuditFilter, fn func(*AuditEvent) error) error {
+	query := fmt.Sprintf(`
+        SELECT id, created_at, actor_id, target_user_id, action,
+               outcome, ip_address, user_agent, details
+        FROM audit_events
+        %s
+        ORDER BY id ASC`, auditFilterClause)
+
+	// The whole log can be large so this gets longer than usual
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, filter.args()...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var event AuditEvent
+		err := scanAuditEvent(rows, &event, nil)
+		if err != nil {
+			return err
+		}
+		err = fn(&event)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Scan one row into event. If totalRecords isn't nil the row starts with
+// a COUNT(*) OVER() column
+func scanAuditEvent(rows *sql.Rows, event *AuditEvent, totalRecords *int) error {
+	var detailsJSON []byte
+	dest := []any{
+		&event.ID,
+		&event.CreatedAt,
+		&event.ActorID,
+		&event.TargetUserID,
+		&event.Action,
+		&event.Outcome,
+		&event.IPAddress,
+		&event.UserAgent,
+		&detailsJSON,
+	}
+	if totalRecords != nil {
+		dest = append([]any{totalRecords}, dest...)
+	}
+
+	err := rows.Scan(dest...)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(detailsJSON, &event.Details)
+}
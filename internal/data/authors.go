@@ -0,0 +1,409 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lib/pq"
+	"github.com/martinezmoises/Test3/internal/validator"
+)
+
+// An Author is anyone credited on a book, whether they wrote, edited or
+// translated it
+type Author struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Bio       string    `json:"bio"`
+	CreatedAt time.Time `json:"created_at"`
+	Version   int       `json:"version"`
+}
+
+type AuthorModel struct {
+	DB *sql.DB
+}
+
+// The part someone played in a book
+const ContributorAuthor = "author"
+const ContributorEditor = "editor"
+const ContributorTranslator = "translator"
+
+// A Contributor links an author to a book, in the order they are credited.
+// When a book is saved a contributor without an AuthorID is looked up by
+// Name, and a new author is created if nobody has that name yet
+type Contributor struct {
+	AuthorID int64  `json:"author_id"`
+	Name     string `json:"name"`
+	Role     string `json:"role"`
+}
+
+// An AuthorBook is one of an author's books and the part they played in it
+type AuthorBook struct {
+	Role string `json:"role"`
+	*Book
+}
+
+var ErrDuplicateAuthor = errors.New("duplicate author")
+var ErrAuthorHasBooks = errors.New("author has books")
+var ErrUnknownAuthor = errors.New("unknown author")
+
+// isDuplicateAuthor reports whether err is Postgres rejecting an author
+// because another one already has the same name once case, spacing and
+// punctuation are ignored (unique_violation on authors_normalized_name_key)
+func isDuplicateAuthor(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505" && pqErr.Constraint == "authors_normalized_name_key"
+	}
+	return false
+}
+
+// isAuthorReference reports whether err is a foreign_key_violation between
+// book_authors and authors: either linking a book to an author that
+// doesn't exist, or deleting an author who still has books
+func isAuthorReference(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23503" && pqErr.Constraint == "book_authors_author_id_fkey"
+	}
+	return false
+}
+
+func validateAuthorName(v *validator.Validator, key string, name string) {
+	v.Check(name != "", key, "must be provided")
+	v.Check(len(name) <= 200, key, "must not be more than 200 bytes long")
+	// Names are matched on what normalizeAuthorName() leaves of them
+	v.Check(name == "" || normalizeAuthorName(name) != "", key, "must contain a letter or a digit")
+}
+
+// The same as normalize_author_name() from migration 000023, which works
+// out authors.normalized_name, and the two have to stay in step. ASCII
+// letters are lowercased and any other ASCII character that isn't a letter
+// or digit is dropped. Everything outside ASCII is kept as it is: what
+// Postgres counts as a letter, or how it lowercases one, depends on the
+// database's locale, and in the C locale names in other scripts would be
+// stripped to nothing and all clash. The price is that "Émile" and "émile"
+// are two different authors
+func normalizeAuthorName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			b.WriteRune(r + 'a' - 'A')
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r > unicode.MaxASCII:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func ValidateAuthor(v *validator.Validator, author *Author) {
+	validateAuthorName(v, "name", author.Name)
+	v.Check(len(author.Bio) <= 2000, "bio", "must not be more than 2000 bytes long")
+}
+
+// A book needs at least one author, and can have editors and translators
+// as well
+func ValidateContributors(v *validator.Validator, contributors []Contributor) {
+	authors := 0
+	for _, contributor := range contributors {
+		if contributor.Role == ContributorAuthor {
+			authors++
+		}
+		v.Check(validator.PermittedValue(contributor.Role, ContributorAuthor, ContributorEditor, ContributorTranslator),
+			"contributors", "role must be one of author, editor or translator")
+		if contributor.AuthorID == 0 {
+			validateAuthorName(v, "contributors", contributor.Name)
+		} else {
+			v.Check(contributor.AuthorID > 0, "contributors", "author_id must be a positive integer")
+		}
+	}
+	v.Check(authors > 0, "authors", "at least one author must be provided")
+}
+
+func (m AuthorModel) Insert(author *Author) error {
+	query := `
+        INSERT INTO authors (name, bio)
+        VALUES ($1, $2)
+        RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, author.Name, author.Bio).Scan(&author.ID, &author.CreatedAt, &author.Version)
+	if err != nil {
+		if isDuplicateAuthor(err) {
+			return ErrDuplicateAuthor
+		}
+		return err
+	}
+	return nil
+}
+
+func (m AuthorModel) Get(id int64) (*Author, error) {
+	query := `
+        SELECT id, name, bio, created_at, version
+        FROM authors
+        WHERE id = $1`
+
+	var author Author
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&author.ID, &author.Name, &author.Bio, &author.CreatedAt, &author.Version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+	return &author, nil
+}
+
+// GetAll lists authors one page at a time, optionally only those whose
+// name contains name, ignoring case
+func (m AuthorModel) GetAll(name string, filters Filters) ([]*Author, Metadata, error) {
+	query := fmt.Sprintf(`
+        SELECT COUNT(*) OVER(), id, name, bio, created_at, version
+        FROM authors
+        WHERE ($1 = '' OR name ILIKE '%%' || $1 || '%%')
+        ORDER BY %s %s, id ASC
+        LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, name, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	var totalRecords int
+	authors := []*Author{}
+
+	for rows.Next() {
+		var author Author
+		err := rows.Scan(&totalRecords, &author.ID, &author.Name, &author.Bio, &author.CreatedAt, &author.Version)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		authors = append(authors, &author)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+	return authors, metadata, nil
+}
+
+// Update saves an author as long as nobody else has changed them since they
+// were read. Otherwise ErrEditConflict is returned. A new name shows up on
+// all of their books straight away
+func (m AuthorModel) Update(author *Author) error {
+	query := `
+        UPDATE authors
+        SET name = $1, bio = $2, version = version + 1
+        WHERE id = $3 AND version = $4
+        RETURNING version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, author.Name, author.Bio, author.ID, author.Version).Scan(&author.Version)
+	if err != nil {
+		switch {
+		case isDuplicateAuthor(err):
+			return ErrDuplicateAuthor
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes an author, but only if they are still at the given version
+// and aren't credited on any books
+func (m AuthorModel) Delete(id int64, version int) error {
+	query := `DELETE FROM authors WHERE id = $1 AND version = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, version)
+	if err != nil {
+		if isAuthorReference(err) {
+			return ErrAuthorHasBooks
+		}
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+	return nil
+}
+
+// GetBooks lists the books an author is credited on, one page at a time.
+// A book they are credited on twice, e.g. as author and translator, shows
+// up once for each role
+func (m AuthorModel) GetBooks(authorID int64, filters Filters) ([]*AuthorBook, Metadata, error) {
+	query := fmt.Sprintf(`
+        SELECT COUNT(*) OVER(), book_authors.role, books.id, books.created_at, books.title, books.authors,
+               books.isbn, books.publication_date, books.genre, books.description,
+               books.average_rating, books.ratings_count, books.version
+        FROM book_authors
+        INNER JOIN books ON books.id = book_authors.book_id
+        WHERE book_authors.author_id = $1
+        ORDER BY books.%s %s, books.id ASC, book_authors.role ASC
+        LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, authorID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	var totalRecords int
+	books := []*AuthorBook{}
+
+	for rows.Next() {
+		book := AuthorBook{Book: &Book{}}
+		err := rows.Scan(
+			&totalRecords,
+			&book.Role,
+			&book.ID,
+			&book.CreatedAt,
+			&book.Title,
+			pq.Array(&book.Authors),
+			&book.ISBN,
+			&book.PublicationDate,
+			&book.Genre,
+			&book.Description,
+			&book.AverageRating,
+			&book.RatingsCount,
+			&book.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		books = append(books, &book)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+	return books, metadata, nil
+}
+
+// queryer is what *sql.DB and *sql.Tx have in common, so the contributor
+// helpers work inside or outside a transaction
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Load a book's contributors in the order they are credited
+func getContributors(ctx context.Context, q queryer, bookID int64) ([]Contributor, error) {
+	query := `
+        SELECT authors.id, authors.name, book_authors.role
+        FROM book_authors
+        INNER JOIN authors ON authors.id = book_authors.author_id
+        WHERE book_authors.book_id = $1
+        ORDER BY book_authors.position, book_authors.role`
+
+	rows, err := q.QueryContext(ctx, query, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	contributors := []Contributor{}
+	for rows.Next() {
+		var contributor Contributor
+		err := rows.Scan(&contributor.AuthorID, &contributor.Name, &contributor.Role)
+		if err != nil {
+			return nil, err
+		}
+		contributors = append(contributors, contributor)
+	}
+
+	return contributors, rows.Err()
+}
+
+// Replace a book's contributors with book.Contributors, creating any new
+// authors on the way. The triggers from migration 000023 rebuild
+// books.authors, so both are read back afterwards
+func setContributors(ctx context.Context, q queryer, book *Book) error {
+	_, err := q.ExecContext(ctx, `DELETE FROM book_authors WHERE book_id = $1`, book.ID)
+	if err != nil {
+		return err
+	}
+
+	for i, contributor := range book.Contributors {
+		authorID := contributor.AuthorID
+		if authorID == 0 {
+			authorID, err = findOrCreateAuthor(ctx, q, contributor.Name)
+			if err != nil {
+				return err
+			}
+		}
+
+		// The same person listed twice in the same role, perhaps under two
+		// spellings, is only linked once
+		query := `
+            INSERT INTO book_authors (book_id, author_id, role, position)
+            VALUES ($1, $2, $3, $4)
+            ON CONFLICT DO NOTHING`
+		_, err = q.ExecContext(ctx, query, book.ID, authorID, contributor.Role, i+1)
+		if err != nil {
+			if isAuthorReference(err) {
+				return ErrUnknownAuthor
+			}
+			return err
+		}
+	}
+
+	book.Contributors, err = getContributors(ctx, q, book.ID)
+	if err != nil {
+		return err
+	}
+
+	return q.QueryRowContext(ctx, `SELECT authors FROM books WHERE id = $1`, book.ID).Scan(pq.Array(&book.Authors))
+}
+
+// Return the id of the author with this name, ignoring case, spacing and
+// punctuation, adding them if there is no such author. With DO NOTHING an
+// author added by a concurrent transaction is invisible to this statement,
+// so nothing would come back. DO UPDATE waits for that transaction and
+// returns its row. Setting name to itself leaves the author as it was, and
+// the authors_books trigger only fires when the name actually changes
+func findOrCreateAuthor(ctx context.Context, q queryer, name string) (int64, error) {
+	query := `
+        INSERT INTO authors (name)
+        VALUES ($1)
+        ON CONFLICT (normalized_name) DO UPDATE SET name = authors.name
+        RETURNING id`
+
+	var id int64
+	err := q.QueryRowContext(ctx, query, strings.TrimSpace(name)).Scan(&id)
+	return id, err
+}
@@ -0,0 +1,97 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/martinezmoises/Test3/internal/validator"
+)
+
+// Each want is also what normalize_author_name() in migration 000023 gives
+// for the name, whatever the database's locale
+func TestNormalizeAuthorName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "J.R.R. Tolkien", want: "jrrtolkien"},
+		{name: "J. R. R. Tolkien", want: "jrrtolkien"},
+		{name: "  j r r tolkien  ", want: "jrrtolkien"},
+		{name: "Ursula K. Le Guin", want: "ursulakleguin"},
+		{name: "O'Brien", want: "obrien"},
+		{name: "R2-D2", want: "r2d2"},
+		{name: "under_score\ttab", want: "underscoretab"},
+		{name: "Émile Zola", want: "Émilezola"},
+		{name: "émile zola", want: "émilezola"},
+		{name: "Zoë", want: "zoë"},
+		{name: "Николай Гоголь", want: "НиколайГоголь"},
+		{name: "李白", want: "李白"},
+		{name: "杜甫", want: "杜甫"},
+		{name: "O’Brien", want: "o’brien"},
+		{name: "Le Guin", want: "le guin"},
+		{name: "?", want: ""},
+		{name: " - ", want: ""},
+		{name: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeAuthorName(tt.name); got != tt.want {
+				t.Errorf("normalizeAuthorName(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateAuthorName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{name: "J.R.R. Tolkien", valid: true},
+		{name: "李白", valid: true},
+		{name: "Émile Zola", valid: true},
+		{name: "7", valid: true},
+		{name: "", valid: false},
+		{name: "?", valid: false},
+		{name: "-- . --", valid: false},
+		{name: string(make([]byte, 201)), valid: false},
+	}
+
+	for _, tt := range tests {
+		v := validator.New()
+		validateAuthorName(v, "name", tt.name)
+		if v.IsEmpty() != tt.valid {
+			t.Errorf("validateAuthorName(%q) errors = %v, want valid %t", tt.name, v.Errors, tt.valid)
+		}
+	}
+}
+
+func TestValidateContributors(t *testing.T) {
+	tests := []struct {
+		name         string
+		contributors []Contributor
+		valid        bool
+	}{
+		{name: "one author", contributors: []Contributor{{Name: "Ursula K. Le Guin", Role: ContributorAuthor}}, valid: true},
+		{name: "existing author", contributors: []Contributor{{AuthorID: 7, Role: ContributorAuthor}}, valid: true},
+		{name: "author and translator", contributors: []Contributor{
+			{Name: "Gabriel García Márquez", Role: ContributorAuthor},
+			{Name: "Gregory Rabassa", Role: ContributorTranslator},
+		}, valid: true},
+		{name: "nobody", contributors: []Contributor{}},
+		{name: "only an editor", contributors: []Contributor{{Name: "Someone", Role: ContributorEditor}}},
+		{name: "unknown role", contributors: []Contributor{{Name: "Someone", Role: ContributorAuthor}, {Name: "Other", Role: "illustrator"}}},
+		{name: "name without letters", contributors: []Contributor{{Name: "?", Role: ContributorAuthor}}},
+		{name: "negative author id", contributors: []Contributor{{AuthorID: -1, Role: ContributorAuthor}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			ValidateContributors(v, tt.contributors)
+			if v.IsEmpty() != tt.valid {
+				t.Errorf("ValidateContributors() errors = %v, want valid %t", v.Errors, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/martinezmoises/Test3/internal/validator"
+)
+
+// The facets a book search can be broken down by
+const (
+	FacetGenre  = "genre"
+	FacetAuthor = "author"
+	FacetDecade = "decade"
+	FacetRating = "rating"
+)
+
+var BookFacetNames = []string{FacetGenre, FacetAuthor, FacetDecade, FacetRating}
+
+// A FacetBucket is one value of a facet and how many books have it
+type FacetBucket struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// Facets maps each requested facet to its buckets
+type Facets map[string][]FacetBucket
+
+func ValidateFacets(v *validator.Validator, names []string, authorLimit int) {
+	for _, name := range names {
+		if !validator.PermittedValue(name, BookFacetNames...) {
+			v.AddError("facets", fmt.Sprintf("unknown facet %q", name))
+			break
+		}
+	}
+	v.Check(authorLimit > 0, "facet_authors", "must be greater than zero")
+	v.Check(authorLimit <= 50, "facet_authors", "must not exceed 50")
+}
+
+// GetFacets counts the books matching filter by the named facets. Genres
+// come most common first, authors likewise but only the top authorLimit,
+// decades in order (e.g. "1990s") and ratings in bands from "unrated" and
+// "1-2" up to "4-5"
+func (m BookModel) GetFacets(filter BookFilter, names []string, authorLimit int) (Facets, error) {
+	// Each facet numbers its own buckets so they come back in the right
+	// order. The filter values are $1 to $4
+	query := fmt.Sprintf(`
+        WITH filtered AS (
+            SELECT genre, authors, publication_date, average_rating, ratings_count
+            FROM books
+            %s
+        ), buckets AS (
+            SELECT 'genre' AS facet, genre AS value, COUNT(*) AS count,
+                   row_number() OVER (ORDER BY COUNT(*) DESC, genre) AS position
+            FROM filtered
+            WHERE 'genre' = ANY($5)
+            GROUP BY genre
+
+            UNION ALL
+
+            SELECT * FROM (
+                SELECT 'author', author, COUNT(*),
+                       row_number() OVER (ORDER BY COUNT(*) DESC, author) AS position
+                FROM filtered, unnest(authors) AS author
+                WHERE 'author' = ANY($5)
+                GROUP BY author
+            ) AS authors
+            WHERE position <= $6
+
+            UNION ALL
+
+            SELECT 'decade', decade::TEXT || 's', COUNT(*),
+                   row_number() OVER (ORDER BY decade)
+            FROM (
+                SELECT EXTRACT(YEAR FROM publication_date)::INT / 10 * 10 AS decade
+                FROM filtered
+                WHERE 'decade' = ANY($5)
+            ) AS decades
+            GROUP BY decade
+
+            UNION ALL
+
+            SELECT 'rating', band, COUNT(*),
+                   row_number() OVER (ORDER BY MIN(band_order))
+            FROM (
+                SELECT CASE
+                           WHEN ratings_count = 0 THEN 'unrated'
+                           WHEN average_rating >= 4 THEN '4-5'
+                           WHEN average_rating >= 3 THEN '3-4'
+                           WHEN average_rating >= 2 THEN '2-3'
+                           ELSE '1-2'
+                       END AS band,
+                       CASE WHEN ratings_count = 0 THEN 0 ELSE floor(average_rating) END AS band_order
+                FROM filtered
+                WHERE 'rating' = ANY($5)
+            ) AS bands
+            GROUP BY band
+        )
+        SELECT facet, value, count
+        FROM buckets
+        ORDER BY facet, position`, bookFilterClause)
+
+	args := append(filter.args(), pq.Array(names), authorLimit)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Every requested facet is in the response, even with no buckets
+	facets := Facets{}
+	for _, name := range names {
+		facets[name] = []FacetBucket{}
+	}
+
+	for rows.Next() {
+		var facet string
+		var bucket FacetBucket
+		err := rows.Scan(&facet, &bucket.Value, &bucket.Count)
+		if err != nil {
+			return nil, err
+		}
+		facets[facet] = append(facets[facet], bucket)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return facets, nil
+}
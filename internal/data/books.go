@@ -5,6 +5,8 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"html"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
@@ -14,66 +16,118 @@ import (
 type Book struct {
 	ID              int64     `json:"id"`
 	Title           string    `json:"title"`
-	Authors         []string  `json:"authors"` // Change to slice of strings
+	Authors         []string  `json:"authors"` // Names of the book's authors, kept in step with Contributors
 	ISBN            string    `json:"isbn"`
 	PublicationDate string    `json:"publication_date"`
 	Genre           string    `json:"genre"`
 	Description     string    `json:"description"`
-	AverageRating   float64   `json:"average_rating"`
+	AverageRating   float64   `json:"average_rating"` // Derived from reviews, see migration 000019
+	RatingsCount    int       `json:"ratings_count"`
 	CreatedAt       time.Time `json:"created_at"`
 	Version         int       `json:"version"`
+
+	// Everyone credited on the book. Only loaded for a single book
+	Contributors []Contributor `json:"contributors,omitempty"`
+
+	// Only set on full-text search results
+	Relevance  float64           `json:"relevance,omitempty"`
+	Highlights map[string]string `json:"highlights,omitempty"`
 }
 
 type BookModel struct {
 	DB *sql.DB
 }
 
+// Specify a custom duplicate ISBN error message
+var ErrDuplicateISBN = errors.New("duplicate isbn")
+
+// isDuplicateISBN reports whether err is Postgres rejecting a row because
+// another book already has that ISBN (unique_violation on books_isbn_key)
+func isDuplicateISBN(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505" && pqErr.Constraint == "books_isbn_key"
+	}
+	return false
+}
+
+// ValidateBook expects the ISBN to have been through NormalizeISBN already
 func ValidateBook(v *validator.Validator, book *Book) {
 	v.Check(book.Title != "", "title", "must be provided")
 	v.Check(len(book.Title) <= 200, "title", "must not be more than 200 bytes long")
-	v.Check(len(book.Authors) > 0, "authors", "at least one author must be provided")
+	ValidateContributors(v, book.Contributors)
 	v.Check(book.ISBN != "", "isbn", "must be provided")
-	v.Check(len(book.ISBN) <= 13, "isbn", "must not be more than 13 bytes")
+	if book.ISBN != "" {
+		v.Check(ValidISBN13(book.ISBN), "isbn", "must be a valid ISBN-10 or ISBN-13")
+	}
 	v.Check(book.Genre != "", "genre", "must be provided")
 	v.Check(len(book.Genre) <= 50, "genre", "must not be more than 50 bytes")
 	v.Check(book.Description != "", "description", "must be provided")
 	v.Check(len(book.Description) <= 500, "description", "must not be more than 500 bytes")
 }
 
+// Insert adds a book and links it to its contributors. The authors column
+// is filled in from the contributors, see migration 000023
 func (m BookModel) Insert(book *Book) error {
 	query := `
-        INSERT INTO books (title, authors, isbn, publication_date, genre, description, average_rating)
-        VALUES ($1, $2, $3, $4, $5, $6, $7)
-        RETURNING id, created_at, version
+        INSERT INTO books (title, authors, isbn, publication_date, genre, description)
+        VALUES ($1, '{}', $2, $3, $4, $5)
+        RETURNING id, created_at, average_rating, ratings_count, version
     `
 
 	args := []any{
 		book.Title,
-		pq.Array(book.Authors), // Pass authors as array
 		book.ISBN,
 		book.PublicationDate,
 		book.Genre,
 		book.Description,
-		book.AverageRating,
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&book.ID, &book.CreatedAt, &book.Version)
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&book.ID, &book.CreatedAt, &book.AverageRating, &book.RatingsCount, &book.Version)
+	if err != nil {
+		if isDuplicateISBN(err) {
+			return ErrDuplicateISBN
+		}
+		return err
+	}
+
+	err = setContributors(ctx, tx, book)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
+
 func (m BookModel) Get(id int64) (*Book, error) {
+	return m.getWhere("id = $1", id)
+}
+
+// GetByISBN looks a book up by its normalized ISBN-13
+func (m BookModel) GetByISBN(isbn string) (*Book, error) {
+	return m.getWhere("isbn = $1", isbn)
+}
+
+func (m BookModel) getWhere(condition string, arg any) (*Book, error) {
 	query := `
-        SELECT id, created_at, title, authors, isbn, publication_date, genre, description, average_rating, version
+        SELECT id, created_at, title, authors, isbn, publication_date, genre, description, average_rating, ratings_count, version
         FROM books
-        WHERE id = $1
-    `
+        WHERE ` + condition
 
 	var book Book
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := m.DB.QueryRowContext(ctx, query, arg).Scan(
 		&book.ID,
 		&book.CreatedAt,
 		&book.Title,
@@ -83,6 +137,7 @@ func (m BookModel) Get(id int64) (*Book, error) {
 		&book.Genre,
 		&book.Description,
 		&book.AverageRating,
+		&book.RatingsCount,
 		&book.Version,
 	)
 	if err != nil {
@@ -92,75 +147,167 @@ func (m BookModel) Get(id int64) (*Book, error) {
 		return nil, err
 	}
 
+	book.Contributors, err = getContributors(ctx, m.DB, book.ID)
+	if err != nil {
+		return nil, err
+	}
+
 	return &book, nil
 }
 
+// Update saves a book and replaces its contributors with book.Contributors
 func (m BookModel) Update(book *Book) error {
 	query := `
         UPDATE books
-        SET title = $1, authors = $2, isbn = $3, publication_date = $4, genre = $5, description = $6, 
-            average_rating = $7, version = version + 1
-        WHERE id = $8
-        RETURNING version
+        SET title = $1, isbn = $2, publication_date = $3, genre = $4, description = $5,
+            version = version + 1
+        WHERE id = $6 AND version = $7
+        RETURNING average_rating, ratings_count, version
     `
 
 	args := []any{
 		book.Title,
-		pq.Array(book.Authors), // Use pq.Array to handle the slice of strings
 		book.ISBN,
 		book.PublicationDate,
 		book.Genre,
 		book.Description,
-		book.AverageRating,
 		book.ID,
+		book.Version,
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&book.Version)
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// No row means someone else changed (or deleted) the book since we
+	// read it
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&book.AverageRating, &book.RatingsCount, &book.Version)
+	if err != nil {
+		switch {
+		case isDuplicateISBN(err):
+			return ErrDuplicateISBN
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	err = setContributors(ctx, tx, book)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (m BookModel) Delete(id int64) error {
+// Delete removes a book, but only if it is still at the given version
+func (m BookModel) Delete(id int64, version int) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
-	query := `DELETE FROM books WHERE id = $1`
+	query := `DELETE FROM books WHERE id = $1 AND version = $2`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	result, err := m.DB.ExecContext(ctx, query, id)
+	result, err := m.DB.ExecContext(ctx, query, id, version)
 	if err != nil {
 		return err
 	}
 
 	rowsAffected, err := result.RowsAffected()
-	if err != nil || rowsAffected == 0 {
-		return ErrRecordNotFound
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrEditConflict
 	}
 
 	return nil
 }
 
-func (m BookModel) GetAll(title string, author string, genre string, filters Filters) ([]*Book, Metadata, error) {
-	query := fmt.Sprintf(`
-        SELECT COUNT(*) OVER(), id, created_at, title, authors, isbn, publication_date, genre, description, average_rating, version
-        FROM books
-        WHERE (title ILIKE '%%' || $1 || '%%' OR $1 = '')
-        AND ($2 = '' OR EXISTS (
+// BookFilter narrows down the book catalog. Zero values match everything.
+// Query is a full-text search in the style of a web search engine: words
+// are ANDed, "quoted phrases" match together, "or" between words matches
+// either and -word excludes it. Title, Author and Genre match any part of
+// those fields, ignoring case
+type BookFilter struct {
+	Query  string
+	Title  string
+	Author string
+	Genre  string
+}
+
+func ValidateBookFilter(v *validator.Validator, filter BookFilter, filters Filters) {
+	v.Check(len(filter.Query) <= 200, "q", "must not be more than 200 bytes long")
+	v.Check(filter.Query != "" || filters.Sort != "-relevance", "sort", "can only be -relevance with a search query")
+}
+
+// The WHERE clause for searching books. The filter values are passed as
+// $1 to $4
+const bookFilterClause = `
+        WHERE ($1 = '' OR search_vector @@ websearch_to_tsquery('english', $1))
+        AND ($2 = '' OR title ILIKE '%' || $2 || '%')
+        AND ($3 = '' OR EXISTS (
             SELECT 1
             FROM unnest(authors) AS a
-            WHERE a ILIKE '%%' || $2 || '%%'
+            WHERE a ILIKE '%' || $3 || '%'
         ))
-        AND (genre ILIKE '%%' || $3 || '%%' OR $3 = '')
-        ORDER BY %s %s, id ASC
-        LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
+        AND ($4 = '' OR genre ILIKE '%' || $4 || '%')`
+
+func (f BookFilter) args() []any {
+	return []any{f.Query, f.Title, f.Author, f.Genre}
+}
+
+// ts_headline() doesn't escape the text around the matches, and book
+// descriptions come from users. So the matches are marked with these,
+// the rest is HTML escaped and then they're swapped for <mark> tags
+const (
+	headlineStart = "[[mark]]"
+	headlineStop  = "[[/mark]]"
+)
+
+var headlineMarks = strings.NewReplacer(headlineStart, "<mark>", headlineStop, "</mark>")
+
+// GetAll searches the catalog one page at a time. With a search query each
+// book also gets its relevance and highlighted extracts of its title and
+// description. "-relevance" sorts the best matches first
+func (m BookModel) GetAll(filter BookFilter, filters Filters) ([]*Book, Metadata, error) {
+	// The headlines are slow to build so they are only worked out for the
+	// page being returned
+	query := fmt.Sprintf(`
+        SELECT page.*,
+               CASE WHEN $1 = '' THEN '' ELSE ts_headline('english', page.title,
+                   websearch_to_tsquery('english', $1), $7) END,
+               CASE WHEN $1 = '' THEN '' ELSE ts_headline('english', page.description,
+                   websearch_to_tsquery('english', $1), $8) END
+        FROM (
+            SELECT COUNT(*) OVER(), id, created_at, title, authors, isbn, publication_date, genre,
+                   description, average_rating, ratings_count, version,
+                   CASE WHEN $1 = '' THEN 0
+                        ELSE ts_rank(search_vector, websearch_to_tsquery('english', $1)) END AS relevance
+            FROM books
+            %s
+            ORDER BY %s %s, id ASC
+            LIMIT $5 OFFSET $6
+        ) AS page
+        ORDER BY %[2]s %[3]s, id ASC`, bookFilterClause, filters.sortColumn(), filters.sortDirection())
+
+	selectors := fmt.Sprintf("StartSel=%s, StopSel=%s", headlineStart, headlineStop)
+	args := append(filter.args(), filters.limit(), filters.offset(),
+		selectors+", HighlightAll=true",
+		selectors+", MaxFragments=2, MaxWords=30, MinWords=10")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query, title, author, genre, filters.limit(), filters.offset())
+	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -171,6 +318,7 @@ func (m BookModel) GetAll(title string, author string, genre string, filters Fil
 
 	for rows.Next() {
 		var book Book
+		var titleHeadline, descriptionHeadline string
 		err := rows.Scan(
 			&totalRecords,
 			&book.ID,
@@ -182,11 +330,21 @@ func (m BookModel) GetAll(title string, author string, genre string, filters Fil
 			&book.Genre,
 			&book.Description,
 			&book.AverageRating,
+			&book.RatingsCount,
 			&book.Version,
+			&book.Relevance,
+			&titleHeadline,
+			&descriptionHeadline,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
+		if filter.Query != "" {
+			book.Highlights = map[string]string{
+				"title":       headlineMarks.Replace(html.EscapeString(titleHeadline)),
+				"description": headlineMarks.Replace(html.EscapeString(descriptionHeadline)),
+			}
+		}
 		books = append(books, &book)
 	}
 
@@ -197,3 +355,30 @@ func (m BookModel) GetAll(title string, author string, genre string, filters Fil
 	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
 	return books, metadata, nil
 }
+
+// RecalculateRatings rebuilds every book's average rating and ratings count
+// from its reviews and returns how many books were updated. The reviews
+// trigger keeps them current, this is for repairing them
+func (m BookModel) RecalculateRatings() (int64, error) {
+	query := `
+        UPDATE books
+        SET average_rating = COALESCE(stats.average, 0), ratings_count = COALESCE(stats.count, 0)
+        FROM books AS b
+        LEFT JOIN (
+            SELECT book_id, ROUND(AVG(rating), 2) AS average, COUNT(rating) AS count
+            FROM reviews
+            GROUP BY book_id
+        ) AS stats ON stats.book_id = b.id
+        WHERE books.id = b.id
+        AND (books.average_rating <> COALESCE(stats.average, 0) OR books.ratings_count <> COALESCE(stats.count, 0))`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
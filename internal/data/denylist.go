@@ -0,0 +1,77 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Revoked signed tokens. Signed tokens are verified without a database
+// lookup, so revoking one before it expires means remembering its ID
+type DenylistModel struct {
+	DB *sql.DB
+}
+
+// Add a token ID (or token family) to the denylist until expiry
+func (m DenylistModel) Insert(id string, expiry time.Time) error {
+	query := `
+        INSERT INTO token_denylist (id, expiry)
+        VALUES ($1, $2)
+        ON CONFLICT (id) DO UPDATE SET expiry = GREATEST(token_denylist.expiry, EXCLUDED.expiry)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, expiry)
+	return err
+}
+
+// GetAll returns every entry that has not expired yet, keyed by ID
+func (m DenylistModel) GetAll() (map[string]time.Time, error) {
+	query := `
+        SELECT id, expiry
+        FROM token_denylist
+        WHERE expiry > $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make(map[string]time.Time)
+	for rows.Next() {
+		var id string
+		var expiry time.Time
+		err := rows.Scan(&id, &expiry)
+		if err != nil {
+			return nil, err
+		}
+		entries[id] = expiry
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// DeleteExpired removes entries for tokens that have expired anyway and
+// returns how many were removed
+func (m DenylistModel) DeleteExpired(ctx context.Context) (int64, error) {
+	query := `DELETE FROM token_denylist WHERE expiry <= $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,161 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var ErrDuplicateIdentity = errors.New("duplicate identity")
+
+// An Identity links an account at an external identity provider to a user
+type Identity struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"-"`
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"-"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// The secrets we keep between sending a user to the provider and the
+// provider sending them back
+type OIDCLogin struct {
+	Nonce        string
+	CodeVerifier string
+}
+
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+// GetUser returns the user linked to the provider's subject
+func (m IdentityModel) GetUser(issuer string, subject string) (*User, error) {
+	query := `
+        SELECT users.id, users.created_at, users.username, users.email,
+               users.password_hash, users.activated, users.deactivated_at,
+               users.banned_at, users.ban_reason, users.version
+        FROM users
+        INNER JOIN identities ON identities.user_id = users.id
+        WHERE identities.issuer = $1
+        AND identities.subject = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var user User
+	err := m.DB.QueryRowContext(ctx, query, issuer, subject).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Username,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.DeactivatedAt,
+		&user.BannedAt,
+		&user.BanReason,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// Insert links a new identity to a user
+func (m IdentityModel) Insert(identity *Identity) error {
+	query := `
+        INSERT INTO identities (user_id, issuer, subject, email)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id, created_at`
+	args := []any{identity.UserID, identity.Issuer, identity.Subject, identity.Email}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&identity.ID, &identity.CreatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "identities_issuer_subject_key" {
+			return ErrDuplicateIdentity
+		}
+		return err
+	}
+
+	return nil
+}
+
+// SaveLogin remembers the nonce and PKCE verifier for a login that is
+// being sent to the provider. Only a hash of the state is stored
+func (m IdentityModel) SaveLogin(state string, login OIDCLogin, ttl time.Duration) error {
+	stateHash := sha256.Sum256([]byte(state))
+
+	query := `
+        INSERT INTO oidc_logins (state_hash, nonce, code_verifier, expiry)
+        VALUES ($1, $2, $3, $4)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, stateHash[:], login.Nonce, login.CodeVerifier, time.Now().Add(ttl))
+	return err
+}
+
+// TakeLogin looks up a pending login by its state and deletes it, so each
+// state can only complete one login
+func (m IdentityModel) TakeLogin(state string) (*OIDCLogin, error) {
+	stateHash := sha256.Sum256([]byte(state))
+
+	query := `
+        DELETE FROM oidc_logins
+        WHERE state_hash = $1
+        RETURNING nonce, code_verifier, expiry > $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var login OIDCLogin
+	var unexpired bool
+	err := m.DB.QueryRowContext(ctx, query, stateHash[:], time.Now()).Scan(&login.Nonce, &login.CodeVerifier, &unexpired)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if !unexpired {
+		return nil, ErrRecordNotFound
+	}
+
+	return &login, nil
+}
+
+// DeleteExpiredLogins removes logins the user never came back from
+func (m IdentityModel) DeleteExpiredLogins(ctx context.Context) (int64, error) {
+	query := `
+        DELETE FROM oidc_logins
+        WHERE expiry <= $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,73 @@
+package data
+
+import (
+	"strings"
+)
+
+// NormalizeISBN removes the hyphens and spaces people write ISBNs with and
+// turns a valid ISBN-10 into the equivalent ISBN-13, which is how books
+// store them. Anything else is returned with just the separators removed,
+// so ValidateBook can reject it
+func NormalizeISBN(isbn string) string {
+	isbn = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(isbn))
+
+	if validISBN10(isbn) {
+		isbn13 := "978" + isbn[:9]
+		return isbn13 + string(isbn13CheckDigit(isbn13))
+	}
+	return isbn
+}
+
+// ValidISBN13 reports whether isbn is 13 digits with a correct check digit
+func ValidISBN13(isbn string) bool {
+	if len(isbn) != 13 || !allDigits(isbn) {
+		return false
+	}
+	return isbn13CheckDigit(isbn[:12]) == isbn[12]
+}
+
+// The digits of an ISBN-10 are weighted 10 down to 1 and the total must be
+// a multiple of 11. The last digit can be X, standing for 10
+func validISBN10(isbn string) bool {
+	if len(isbn) != 10 || !allDigits(isbn[:9]) {
+		return false
+	}
+
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += int(isbn[i]-'0') * (10 - i)
+	}
+	switch last := isbn[9]; {
+	case last == 'X':
+		sum += 10
+	case last >= '0' && last <= '9':
+		sum += int(last - '0')
+	default:
+		return false
+	}
+
+	return sum%11 == 0
+}
+
+// The first 12 digits of an ISBN-13 are weighted 1, 3, 1, 3, ... and the
+// check digit brings the total up to a multiple of 10
+func isbn13CheckDigit(first12 string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += int(first12[i]-'0') * weight
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+func allDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package data
+
+import "testing"
+
+func TestNormalizeISBN(t *testing.T) {
+	tests := []struct {
+		name string
+		isbn string
+		want string
+	}{
+		{name: "isbn-13", isbn: "9780306406157", want: "9780306406157"},
+		{name: "isbn-13 with hyphens", isbn: "978-0-306-40615-7", want: "9780306406157"},
+		{name: "isbn-13 with spaces", isbn: "978 0 306 40615 7", want: "9780306406157"},
+		{name: "isbn-10", isbn: "0306406152", want: "9780306406157"},
+		{name: "isbn-10 with hyphens", isbn: "0-306-40615-2", want: "9780306406157"},
+		{name: "isbn-10 ending in X", isbn: "080442957X", want: "9780804429573"},
+		{name: "isbn-10 ending in lowercase x", isbn: "0-8044-2957-x", want: "9780804429573"},
+		{name: "isbn-10 with wrong check digit", isbn: "0306406153", want: "0306406153"},
+		{name: "X in the middle", isbn: "03064X6152", want: "03064X6152"},
+		{name: "too short", isbn: "030640615", want: "030640615"},
+		{name: "empty", isbn: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizeISBN(tt.isbn); got != tt.want {
+				t.Errorf("NormalizeISBN(%q) = %q, want %q", tt.isbn, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidISBN13(t *testing.T) {
+	tests := []struct {
+		isbn string
+		want bool
+	}{
+		{isbn: "9780306406157", want: true},
+		{isbn: "9780804429573", want: true},
+		{isbn: "9791234567896", want: true},
+		{isbn: "9780306406158", want: false},
+		{isbn: "978-0306406157", want: false},
+		{isbn: "978030640615X", want: false},
+		{isbn: "978030640615", want: false},
+		{isbn: "97803064061570", want: false},
+		{isbn: "0306406152", want: false},
+		{isbn: "", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := ValidISBN13(tt.isbn); got != tt.want {
+			t.Errorf("ValidISBN13(%q) = %t, want %t", tt.isbn, got, tt.want)
+		}
+	}
+}
+
+func TestValidISBN10(t *testing.T) {
+	tests := []struct {
+		isbn string
+		want bool
+	}{
+		{isbn: "0306406152", want: true},
+		{isbn: "080442957X", want: true},
+		{isbn: "0306406153", want: false},
+		{isbn: "0804429579", want: false},
+		{isbn: "X306406152", want: false},
+		{isbn: "080442957x", want: false},
+		{isbn: "030640615", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := validISBN10(tt.isbn); got != tt.want {
+			t.Errorf("validISBN10(%q) = %t, want %t", tt.isbn, got, tt.want)
+		}
+	}
+}
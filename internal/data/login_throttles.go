@@ -0,0 +1,113 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Failed logins are counted per email address and per client IP, so an
+// attacker can't get around the limit by spreading attempts over many
+// accounts or many addresses
+func LoginThrottleEmailKey(email string) string {
+	return "email:" + strings.ToLower(email)
+}
+
+func LoginThrottleIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+type LoginThrottleModel struct {
+	DB *sql.DB
+}
+
+// RetryAfter returns how long the client has to wait before any of the
+// keys may try again. Zero means none of them are blocked
+func (m LoginThrottleModel) RetryAfter(keys ...string) (time.Duration, error) {
+	query := `
+        SELECT COALESCE(EXTRACT(EPOCH FROM MAX(blocked_until) - now()), 0)
+        FROM login_throttles
+        WHERE key = ANY($1) AND blocked_until > now()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var seconds float64
+	err := m.DB.QueryRowContext(ctx, query, pq.Array(keys)).Scan(&seconds)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// RecordFailure counts a failed attempt against a key and returns the number
+// of failures so far. Failures older than window are forgotten
+func (m LoginThrottleModel) RecordFailure(key string, window time.Duration) (int, error) {
+	query := `
+        INSERT INTO login_throttles (key, failures, last_failure_at)
+        VALUES ($1, 1, now())
+        ON CONFLICT (key) DO UPDATE
+        SET failures = CASE
+                WHEN login_throttles.last_failure_at < now() - make_interval(secs => $2) THEN 1
+                ELSE login_throttles.failures + 1
+            END,
+            last_failure_at = now()
+        RETURNING failures`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var failures int
+	err := m.DB.QueryRowContext(ctx, query, key, window.Seconds()).Scan(&failures)
+	return failures, err
+}
+
+// Block stops any further attempts for a key for the given duration
+func (m LoginThrottleModel) Block(key string, duration time.Duration) error {
+	query := `
+        UPDATE login_throttles
+        SET blocked_until = now() + make_interval(secs => $2)
+        WHERE key = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key, duration.Seconds())
+	return err
+}
+
+// Clear forgets all failures for the keys. Called after a successful login
+// and when an admin unlocks an account
+func (m LoginThrottleModel) Clear(keys ...string) error {
+	query := `
+        DELETE FROM login_throttles
+        WHERE key = ANY($1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, pq.Array(keys))
+	return err
+}
+
+// DeleteStale forgets keys that aren't blocked and haven't failed for
+// longer than olderThan. Their failures would be reset anyway
+func (m LoginThrottleModel) DeleteStale(ctx context.Context, olderThan time.Duration) (int64, error) {
+	query := `
+        DELETE FROM login_throttles
+        WHERE blocked_until < now()
+        AND last_failure_at < now() - make_interval(secs => $1)`
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, olderThan.Seconds())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,198 @@
+package data
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap settings so the tests don't spend their time hashing
+var testBcrypt = PasswordHashing{Algorithm: HashBcrypt, BcryptCost: bcrypt.MinCost}
+var testArgon2 = PasswordHashing{
+	Algorithm: HashArgon2id,
+	Argon2:    Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1},
+}
+
+func TestPasswordHashRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		hashing PasswordHashing
+		prefix  string
+	}{
+		{name: "bcrypt", hashing: testBcrypt, prefix: "$2a$04$"},
+		{name: "argon2id", hashing: testArgon2, prefix: "$argon2id$v=19$m=64,t=1,p=1$"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash, err := tt.hashing.hash("correct horse battery staple")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(hash), tt.prefix) {
+				t.Errorf("hash = %q, want prefix %q", hash, tt.prefix)
+			}
+
+			match, err := comparePassword(hash, "correct horse battery staple")
+			if err != nil || !match {
+				t.Errorf("comparePassword(right password) = %t, %v, want true", match, err)
+			}
+
+			match, err = comparePassword(hash, "correct horse battery stapler")
+			if err != nil || match {
+				t.Errorf("comparePassword(wrong password) = %t, %v, want false", match, err)
+			}
+
+			if tt.hashing.needsRehash(hash) {
+				t.Error("needsRehash() = true for a hash made with the same settings")
+			}
+		})
+	}
+}
+
+// Every argon2id hash gets its own salt
+func TestArgon2HashesAreSalted(t *testing.T) {
+	first, err := testArgon2.hash("hunter22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := testArgon2.hash("hunter22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first) == string(second) {
+		t.Error("two hashes of the same password are the same")
+	}
+}
+
+// bcrypt hashes from before argon2id was turned on keep working, and are
+// flagged for a rehash
+func TestLegacyBcryptHash(t *testing.T) {
+	legacy, err := bcrypt.GenerateFromPassword([]byte("hunter22"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match, err := comparePassword(legacy, "hunter22")
+	if err != nil || !match {
+		t.Errorf("comparePassword() = %t, %v, want true", match, err)
+	}
+	if !testArgon2.needsRehash(legacy) {
+		t.Error("needsRehash() = false for a bcrypt hash with argon2id configured")
+	}
+}
+
+func TestMalformedArgon2Hash(t *testing.T) {
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{name: "missing key", hash: "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ"},
+		{name: "empty key", hash: "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$"},
+		{name: "wrong version", hash: "$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5"},
+		{name: "version not a number", hash: "$argon2id$v=x$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5"},
+		{name: "params out of order", hash: "$argon2id$v=19$t=1,m=64,p=1$c2FsdHNhbHQ$a2V5a2V5"},
+		{name: "params not numbers", hash: "$argon2id$v=19$m=lots,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5"},
+		{name: "salt not base64", hash: "$argon2id$v=19$m=64,t=1,p=1$not*base64$a2V5a2V5"},
+		{name: "key not base64", hash: "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$not*base64"},
+		{name: "extra part", hash: "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5$"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, err := comparePassword([]byte(tt.hash), "hunter22")
+			if !errors.Is(err, ErrInvalidHash) || match {
+				t.Errorf("comparePassword() = %t, %v, want false, %v", match, err, ErrInvalidHash)
+			}
+			if !testArgon2.needsRehash([]byte(tt.hash)) {
+				t.Error("needsRehash() = false for a malformed hash")
+			}
+		})
+	}
+}
+
+// Anything that isn't argon2id is handed to bcrypt, which doesn't know it
+// either
+func TestUnknownHash(t *testing.T) {
+	for _, hash := range []string{"", "plaintext", "$argon2i$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5"} {
+		match, err := comparePassword([]byte(hash), "plaintext")
+		if err == nil || match {
+			t.Errorf("comparePassword(%q) = %t, %v, want an error", hash, match, err)
+		}
+	}
+}
+
+func TestPasswordNeedsRehash(t *testing.T) {
+	bcryptHash, err := testBcrypt.hash("hunter22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2Hash, err := testArgon2.hash("hunter22")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	higherCost := testBcrypt
+	higherCost.BcryptCost++
+
+	moreMemory := testArgon2
+	moreMemory.Argon2.Memory *= 2
+	moreIterations := testArgon2
+	moreIterations.Argon2.Iterations++
+	moreThreads := testArgon2
+	moreThreads.Argon2.Parallelism++
+
+	tests := []struct {
+		name    string
+		hashing PasswordHashing
+		hash    []byte
+		want    bool
+	}{
+		{name: "bcrypt, same cost", hashing: testBcrypt, hash: bcryptHash, want: false},
+		{name: "bcrypt, cost raised", hashing: higherCost, hash: bcryptHash, want: true},
+		{name: "bcrypt to argon2id", hashing: testArgon2, hash: bcryptHash, want: true},
+		{name: "argon2id, same params", hashing: testArgon2, hash: argon2Hash, want: false},
+		{name: "argon2id, more memory", hashing: moreMemory, hash: argon2Hash, want: true},
+		{name: "argon2id, more iterations", hashing: moreIterations, hash: argon2Hash, want: true},
+		{name: "argon2id, more threads", hashing: moreThreads, hash: argon2Hash, want: true},
+		{name: "argon2id to bcrypt", hashing: testBcrypt, hash: argon2Hash, want: true},
+		{name: "not a hash", hashing: testBcrypt, hash: []byte("plaintext"), want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.hashing.needsRehash(tt.hash); got != tt.want {
+				t.Errorf("needsRehash() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordHashingValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		hashing PasswordHashing
+		valid   bool
+	}{
+		{name: "bcrypt", hashing: testBcrypt, valid: true},
+		{name: "bcrypt cost too low", hashing: PasswordHashing{Algorithm: HashBcrypt, BcryptCost: bcrypt.MinCost - 1}},
+		{name: "bcrypt cost too high", hashing: PasswordHashing{Algorithm: HashBcrypt, BcryptCost: bcrypt.MaxCost + 1}},
+		{name: "argon2id", hashing: testArgon2, valid: true},
+		{name: "argon2id without iterations", hashing: PasswordHashing{Algorithm: HashArgon2id, Argon2: Argon2Params{Memory: 64, Parallelism: 1}}},
+		{name: "argon2id without threads", hashing: PasswordHashing{Algorithm: HashArgon2id, Argon2: Argon2Params{Memory: 64, Iterations: 1}}},
+		{name: "argon2id with too little memory", hashing: PasswordHashing{Algorithm: HashArgon2id, Argon2: Argon2Params{Memory: 15, Iterations: 1, Parallelism: 2}}},
+		{name: "unknown algorithm", hashing: PasswordHashing{Algorithm: "md5"}},
+		{name: "no algorithm", hashing: PasswordHashing{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.hashing.Validate()
+			if (err == nil) != tt.valid {
+				t.Errorf("Validate() = %v, want valid %t", err, tt.valid)
+			}
+		})
+	}
+}
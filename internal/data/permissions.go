@@ -0,0 +1,197 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/martinezmoises/Test3/internal/validator"
+)
+
+// Permission codes checked by the requirePermission() middleware
+const PermissionBooksRead = "books:read"
+const PermissionBooksWrite = "books:write"
+const PermissionAdmin = "admin:access"
+
+// Roles seeded by the permissions migration
+const RoleMember = "member"
+const RoleLibrarian = "librarian"
+const RoleAdmin = "admin"
+
+// Permissions holds the permission codes for a single user
+// e.g. ["books:read", "books:write"]
+type Permissions []string
+
+// Include checks if a specific permission code is in the slice
+func (p Permissions) Include(code string) bool {
+	return slices.Contains(p, code)
+}
+
+func ValidateRole(v *validator.Validator, role string) {
+	v.Check(role != "", "role", "must be provided")
+	v.Check(validator.PermittedValue(role, RoleMember, RoleLibrarian, RoleAdmin), "role", "must be one of member, librarian or admin")
+}
+
+type PermissionModel struct {
+	DB *sql.DB
+}
+
+// GetAllForUser returns every permission a user holds, either granted
+// directly or through one of their roles
+func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	query := `
+        SELECT permissions.code
+        FROM permissions
+        INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+        WHERE users_permissions.user_id = $1
+        UNION
+        SELECT permissions.code
+        FROM permissions
+        INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+        INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+        WHERE users_roles.user_id = $1
+        ORDER BY code`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions Permissions
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// AddForUser grants permission codes to a user directly
+func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+	query := `
+        INSERT INTO users_permissions (user_id, permission_id)
+        SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+        ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	return err
+}
+
+// GetRolesForUser returns the names of the roles assigned to a user
+func (m PermissionModel) GetRolesForUser(userID int64) ([]string, error) {
+	query := `
+        SELECT roles.name
+        FROM roles
+        INNER JOIN users_roles ON users_roles.role_id = roles.id
+        WHERE users_roles.user_id = $1
+        ORDER BY roles.name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []string{}
+	for rows.Next() {
+		var role string
+		err := rows.Scan(&role)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// GrantRole assigns a role to a user. Granting a role the user already
+// holds is not an error. An unknown role returns ErrRecordNotFound
+func (m PermissionModel) GrantRole(userID int64, role string) error {
+	query := `
+        INSERT INTO users_roles (user_id, role_id)
+        SELECT $1, roles.id FROM roles WHERE roles.name = $2
+        ON CONFLICT DO NOTHING
+        RETURNING role_id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var roleID int64
+	err := m.DB.QueryRowContext(ctx, query, userID, role).Scan(&roleID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		// Either the role does not exist or the user already has it
+		exists, err := m.roleExists(role)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrRecordNotFound
+		}
+	}
+
+	return nil
+}
+
+// RevokeRole removes a role from a user
+func (m PermissionModel) RevokeRole(userID int64, role string) error {
+	query := `
+        DELETE FROM users_roles
+        USING roles
+        WHERE users_roles.role_id = roles.id
+        AND users_roles.user_id = $1
+        AND roles.name = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, role)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (m PermissionModel) roleExists(role string) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM roles WHERE name = $1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var exists bool
+	err := m.DB.QueryRowContext(ctx, query, role).Scan(&exists)
+	return exists, err
+}
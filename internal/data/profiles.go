@@ -0,0 +1,151 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/martinezmoises/Test3/internal/validator"
+)
+
+// Visibility settings for a user's reading lists and reviews. Private lists
+// are only shown to their owner and to admins. Private reviews still appear
+// on the book, but only those two get to see who wrote them
+const VisibilityPublic = "public"
+const VisibilityPrivate = "private"
+
+type PrivacySettings struct {
+	Lists   string `json:"lists"`
+	Reviews string `json:"reviews"`
+}
+
+// A Profile is what other members get to see about a user
+type Profile struct {
+	ID          int64           `json:"id"`
+	Username    string          `json:"username"`
+	JoinedAt    time.Time       `json:"joined_at"`
+	Bio         string          `json:"bio,omitempty"`
+	AvatarURL   string          `json:"avatar_url,omitempty"`
+	ListCount   *int            `json:"list_count,omitempty"`
+	ReviewCount *int            `json:"review_count,omitempty"`
+	Privacy     PrivacySettings `json:"-"`
+}
+
+// HidePrivate drops the counts the user has chosen not to share
+func (p *Profile) HidePrivate() {
+	if p.Privacy.Lists == VisibilityPrivate {
+		p.ListCount = nil
+	}
+	if p.Privacy.Reviews == VisibilityPrivate {
+		p.ReviewCount = nil
+	}
+}
+
+func ValidateProfile(v *validator.Validator, user *User) {
+	v.Check(len(user.Bio) <= 500, "bio", "must not be more than 500 bytes long")
+
+	if user.AvatarURL != "" {
+		v.Check(len(user.AvatarURL) <= 500, "avatar_url", "must not be more than 500 bytes long")
+		u, err := url.ParseRequestURI(user.AvatarURL)
+		v.Check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "", "avatar_url", "must be an http or https URL")
+	}
+
+	v.Check(validator.PermittedValue(user.Privacy.Lists, VisibilityPublic, VisibilityPrivate), "privacy.lists", "must be public or private")
+	v.Check(validator.PermittedValue(user.Privacy.Reviews, VisibilityPublic, VisibilityPrivate), "privacy.reviews", "must be public or private")
+}
+
+// GetProfile fetches the public side of a user along with how many reading
+// lists and reviews they have. The counts are always filled in, call
+// HidePrivate() before showing the profile to anyone but its owner
+func (u UserModel) GetProfile(id int64) (*Profile, error) {
+	query := `
+        SELECT id, username, created_at, bio, avatar_url,
+               lists_visibility, reviews_visibility,
+               (SELECT COUNT(*) FROM reading_lists WHERE created_by = users.id),
+               (SELECT COUNT(*) FROM reviews WHERE user_id = users.id)
+        FROM users
+        WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var profile Profile
+	var listCount, reviewCount int
+	err := u.DB.QueryRowContext(ctx, query, id).Scan(
+		&profile.ID,
+		&profile.Username,
+		&profile.JoinedAt,
+		&profile.Bio,
+		&profile.AvatarURL,
+		&profile.Privacy.Lists,
+		&profile.Privacy.Reviews,
+		&listCount,
+		&reviewCount,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	profile.ListCount = &listCount
+	profile.ReviewCount = &reviewCount
+
+	return &profile, nil
+}
+
+// GetPrivacy returns a user's privacy settings
+func (u UserModel) GetPrivacy(id int64) (*PrivacySettings, error) {
+	query := `
+        SELECT lists_visibility, reviews_visibility
+        FROM users
+        WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var privacy PrivacySettings
+	err := u.DB.QueryRowContext(ctx, query, id).Scan(&privacy.Lists, &privacy.Reviews)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &privacy, nil
+}
+
+// UpdateProfile saves the user's bio, avatar and privacy settings. It is
+// kept apart from Update() so that code holding a user loaded without
+// these columns can't blank them
+func (u UserModel) UpdateProfile(user *User) error {
+	query := `
+        UPDATE users
+        SET bio = $1, avatar_url = $2, lists_visibility = $3, reviews_visibility = $4,
+            version = version + 1
+        WHERE id = $5 AND version = $6
+        RETURNING version`
+	args := []any{user.Bio, user.AvatarURL, user.Privacy.Lists, user.Privacy.Reviews, user.ID, user.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := u.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
@@ -18,6 +18,7 @@ type ReadingList struct {
 	Books       []int64   `json:"books"`
 	Status      string    `json:"status"`
 	CreatedAt   time.Time `json:"created_at"`
+	Version     int       `json:"version"`
 }
 
 type ReadingListModel struct {
@@ -36,18 +37,18 @@ func (m ReadingListModel) Insert(rl *ReadingList) error {
 	query := `
         INSERT INTO reading_lists (name, description, created_by, books, status)
         VALUES ($1, $2, $3, $4, $5)
-        RETURNING id, created_at`
+        RETURNING id, created_at, version`
 	args := []any{rl.Name, rl.Description, rl.CreatedBy, pq.Array(rl.Books), rl.Status}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&rl.ID, &rl.CreatedAt)
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&rl.ID, &rl.CreatedAt, &rl.Version)
 }
 
 func (m ReadingListModel) Get(id int64) (*ReadingList, error) {
 	query := `
-        SELECT id, name, description, created_by, books, status, created_at
+        SELECT id, name, description, created_by, books, status, created_at, version
         FROM reading_lists
         WHERE id = $1`
 
@@ -57,7 +58,7 @@ func (m ReadingListModel) Get(id int64) (*ReadingList, error) {
 
 	err := m.DB.QueryRowContext(ctx, query, id).Scan(
 		&rl.ID, &rl.Name, &rl.Description, &rl.CreatedBy,
-		pq.Array(&rl.Books), &rl.Status, &rl.CreatedAt)
+		pq.Array(&rl.Books), &rl.Status, &rl.CreatedAt, &rl.Version)
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -68,17 +69,23 @@ func (m ReadingListModel) Get(id int64) (*ReadingList, error) {
 	return &rl, nil
 }
 
-// GetAll retrieves all reading lists from the database.
-func (m ReadingListModel) GetAll() ([]*ReadingList, error) {
+// GetAll retrieves all reading lists from the database that viewerID may
+// see: their own, and those of users who keep their lists public. Admins
+// see every list
+func (m ReadingListModel) GetAll(viewerID int64, isAdmin bool) ([]*ReadingList, error) {
 	query := `
-        SELECT id, name, description, created_by, books, status, created_at
+        SELECT reading_lists.id, reading_lists.name, reading_lists.description,
+               reading_lists.created_by, reading_lists.books, reading_lists.status,
+               reading_lists.created_at, reading_lists.version
         FROM reading_lists
-        ORDER BY created_at DESC`
+        INNER JOIN users ON users.id = reading_lists.created_by
+        WHERE $2 OR reading_lists.created_by = $1 OR users.lists_visibility = 'public'
+        ORDER BY reading_lists.created_at DESC`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	rows, err := m.DB.QueryContext(ctx, query, viewerID, isAdmin)
 	if err != nil {
 		return nil, err
 	}
@@ -96,6 +103,7 @@ func (m ReadingListModel) GetAll() ([]*ReadingList, error) {
 			pq.Array(&books), // Handles the array of book IDs
 			&list.Status,
 			&list.CreatedAt,
+			&list.Version,
 		)
 		if err != nil {
 			return nil, err
@@ -111,67 +119,92 @@ func (m ReadingListModel) GetAll() ([]*ReadingList, error) {
 	return lists, nil
 }
 
+// Update saves a reading list as long as nobody else has changed it since
+// it was read. Otherwise ErrEditConflict is returned
 func (m ReadingListModel) Update(rl *ReadingList) error {
 	query := `
         UPDATE reading_lists
-        SET name = $1, description = $2, books = $3, status = $4
-        WHERE id = $5`
+        SET name = $1, description = $2, books = $3, status = $4, version = version + 1
+        WHERE id = $5 AND version = $6
+        RETURNING version`
 
-	args := []any{rl.Name, rl.Description, pq.Array(rl.Books), rl.Status, rl.ID}
+	args := []any{rl.Name, rl.Description, pq.Array(rl.Books), rl.Status, rl.ID, rl.Version}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
-	return err
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&rl.Version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrEditConflict
+		}
+		return err
+	}
+	return nil
 }
 
-func (m ReadingListModel) Delete(id int64) error {
-	query := `DELETE FROM reading_lists WHERE id = $1`
+// Delete removes a reading list, but only if it is still at the given
+// version
+func (m ReadingListModel) Delete(id int64, version int) error {
+	query := `DELETE FROM reading_lists WHERE id = $1 AND version = $2`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	result, err := m.DB.ExecContext(ctx, query, id)
+	result, err := m.DB.ExecContext(ctx, query, id, version)
 	if err != nil {
 		return err
 	}
 
 	rowsAffected, err := result.RowsAffected()
-	if err != nil || rowsAffected == 0 {
-		return ErrRecordNotFound
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrEditConflict
 	}
 	return nil
 }
 
-func (m ReadingListModel) AddBook(listID int64, bookID int64) error {
+// AddBook and RemoveBook change the list too, so they are version checked
+// and bump the version like Update()
+func (m ReadingListModel) AddBook(rl *ReadingList, bookID int64) error {
 	query := `
         UPDATE reading_lists
-        SET books = array_append(books, $1)
-        WHERE id = $2`
+        SET books = array_append(books, $1), version = version + 1
+        WHERE id = $2 AND version = $3
+        RETURNING books, version`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	_, err := m.DB.ExecContext(ctx, query, bookID, listID)
-	return err
+	return m.updateBooks(rl, query, bookID)
 }
 
-func (m ReadingListModel) RemoveBook(listID int64, bookID int64) error {
+func (m ReadingListModel) RemoveBook(rl *ReadingList, bookID int64) error {
 	query := `
         UPDATE reading_lists
-        SET books = array_remove(books, $1)
-        WHERE id = $2`
+        SET books = array_remove(books, $1), version = version + 1
+        WHERE id = $2 AND version = $3
+        RETURNING books, version`
+
+	return m.updateBooks(rl, query, bookID)
+}
 
+func (m ReadingListModel) updateBooks(rl *ReadingList, query string, bookID int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, bookID, listID)
-	return err
+	err := m.DB.QueryRowContext(ctx, query, bookID, rl.ID, rl.Version).Scan(pq.Array(&rl.Books), &rl.Version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrEditConflict
+		}
+		return err
+	}
+	return nil
 }
+
 func (m ReadingListModel) GetByUserID(userID int64) ([]*ReadingList, error) {
 	query := `
-        SELECT id, name, description, created_by, books, status, created_at
+        SELECT id, name, description, created_by, books, status, created_at, version
         FROM reading_lists
         WHERE created_by = $1
     `
@@ -195,6 +228,7 @@ func (m ReadingListModel) GetByUserID(userID int64) ([]*ReadingList, error) {
 			pq.Array(&list.Books),
 			&list.Status,
 			&list.CreatedAt,
+			&list.Version,
 		)
 		if err != nil {
 			return nil, err
@@ -12,10 +12,11 @@ import (
 type Review struct {
 	ID         int64     `json:"id"`
 	BookID     int64     `json:"book_id"`
-	UserID     int64     `json:"user_id"`
+	UserID     int64     `json:"user_id,omitempty"`
 	Rating     float64   `json:"rating"`
 	Review     string    `json:"review"`
 	ReviewDate time.Time `json:"review_date"`
+	Version    int       `json:"version"`
 }
 
 type ReviewModel struct {
@@ -27,14 +28,21 @@ func ValidateReview(v *validator.Validator, review *Review) {
 	v.Check(review.Review != "", "review", "must not be empty")
 }
 
-func (m ReviewModel) GetAll(bookID int64) ([]*Review, error) {
+// GetAll lists a book's reviews. Reviews by users who keep their reviews
+// private come back with a zero UserID, except to viewerID themselves and
+// to admins
+func (m ReviewModel) GetAll(bookID int64, viewerID int64, isAdmin bool) ([]*Review, error) {
 	query := `
-        SELECT id, book_id, user_id, rating, review, review_date
+        SELECT reviews.id, reviews.book_id,
+               CASE WHEN users.reviews_visibility = 'private' AND reviews.user_id <> $2 AND NOT $3
+                    THEN 0 ELSE reviews.user_id END,
+               reviews.rating, reviews.review, reviews.review_date, reviews.version
         FROM reviews
-        WHERE book_id = $1
-        ORDER BY review_date DESC`
+        INNER JOIN users ON users.id = reviews.user_id
+        WHERE reviews.book_id = $1
+        ORDER BY reviews.review_date DESC`
 
-	rows, err := m.DB.Query(query, bookID)
+	rows, err := m.DB.Query(query, bookID, viewerID, isAdmin)
 	if err != nil {
 		return nil, err
 	}
@@ -43,7 +51,7 @@ func (m ReviewModel) GetAll(bookID int64) ([]*Review, error) {
 	var reviews []*Review
 	for rows.Next() {
 		var review Review
-		if err := rows.Scan(&review.ID, &review.BookID, &review.UserID, &review.Rating, &review.Review, &review.ReviewDate); err != nil {
+		if err := rows.Scan(&review.ID, &review.BookID, &review.UserID, &review.Rating, &review.Review, &review.ReviewDate, &review.Version); err != nil {
 			return nil, err
 		}
 		reviews = append(reviews, &review)
@@ -55,18 +63,20 @@ func (m ReviewModel) Insert(review *Review) error {
 	query := `
         INSERT INTO reviews (book_id, user_id, rating, review)
         VALUES ($1, $2, $3, $4)
-        RETURNING id, review_date`
+        RETURNING id, review_date, version`
 
 	args := []any{review.BookID, review.UserID, review.Rating, review.Review}
-	return m.DB.QueryRow(query, args...).Scan(&review.ID, &review.ReviewDate)
+	return m.DB.QueryRow(query, args...).Scan(&review.ID, &review.ReviewDate, &review.Version)
 }
 
+// Update saves a review as long as nobody else has changed it since it was
+// read. Otherwise ErrEditConflict is returned
 func (m ReviewModel) Update(review *Review) error {
 	query := `
 		UPDATE reviews
-		SET rating = $1, review = $2, review_date = NOW()
-		WHERE id = $3
-		RETURNING review_date`
+		SET rating = $1, review = $2, review_date = NOW(), version = version + 1
+		WHERE id = $3 AND version = $4
+		RETURNING review_date, version`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -75,10 +85,11 @@ func (m ReviewModel) Update(review *Review) error {
 		review.Rating,
 		review.Review,
 		review.ID,
-	).Scan(&review.ReviewDate)
+		review.Version,
+	).Scan(&review.ReviewDate, &review.Version)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return ErrRecordNotFound
+			return ErrEditConflict
 		}
 		return err
 	}
@@ -88,7 +99,7 @@ func (m ReviewModel) Update(review *Review) error {
 
 func (m ReviewModel) Get(id int64) (*Review, error) {
 	query := `
-		SELECT id, book_id, user_id, rating, review, review_date
+		SELECT id, book_id, user_id, rating, review, review_date, version
 		FROM reviews
 		WHERE id = $1`
 
@@ -103,6 +114,7 @@ func (m ReviewModel) Get(id int64) (*Review, error) {
 		&review.Rating,
 		&review.Review,
 		&review.ReviewDate,
+		&review.Version,
 	)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -114,25 +126,30 @@ func (m ReviewModel) Get(id int64) (*Review, error) {
 	return &review, nil
 }
 
-func (m ReviewModel) Delete(id int64, userID int64) error {
+// Delete removes a user's review, but only if it is still at the given
+// version
+func (m ReviewModel) Delete(id int64, userID int64, version int) error {
 	query := `
         DELETE FROM reviews
-        WHERE id = $1 AND user_id = $2`
+        WHERE id = $1 AND user_id = $2 AND version = $3`
 
-	result, err := m.DB.Exec(query, id, userID)
+	result, err := m.DB.Exec(query, id, userID, version)
 	if err != nil {
 		return err
 	}
 	rowsAffected, err := result.RowsAffected()
-	if err != nil || rowsAffected == 0 {
-		return ErrRecordNotFound
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrEditConflict
 	}
 	return nil
 }
 
 func (m ReviewModel) GetByUserID(userID int64) ([]*Review, error) {
 	query := `
-        SELECT id, book_id, user_id, rating, review, review_date
+        SELECT id, book_id, user_id, rating, review, review_date, version
         FROM reviews
         WHERE user_id = $1
     `
@@ -155,6 +172,7 @@ func (m ReviewModel) GetByUserID(userID int64) ([]*Review, error) {
 			&review.Rating,
 			&review.Review,
 			&review.ReviewDate,
+			&review.Version,
 		)
 		if err != nil {
 			return nil, err
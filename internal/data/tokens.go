@@ -6,8 +6,10 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/martinezmoises/Test3/internal/validator"
 )
 
@@ -15,14 +17,48 @@ import (
 const ScopeActivation = "activation"
 const ScopeAuthentication = "authentication"
 const ScopePasswordReset = "password_reset"
+const ScopeRefresh = "refresh"
+const ScopeTwoFactorPending = "2fa_pending"
+const ScopeEmailChange = "email_change"
+const ScopeMagicLogin = "magic_login"
+
+// ErrTokenReused is returned when a refresh token that was already
+// rotated is presented again
+var ErrTokenReused = errors.New("refresh token reused")
 
 // Define our token
 type Token struct {
-	Plaintext string    `json:"token"`
-	Hash      []byte    `json:"-"`
-	UserID    int64     `json:"-"`
-	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	ID        int64      `json:"-"`
+	Plaintext string     `json:"token"`
+	Hash      []byte     `json:"-"`
+	UserID    int64      `json:"-"`
+	Expiry    time.Time  `json:"expiry"`
+	Scope     string     `json:"-"`
+	Family    string     `json:"-"`
+	UsedAt    *time.Time `json:"-"`
+	UserAgent string     `json:"-"`
+	IPAddress string     `json:"-"`
+}
+
+// TokenMetadata is the extra information we record about tokens that are
+// issued to a client when they log in
+type TokenMetadata struct {
+	Family    string
+	UserAgent string
+	IPAddress string
+}
+
+// A Session describes one active authentication token without exposing
+// the token itself
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	UserAgent  string     `json:"user_agent"`
+	IPAddress  string     `json:"ip_address"`
+	Family     string     `json:"-"`
+	Current    bool       `json:"current"`
 }
 
 // Generate a token for the user
@@ -49,13 +85,26 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 	return token, nil
 }
 
+// NewTokenFamily generates the identifier shared by every token issued
+// from a single login
+func NewTokenFamily() (string, error) {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
 // Validate the token the client sends back to us to be 26 bytes long
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(tokenPlaintext != "", "token", "must be provided")
 	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
 }
 
-// Our access to the database
+// Our access to the database. Token expiry is set from this server's
+// clock, so queries compare it with time.Now() passed in as a parameter
+// rather than the database's NOW()
 type TokenModel struct {
 	DB *sql.DB
 }
@@ -73,13 +122,29 @@ func (t TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
+// NewWithMetadata works like New() but also records the token family and
+// the user agent and IP address of the client the token was issued to
+func (t TokenModel) NewWithMetadata(userID int64, ttl time.Duration, scope string, metadata TokenMetadata) (*Token, error) {
+
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	token.Family = metadata.Family
+	token.UserAgent = metadata.UserAgent
+	token.IPAddress = metadata.IPAddress
+
+	err = t.Insert(token)
+	return token, err
+}
+
 // Do the actual insert in to the database table
 func (t TokenModel) Insert(token *Token) error {
 	query := `
-              INSERT INTO tokens (hash, user_id, expiry, scope) 
-              VALUES ($1, $2, $3, $4)
+              INSERT INTO tokens (hash, user_id, expiry, scope, user_agent, ip_address, family) 
+              VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''))
             `
-	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope, token.UserAgent, token.IPAddress, token.Family}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -100,3 +165,315 @@ func (t TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	_, err := t.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// Delete a single token along with the rest of its family. Used to log out
+// the token's owner, so the matching refresh token has to go too
+func (t TokenModel) DeleteByPlaintext(scope string, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+              DELETE FROM tokens
+              WHERE (scope = $1 AND hash = $2)
+              OR family = (SELECT family FROM tokens WHERE scope = $1 AND hash = $2)
+            `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := t.DB.ExecContext(ctx, query, scope, tokenHash[:])
+	return err
+}
+
+// DeleteExpired removes tokens of every scope that have expired and returns
+// how many were removed. Used refresh tokens are kept until they expire so
+// that reuse can still be detected
+func (t TokenModel) DeleteExpired(ctx context.Context) (int64, error) {
+	query := `
+              DELETE FROM tokens
+              WHERE expiry <= $1
+            `
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	result, err := t.DB.ExecContext(ctx, query, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// Use up a single-use token. The token is deleted and its owner's ID
+// returned in one statement, so two requests racing with the same token
+// can't both succeed
+func (t TokenModel) Consume(scope string, tokenPlaintext string) (int64, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+              DELETE FROM tokens
+              WHERE scope = $1 AND hash = $2 AND expiry > $3
+              RETURNING user_id
+            `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var userID int64
+	err := t.DB.QueryRowContext(ctx, query, scope, tokenHash[:], time.Now()).Scan(&userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+
+	return userID, nil
+}
+
+// Delete one of the user's sessions by its ID, including the other tokens
+// in the same family, and return the family. The user ID is part of the
+// WHERE clause so that users can only revoke their own sessions
+func (t TokenModel) DeleteSession(id int64, userID int64, scope string) (string, error) {
+	query := `
+              WITH session AS (
+                  SELECT id, family FROM tokens
+                  WHERE id = $1 AND user_id = $2 AND scope = $3
+              ), deleted AS (
+                  DELETE FROM tokens
+                  WHERE id IN (SELECT id FROM session)
+                  OR family IN (SELECT family FROM session)
+                  RETURNING id
+              )
+              SELECT COALESCE(family, ''), (SELECT COUNT(*) FROM deleted)
+              FROM session
+            `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var family string
+	var deleted int
+	err := t.DB.QueryRowContext(ctx, query, id, userID, scope).Scan(&family, &deleted)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+	return family, nil
+}
+
+// Record that a token was just used. To avoid a write on every request we
+// only update last_used_at if it is more than a minute old
+func (t TokenModel) Touch(scope string, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+              UPDATE tokens
+              SET last_used_at = now()
+              WHERE scope = $1 AND hash = $2
+              AND (last_used_at IS NULL OR last_used_at < now() - INTERVAL '1 minute')
+            `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := t.DB.ExecContext(ctx, query, scope, tokenHash[:])
+	return err
+}
+
+// List the user's unexpired, unused tokens of one scope. In the default
+// mode a session is an authentication token; with signed access tokens it
+// is the refresh token of a family. A session's creation time is the login
+// that started its family, not the latest refresh. The session matching
+// currentPlaintext (the token used for this request) is flagged as current
+func (t TokenModel) GetSessionsForUser(userID int64, scope string, currentPlaintext string) ([]*Session, error) {
+	currentHash := sha256.Sum256([]byte(currentPlaintext))
+
+	query := `
+              SELECT id,
+                     COALESCE((SELECT MIN(f.created_at) FROM tokens f WHERE f.family = tokens.family), created_at),
+                     last_used_at, expiry, user_agent, ip_address, COALESCE(family, ''), hash = $3
+              FROM tokens
+              WHERE user_id = $1 AND scope = $2 AND expiry > $4 AND used_at IS NULL
+              ORDER BY created_at DESC
+            `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := t.DB.QueryContext(ctx, query, userID, scope, currentHash[:], time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.UserAgent,
+			&session.IPAddress,
+			&session.Family,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// Get an unexpired refresh token. The token is returned even if it has
+// already been used so that the caller can detect reuse
+func (t TokenModel) GetRefreshToken(tokenPlaintext string) (*Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+              SELECT id, user_id, expiry, COALESCE(family, ''), used_at
+              FROM tokens
+              WHERE hash = $1 AND scope = $2 AND expiry > $3
+            `
+	token := Token{
+		Plaintext: tokenPlaintext,
+		Hash:      tokenHash[:],
+		Scope:     ScopeRefresh,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := t.DB.QueryRowContext(ctx, query, tokenHash[:], ScopeRefresh, time.Now()).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Expiry,
+		&token.Family,
+		&token.UsedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+// Mark a refresh token as used. If another request got there first the
+// token has been reused and we return ErrTokenReused
+func (t TokenModel) MarkUsed(id int64) error {
+	query := `
+              UPDATE tokens
+              SET used_at = now()
+              WHERE id = $1 AND used_at IS NULL
+            `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := t.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrTokenReused
+	}
+	return nil
+}
+
+// Delete every token in a family. Used when a refresh token is reused
+func (t TokenModel) DeleteFamily(family string) error {
+	query := `
+              DELETE FROM tokens
+              WHERE family = $1
+            `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := t.DB.ExecContext(ctx, query, family)
+	return err
+}
+
+// Delete the tokens of one scope in a family, e.g. the old access token
+// once it has been replaced during a refresh
+func (t TokenModel) DeleteFamilyScope(family string, scope string) error {
+	query := `
+              DELETE FROM tokens
+              WHERE family = $1 AND scope = $2
+            `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := t.DB.ExecContext(ctx, query, family, scope)
+	return err
+}
+
+// Log a user out of their sessions by deleting their authentication and
+// refresh tokens. Magic login links, half-finished 2FA logins and email
+// change confirmations that haven't been used yet go too, as each of them
+// is a session (or a takeover) waiting to happen. The session that
+// keepPlaintext belongs to (or the family keepFamily, for signed tokens) is
+// left alone; pass empty strings to log out everywhere. Returns the
+// families that were revoked
+func (t TokenModel) DeleteSessionsForUser(userID int64, keepPlaintext string, keepFamily string) ([]string, error) {
+	keepHash := sha256.Sum256([]byte(keepPlaintext))
+
+	query := `
+              WITH kept AS (
+                  SELECT hash, family FROM tokens WHERE hash = $3
+              )
+              DELETE FROM tokens
+              WHERE user_id = $1 AND scope = ANY($2)
+              AND hash NOT IN (SELECT hash FROM kept)
+              AND (family IS NULL OR (
+                  family <> $4
+                  AND family NOT IN (SELECT family FROM kept WHERE family IS NOT NULL)
+              ))
+              RETURNING COALESCE(family, '')
+            `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	scopes := []string{ScopeAuthentication, ScopeRefresh, ScopeMagicLogin, ScopeTwoFactorPending, ScopeEmailChange}
+	rows, err := t.DB.QueryContext(ctx, query, userID, pq.Array(scopes), keepHash[:], keepFamily)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[string]bool)
+	families := []string{}
+	for rows.Next() {
+		var family string
+		err := rows.Scan(&family)
+		if err != nil {
+			return nil, err
+		}
+		if family != "" && !seen[family] {
+			seen[family] = true
+			families = append(families, family)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return families, nil
+}
@@ -0,0 +1,242 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/martinezmoises/Test3/internal/validator"
+)
+
+// How many one-time recovery codes a user gets when they enable 2FA
+const RecoveryCodeCount = 10
+
+// TwoFactor is a user's TOTP enrollment. It only protects logins once the
+// user has confirmed it with a first code
+type TwoFactor struct {
+	UserID       int64
+	Secret       string
+	Confirmed    bool
+	LastUsedStep int64
+	CreatedAt    time.Time
+}
+
+func ValidateTOTPCode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(len(code) == 6, "code", "must be 6 digits long")
+}
+
+type TwoFactorModel struct {
+	DB *sql.DB
+}
+
+// Get the user's enrollment. Returns ErrRecordNotFound if they never
+// started enrolling
+func (m TwoFactorModel) Get(userID int64) (*TwoFactor, error) {
+	query := `
+        SELECT user_id, secret, confirmed, last_used_step, created_at
+        FROM users_totp
+        WHERE user_id = $1`
+
+	var tf TwoFactor
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&tf.UserID,
+		&tf.Secret,
+		&tf.Confirmed,
+		&tf.LastUsedStep,
+		&tf.CreatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+
+	return &tf, nil
+}
+
+// IsEnabled reports whether the user has a confirmed enrollment
+func (m TwoFactorModel) IsEnabled(userID int64) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM users_totp WHERE user_id = $1 AND confirmed)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var enabled bool
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&enabled)
+	return enabled, err
+}
+
+// Start (or restart) an enrollment with a new secret. A confirmed
+// enrollment is left alone and ErrEditConflict is returned
+func (m TwoFactorModel) Begin(userID int64, secret string) error {
+	query := `
+        INSERT INTO users_totp (user_id, secret)
+        VALUES ($1, $2)
+        ON CONFLICT (user_id) DO UPDATE
+        SET secret = EXCLUDED.secret, last_used_step = 0, created_at = now()
+        WHERE users_totp.confirmed = FALSE`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+	return nil
+}
+
+// Confirm the enrollment and replace the user's recovery codes. Both
+// happen in one transaction so a user never has 2FA without recovery codes
+func (m TwoFactorModel) Confirm(userID int64, recoveryCodes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `UPDATE users_totp SET confirmed = TRUE WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range recoveryCodes {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO recovery_codes (user_id, hash) VALUES ($1, $2)`,
+			userID, hashRecoveryCode(code))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Record that the code for a time step was accepted. Returns false if that
+// step (or a later one) was already used, i.e. the code is being replayed
+func (m TwoFactorModel) UseStep(userID int64, step int64) (bool, error) {
+	query := `
+        UPDATE users_totp
+        SET last_used_step = $2
+        WHERE user_id = $1 AND last_used_step < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// Use up one of the user's recovery codes. Returns false if the code is
+// wrong or has already been used
+func (m TwoFactorModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	query := `
+        UPDATE recovery_codes
+        SET used_at = now()
+        WHERE id = (
+            SELECT id FROM recovery_codes
+            WHERE user_id = $1 AND hash = $2 AND used_at IS NULL
+            LIMIT 1
+        )`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// Turn 2FA off and throw away the recovery codes
+func (m TwoFactorModel) Delete(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM users_totp WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return tx.Commit()
+}
+
+// GenerateRecoveryCodes returns a fresh set of plaintext recovery codes in
+// the form xxxxx-xxxxx. They are shown to the user once and stored hashed
+func GenerateRecoveryCodes() ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		randomBytes := make([]byte, 7)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+		codes[i] = code[:5] + "-" + code[5:10]
+	}
+	return codes, nil
+}
+
+// Recovery codes have plenty of entropy so, like tokens, a plain SHA-256
+// hash is enough. We ignore case and the dash so they are easy to type
+func hashRecoveryCode(code string) []byte {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	hash := sha256.Sum256([]byte(normalized))
+	return hash[:]
+}
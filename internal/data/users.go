@@ -2,25 +2,34 @@ package data
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/martinezmoises/Test3/internal/validator"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var AnonymousUser = &User{}
 
 type User struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Username  string    `json:"username"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	ID            int64           `json:"id"`
+	CreatedAt     time.Time       `json:"created_at"`
+	Username      string          `json:"username"`
+	Email         string          `json:"email"`
+	Password      password        `json:"-"`
+	Activated     bool            `json:"activated"`
+	DeactivatedAt *time.Time      `json:"deactivated_at,omitempty"`
+	BannedAt      *time.Time      `json:"banned_at,omitempty"`
+	BanReason     string          `json:"ban_reason,omitempty"`
+	Bio           string          `json:"bio"`
+	AvatarURL     string          `json:"avatar_url"`
+	Privacy       PrivacySettings `json:"privacy"`
+	Version       int             `json:"-"`
 }
 
 // IsAnonymous checks if the user is an anonymous user.
@@ -28,6 +37,11 @@ func (u *User) IsAnonymous() bool {
 	return u.ID == 0
 }
 
+// IsBanned checks if an admin has banned the user
+func (u *User) IsBanned() bool {
+	return u.BannedAt != nil
+}
+
 // define the password type (the plaintext + hashed password)
 // lowercase because we do not want it to be public
 type password struct {
@@ -35,9 +49,11 @@ type password struct {
 	hash      []byte
 }
 
-// The Set() method computes the hash of the password
-func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+// The Set() method computes the hash of the password with the given
+// settings. Handlers go through UserModel.SetPassword() so that the
+// server's settings are used
+func (p *password) Set(plaintextPassword string, hashing PasswordHashing) error {
+	hash, err := hashing.hash(plaintextPassword)
 	if err != nil {
 		return err
 	}
@@ -47,20 +63,10 @@ func (p *password) Set(plaintextPassword string) error {
 	return nil
 }
 
-// Compare the client-provided plaintext password with saved-hashed version
+// Compare the client-provided plaintext password with saved-hashed version.
+// Hashes made with older settings or another algorithm still work
 func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
-
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
-	}
-
-	return true, nil // password is correct
+	return comparePassword(p.hash, plaintextPassword)
 }
 
 // Validate the email address
@@ -96,41 +102,94 @@ func ValidateUser(v *validator.Validator, user *User) {
 // Specify a custom duplicate email error message
 var ErrDuplicateEmail = errors.New("duplicate email")
 
+// isDuplicateEmail reports whether err is Postgres rejecting a row because
+// another user already has that email (unique_violation on users_email_key)
+func isDuplicateEmail(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505" && pqErr.Constraint == "users_email_key"
+	}
+	return false
+}
+
 // Setup the struct
 type UserModel struct {
 	DB *sql.DB
+	// How new password hashes are made. Existing hashes are checked with
+	// whatever they were made with
+	Hashing PasswordHashing
 }
 
-// Insert a new user into the database
-func (u UserModel) Insert(user *User) error {
+// SetPassword hashes a new password for user with the server's settings.
+// Nothing is saved until the user is inserted or updated
+func (u UserModel) SetPassword(user *User, plaintext string) error {
+	return user.Password.Set(plaintext, u.Hashing)
+}
+
+// PasswordNeedsRehash reports whether the user's password hash was made
+// with settings other than the server's current ones
+func (u UserModel) PasswordNeedsRehash(user *User) bool {
+	return u.Hashing.needsRehash(user.Password.hash)
+}
+
+// Insert a new user into the database along with their roles. Both happen
+// in one transaction, so there is never a user without their roles. An
+// unknown role returns ErrRecordNotFound and nothing is saved
+func (u UserModel) Insert(user *User, roles ...string) error {
 	query := `
             INSERT INTO users (username, email, password_hash, activated) 
             VALUES ($1, $2, $3, $4)
-            RETURNING id, created_at, version
+            RETURNING id, created_at, lists_visibility, reviews_visibility, version
            `
 	args := []any{user.Username, user.Email, user.Password.hash, user.Activated}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
+
+	tx, err := u.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	// if an email address already exists we will get a pq error message
-	err := u.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Privacy.Lists, &user.Privacy.Reviews, &user.Version)
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique 
-							constraint "users_email_key"`:
+		case isDuplicateEmail(err):
 			return ErrDuplicateEmail
 		default:
 			return err
 		}
 	}
 
-	return nil
+	for _, role := range roles {
+		query := `
+            INSERT INTO users_roles (user_id, role_id)
+            SELECT $1, roles.id FROM roles WHERE roles.name = $2`
+
+		result, err := tx.ExecContext(ctx, query, user.ID, role)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			return ErrRecordNotFound
+		}
+	}
+
+	return tx.Commit()
 }
 
 // Get a user from the database based on their email provided
 func (u UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-			SELECT id, created_at, username, email, password_hash, activated, version
+			SELECT id, created_at, username, email, password_hash, activated,
+			       deactivated_at, banned_at, ban_reason, bio, avatar_url,
+			       lists_visibility, reviews_visibility, version
 			FROM users
 			WHERE email = $1
 		`
@@ -145,6 +204,13 @@ func (u UserModel) GetByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.DeactivatedAt,
+		&user.BannedAt,
+		&user.BanReason,
+		&user.Bio,
+		&user.AvatarURL,
+		&user.Privacy.Lists,
+		&user.Privacy.Reviews,
 		&user.Version,
 	)
 	if err != nil {
@@ -183,8 +249,7 @@ func (u UserModel) Update(user *User) error {
 	// Check for errors during update
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates 
-                                 unique constraint "users_email_key"`:
+		case isDuplicateEmail(err):
 			return ErrDuplicateEmail
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
@@ -203,13 +268,15 @@ func (u UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	// We will do a join- I hope you still remember how to do a join
 	query := `
 	SELECT users.id, users.created_at, users.username,
-		   users.email, users.password_hash, users.activated, users.version
+		   users.email, users.password_hash, users.activated,
+		   users.deactivated_at, users.version
 	FROM users
 	INNER JOIN tokens
 	ON users.id = tokens.user_id
 	WHERE tokens.hash = $1
 	AND tokens.scope = $2 
 	AND tokens.expiry > $3
+	AND users.banned_at IS NULL
 
 	`
 
@@ -225,6 +292,7 @@ func (u UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.Password.hash,
 
 		&user.Activated,
+		&user.DeactivatedAt,
 		&user.Version,
 	)
 	if err != nil {
@@ -246,7 +314,9 @@ func (u UserModel) GetByID(id int64) (*User, error) {
 	}
 
 	query := `
-        SELECT id, created_at, username, email, activated, version
+        SELECT id, created_at, username, email, password_hash, activated,
+               deactivated_at, banned_at, ban_reason, bio, avatar_url,
+               lists_visibility, reviews_visibility, version
         FROM users
         WHERE id = $1
     `
@@ -259,7 +329,15 @@ func (u UserModel) GetByID(id int64) (*User, error) {
 		&user.CreatedAt,
 		&user.Username,
 		&user.Email,
+		&user.Password.hash,
 		&user.Activated,
+		&user.DeactivatedAt,
+		&user.BannedAt,
+		&user.BanReason,
+		&user.Bio,
+		&user.AvatarURL,
+		&user.Privacy.Lists,
+		&user.Privacy.Reviews,
 		&user.Version,
 	)
 	if err != nil {
@@ -271,3 +349,365 @@ func (u UserModel) GetByID(id int64) (*User, error) {
 
 	return &user, nil
 }
+
+// Remember the address the user wants to change to until they confirm it
+func (u UserModel) SetPendingEmail(userID int64, email string) error {
+	query := `
+        UPDATE users
+        SET pending_email = $1
+        WHERE id = $2
+        `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := u.DB.ExecContext(ctx, query, email, userID)
+	return err
+}
+
+// Forget an email change the user hasn't confirmed yet
+func (u UserModel) ClearPendingEmail(userID int64) error {
+	query := `
+        UPDATE users
+        SET pending_email = NULL
+        WHERE id = $1
+        `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := u.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// Swap the user's email for their pending email. The version check works the
+// same way as in Update()
+func (u UserModel) ConfirmPendingEmail(user *User) error {
+	query := `
+        UPDATE users
+        SET email = pending_email, pending_email = NULL, version = version + 1
+        WHERE id = $1 AND version = $2 AND pending_email IS NOT NULL
+        RETURNING email, version
+        `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := u.DB.QueryRowContext(ctx, query, user.ID, user.Version).Scan(&user.Email, &user.Version)
+	if err != nil {
+		switch {
+		case isDuplicateEmail(err):
+			return ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reclaim hands an account that was never activated to whoever has just
+// proven they own its email address, e.g. through an identity provider.
+// Whoever registered it may not have been the owner, so everything they
+// could have set up goes: the password (user.Password must already hold a
+// new one), a pending email change, tokens of every scope, API keys and
+// 2FA. Deactivate() also clears activated, so accounts an admin deactivated
+// are left alone and ErrEditConflict is returned for them. The version
+// check works the same way as in Update()
+func (u UserModel) Reclaim(user *User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := u.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+        UPDATE users
+        SET password_hash = $1, pending_email = NULL,
+            activated = TRUE, version = version + 1
+        WHERE id = $2 AND version = $3 AND NOT activated AND deactivated_at IS NULL
+        RETURNING activated, version
+        `
+	err = tx.QueryRowContext(ctx, query, user.Password.hash, user.ID, user.Version).Scan(&user.Activated, &user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	for _, query := range []string{
+		`DELETE FROM tokens WHERE user_id = $1`,
+		`DELETE FROM api_keys WHERE user_id = $1`,
+		`DELETE FROM recovery_codes WHERE user_id = $1`,
+		`DELETE FROM users_totp WHERE user_id = $1`,
+	} {
+		_, err = tx.ExecContext(ctx, query, user.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Delete a user. Their reviews, reading lists, tokens and everything else
+// that references them go too (ON DELETE CASCADE)
+func (u UserModel) Delete(id int64) error {
+	query := `
+        DELETE FROM users
+        WHERE id = $1
+        `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := u.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// Anonymize a user instead of deleting them. The row stays so that their
+// reviews and reading lists remain, but everything that identifies the
+// person or lets anyone log in as them is removed
+func (u UserModel) Anonymize(id int64) error {
+	// A random password nobody knows. It has to be a real hash so
+	// that login attempts fail cleanly instead of erroring
+	var pw password
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+	err = pw.Set(hex.EncodeToString(randomBytes), u.Hashing)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := u.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+        UPDATE users
+        SET username = 'deleted user',
+            email = 'deleted-' || id || '@deleted.invalid',
+            pending_email = NULL,
+            password_hash = $2,
+            bio = '',
+            avatar_url = '',
+            activated = FALSE,
+            version = version + 1
+        WHERE id = $1
+        `
+	result, err := tx.ExecContext(ctx, query, id, pw.hash)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	cleanup := []string{
+		`DELETE FROM tokens WHERE user_id = $1`,
+		`DELETE FROM users_roles WHERE user_id = $1`,
+		`DELETE FROM users_permissions WHERE user_id = $1`,
+		`DELETE FROM recovery_codes WHERE user_id = $1`,
+		`DELETE FROM users_totp WHERE user_id = $1`,
+		`DELETE FROM api_keys WHERE user_id = $1`,
+		`DELETE FROM identities WHERE user_id = $1`,
+	}
+	for _, statement := range cleanup {
+		_, err = tx.ExecContext(ctx, statement, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Delete accounts that were never activated and were created more than
+// olderThan ago. Users who have reviews or reading lists are skipped, which
+// also protects anonymized accounts. Returns how many accounts were removed
+func (u UserModel) DeleteUnactivated(ctx context.Context, olderThan time.Duration) (int64, error) {
+	query := `
+        DELETE FROM users
+        WHERE activated = FALSE
+        AND deactivated_at IS NULL
+        AND created_at < now() - make_interval(secs => $1)
+        AND NOT EXISTS (SELECT 1 FROM reviews WHERE reviews.user_id = users.id)
+        AND NOT EXISTS (SELECT 1 FROM reading_lists WHERE reading_lists.created_by = users.id)
+        `
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	result, err := u.DB.ExecContext(ctx, query, olderThan.Seconds())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// Account states admins can filter the user list by
+const UserStatusActive = "active"
+const UserStatusUnactivated = "unactivated"
+const UserStatusDeactivated = "deactivated"
+const UserStatusBanned = "banned"
+
+func ValidateUserStatus(v *validator.Validator, status string) {
+	v.Check(status == "" || validator.PermittedValue(status, UserStatusActive, UserStatusUnactivated, UserStatusDeactivated, UserStatusBanned),
+		"status", "must be one of active, unactivated, deactivated or banned")
+}
+
+// GetAll lists users for the admin API. search matches the username or the
+// email address, status narrows the list to one account state
+func (u UserModel) GetAll(search string, status string, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+        SELECT COUNT(*) OVER(), id, created_at, username, email, activated,
+               deactivated_at, banned_at, ban_reason, bio, avatar_url,
+               lists_visibility, reviews_visibility, version
+        FROM users
+        WHERE ($1 = '' OR username ILIKE '%%' || $1 || '%%' OR email ILIKE '%%' || $1 || '%%')
+        AND ($2 = ''
+            OR ($2 = 'active' AND activated AND banned_at IS NULL)
+            OR ($2 = 'unactivated' AND NOT activated AND deactivated_at IS NULL)
+            OR ($2 = 'deactivated' AND deactivated_at IS NOT NULL)
+            OR ($2 = 'banned' AND banned_at IS NOT NULL))
+        ORDER BY %s %s, id ASC
+        LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := u.DB.QueryContext(ctx, query, search, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	var totalRecords int
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Username,
+			&user.Email,
+			&user.Activated,
+			&user.DeactivatedAt,
+			&user.BannedAt,
+			&user.BanReason,
+			&user.Bio,
+			&user.AvatarURL,
+			&user.Privacy.Lists,
+			&user.Privacy.Reviews,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+	return users, metadata, nil
+}
+
+// Deactivate turns an account off without deleting anything. It behaves
+// like an account that was never activated until it is reactivated.
+// Whether it had been activated is kept for Reactivate(). Deactivating it
+// again doesn't overwrite that
+func (u UserModel) Deactivate(id int64) error {
+	query := `
+        UPDATE users
+        SET activated_before_deactivation = CASE
+                WHEN deactivated_at IS NULL THEN activated
+                ELSE activated_before_deactivation
+            END,
+            activated = FALSE, deactivated_at = now(), version = version + 1
+        WHERE id = $1`
+
+	return u.execForUser(query, id)
+}
+
+// Reactivate undoes Deactivate(). An account whose email was never
+// verified goes back to waiting for activation
+func (u UserModel) Reactivate(id int64) error {
+	query := `
+        UPDATE users
+        SET activated = CASE
+                WHEN deactivated_at IS NULL THEN activated
+                ELSE activated_before_deactivation
+            END,
+            activated_before_deactivation = FALSE,
+            deactivated_at = NULL, version = version + 1
+        WHERE id = $1`
+
+	return u.execForUser(query, id)
+}
+
+// Ban blocks a user from logging in. Their reviews and lists are kept
+func (u UserModel) Ban(id int64, reason string) error {
+	query := `
+        UPDATE users
+        SET banned_at = now(), ban_reason = $2, version = version + 1
+        WHERE id = $1`
+
+	return u.execForUser(query, id, reason)
+}
+
+func (u UserModel) Unban(id int64) error {
+	query := `
+        UPDATE users
+        SET banned_at = NULL, ban_reason = '', version = version + 1
+        WHERE id = $1`
+
+	return u.execForUser(query, id)
+}
+
+// Run an UPDATE that touches a single user, returning ErrRecordNotFound if
+// there is no such user
+func (u UserModel) execForUser(query string, id int64, args ...any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := u.DB.ExecContext(ctx, query, append([]any{id}, args...)...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,240 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Supported signing algorithms
+const AlgHS256 = "HS256"
+const AlgEdDSA = "EdDSA"
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token has expired")
+	ErrUnknownKey   = errors.New("token signed with an unknown key")
+)
+
+// Claims are the fields we put in the token payload. Username and
+// Activated let the API build the current user without a database lookup
+type Claims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+	Family    string `json:"fam,omitempty"`
+	Username  string `json:"username"`
+	Activated bool   `json:"act"`
+}
+
+// Expiry returns the exp claim as a time.Time
+func (c Claims) Expiry() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// A key is either an HMAC secret or an Ed25519 key pair
+type key struct {
+	secret     []byte
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+}
+
+// KeySet signs tokens with the active key and verifies tokens signed with
+// any key in the set. Rotating keys means adding a new key, making it the
+// active one, and removing the old key once its tokens have expired. Every
+// token it signs names issuer, and only tokens that do are accepted
+type KeySet struct {
+	algorithm string
+	issuer    string
+	activeID  string
+	keys      map[string]key
+}
+
+// NewKeySet builds a key set from a space separated list of kid=base64 pairs.
+// For HS256 the value is the shared secret (at least 32 bytes). For EdDSA
+// it is the 32 byte Ed25519 seed. If activeID is empty the first key is used
+func NewKeySet(algorithm string, issuer string, spec string, activeID string) (*KeySet, error) {
+	if algorithm != AlgHS256 && algorithm != AlgEdDSA {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	if issuer == "" {
+		return nil, errors.New("an issuer must be provided")
+	}
+
+	ks := &KeySet{
+		algorithm: algorithm,
+		issuer:    issuer,
+		keys:      make(map[string]key),
+	}
+
+	for _, pair := range strings.Fields(spec) {
+		id, encoded, found := strings.Cut(pair, "=")
+		if !found || id == "" {
+			return nil, fmt.Errorf("key %q must be in the form kid=base64", pair)
+		}
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %q is not valid base64: %w", id, err)
+		}
+
+		var k key
+		switch algorithm {
+		case AlgHS256:
+			if len(raw) < 32 {
+				return nil, fmt.Errorf("key %q must be at least 32 bytes long", id)
+			}
+			k.secret = raw
+		case AlgEdDSA:
+			if len(raw) != ed25519.SeedSize {
+				return nil, fmt.Errorf("key %q must be a %d byte Ed25519 seed", id, ed25519.SeedSize)
+			}
+			k.privateKey = ed25519.NewKeyFromSeed(raw)
+			k.publicKey = k.privateKey.Public().(ed25519.PublicKey)
+		}
+		ks.keys[id] = k
+
+		if activeID == "" {
+			activeID = id
+		}
+	}
+
+	if len(ks.keys) == 0 {
+		return nil, errors.New("at least one signing key must be provided")
+	}
+	if _, ok := ks.keys[activeID]; !ok {
+		return nil, fmt.Errorf("active key %q is not in the key set", activeID)
+	}
+	ks.activeID = activeID
+
+	return ks, nil
+}
+
+// Sign encodes the claims and signs them with the active key. The issuer
+// is always the key set's own
+func (ks *KeySet) Sign(claims Claims) (string, error) {
+	claims.Issuer = ks.issuer
+
+	h := header{
+		Algorithm: ks.algorithm,
+		Type:      "JWT",
+		KeyID:     ks.activeID,
+	}
+
+	headerJSON, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encode(headerJSON) + "." + encode(claimsJSON)
+	signature := ks.signature(ks.keys[ks.activeID], []byte(signingInput))
+
+	return signingInput + "." + encode(signature), nil
+}
+
+// Verify checks the signature, issuer and expiry of a token and returns
+// its claims
+func (ks *KeySet) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	headerJSON, err := decode(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var h header
+	err = json.Unmarshal(headerJSON, &h)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	// Never let the token pick the algorithm
+	if h.Algorithm != ks.algorithm {
+		return nil, ErrInvalidToken
+	}
+
+	k, ok := ks.keys[h.KeyID]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	signature, err := decode(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	signingInput := []byte(parts[0] + "." + parts[1])
+
+	switch ks.algorithm {
+	case AlgHS256:
+		if !hmac.Equal(signature, ks.signature(k, signingInput)) {
+			return nil, ErrInvalidToken
+		}
+	case AlgEdDSA:
+		if !ed25519.Verify(k.publicKey, signingInput, signature) {
+			return nil, ErrInvalidToken
+		}
+	}
+
+	claimsJSON, err := decode(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims Claims
+	err = json.Unmarshal(claimsJSON, &claims)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if claims.Issuer != ks.issuer {
+		return nil, ErrInvalidToken
+	}
+
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+
+	return &claims, nil
+}
+
+// LooksLikeJWT reports whether a bearer token has the three dot separated
+// parts of a JWT, as opposed to one of our opaque tokens
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func (ks *KeySet) signature(k key, signingInput []byte) []byte {
+	switch ks.algorithm {
+	case AlgEdDSA:
+		return ed25519.Sign(k.privateKey, signingInput)
+	default:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(signingInput)
+		return mac.Sum(nil)
+	}
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
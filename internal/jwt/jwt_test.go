@@ -0,0 +1,274 @@
+package jwt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testIssuer = "bookclub"
+
+// A key spec entry with a key of 32 repeated bytes, which works both as an
+// HS256 secret and as an Ed25519 seed
+func testKey(id string, b byte) string {
+	return id + "=" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func newTestKeySet(t *testing.T, algorithm string, spec string, activeID string) *KeySet {
+	t.Helper()
+
+	ks, err := NewKeySet(algorithm, testIssuer, spec, activeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+func testClaims(now time.Time) Claims {
+	return Claims{
+		Subject:   "42",
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(15 * time.Minute).Unix(),
+		ID:        "token-id",
+		Family:    "family-id",
+		Username:  "someone",
+		Activated: true,
+	}
+}
+
+// Replace a token's header and sign it again with the key set's active key,
+// so that only the header is wrong
+func withHeader(t *testing.T, ks *KeySet, token string, h header) string {
+	t.Helper()
+
+	headerJSON, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	signingInput := encode(headerJSON) + "." + parts[1]
+	return signingInput + "." + encode(ks.signature(ks.keys[ks.activeID], []byte(signingInput)))
+}
+
+func TestRoundTrip(t *testing.T) {
+	now := time.Now()
+
+	for _, algorithm := range []string{AlgHS256, AlgEdDSA} {
+		t.Run(algorithm, func(t *testing.T) {
+			ks := newTestKeySet(t, algorithm, testKey("k1", 1), "")
+
+			token, err := ks.Sign(testClaims(now))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !LooksLikeJWT(token) {
+				t.Errorf("LooksLikeJWT(%q) = false", token)
+			}
+
+			claims, err := ks.Verify(token, now)
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			want := testClaims(now)
+			want.Issuer = testIssuer
+			if *claims != want {
+				t.Errorf("claims = %+v, want %+v", *claims, want)
+			}
+		})
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	now := time.Now()
+
+	for _, algorithm := range []string{AlgHS256, AlgEdDSA} {
+		t.Run(algorithm, func(t *testing.T) {
+			ks := newTestKeySet(t, algorithm, testKey("k1", 1), "")
+			token, err := ks.Sign(testClaims(now))
+			if err != nil {
+				t.Fatal(err)
+			}
+			parts := strings.Split(token, ".")
+
+			otherAlgorithm := AlgEdDSA
+			if algorithm == AlgEdDSA {
+				otherAlgorithm = AlgHS256
+			}
+			// The same key spec under the other algorithm
+			other := newTestKeySet(t, otherAlgorithm, testKey("k1", 1), "")
+			otherToken, err := other.Sign(testClaims(now))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// A different key under the same ID
+			forger := newTestKeySet(t, algorithm, testKey("k1", 2), "")
+			forged, err := forger.Sign(testClaims(now))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			noneHeader := encode([]byte(`{"alg":"none","typ":"JWT","kid":"k1"}`))
+
+			tests := []struct {
+				name  string
+				token string
+				want  error
+			}{
+				{name: "other algorithm", token: otherToken, want: ErrInvalidToken},
+				{name: "alg header changed", token: withHeader(t, ks, token, header{Algorithm: otherAlgorithm, Type: "JWT", KeyID: "k1"}), want: ErrInvalidToken},
+				{name: "alg none", token: noneHeader + "." + parts[1] + ".", want: ErrInvalidToken},
+				{name: "alg none with signature", token: noneHeader + "." + parts[1] + "." + parts[2], want: ErrInvalidToken},
+				{name: "unknown kid", token: withHeader(t, ks, token, header{Algorithm: algorithm, Type: "JWT", KeyID: "k9"}), want: ErrUnknownKey},
+				{name: "wrong key", token: forged, want: ErrInvalidToken},
+				{name: "payload changed", token: parts[0] + "." + encode([]byte(`{"sub":"1","iss":"bookclub","exp":99999999999}`)) + "." + parts[2], want: ErrInvalidToken},
+				{name: "two parts", token: parts[0] + "." + parts[1], want: ErrInvalidToken},
+				{name: "not base64", token: parts[0] + "." + parts[1] + ".!!!", want: ErrInvalidToken},
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					_, err := ks.Verify(tt.token, now)
+					if !errors.Is(err, tt.want) {
+						t.Errorf("Verify error = %v, want %v", err, tt.want)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestVerifyIssuer(t *testing.T) {
+	now := time.Now()
+
+	ks := newTestKeySet(t, AlgHS256, testKey("k1", 1), "")
+	other, err := NewKeySet(AlgHS256, "someone-else", testKey("k1", 1), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Whatever issuer the caller sets, the key set's own is signed
+	claims := testClaims(now)
+	claims.Issuer = "someone-else"
+	token, err := ks.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ks.Verify(token, now)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	// Same key, different issuer
+	token, err = other.Sign(testClaims(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ks.Verify(token, now)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Verify error = %v, want %v", err, ErrInvalidToken)
+	}
+
+	_, err = NewKeySet(AlgHS256, "", testKey("k1", 1), "")
+	if err == nil {
+		t.Error("NewKeySet accepted an empty issuer")
+	}
+}
+
+func TestVerifyExpiry(t *testing.T) {
+	now := time.Now()
+
+	ks := newTestKeySet(t, AlgHS256, testKey("k1", 1), "")
+	token, err := ks.Sign(testClaims(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want error
+	}{
+		{name: "just before", now: now.Add(15*time.Minute - time.Second), want: nil},
+		{name: "at expiry", now: now.Add(15 * time.Minute), want: ErrExpiredToken},
+		{name: "after", now: now.Add(time.Hour), want: ErrExpiredToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ks.Verify(token, tt.now)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Verify error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// Rotating adds a new key and makes it active. Tokens signed with the old
+// key keep working until it is removed
+func TestKeyRotation(t *testing.T) {
+	now := time.Now()
+
+	for _, algorithm := range []string{AlgHS256, AlgEdDSA} {
+		t.Run(algorithm, func(t *testing.T) {
+			before := newTestKeySet(t, algorithm, testKey("old", 1), "")
+			oldToken, err := before.Sign(testClaims(now))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			during := newTestKeySet(t, algorithm, testKey("old", 1)+" "+testKey("new", 2), "new")
+			newToken, err := during.Sign(testClaims(now))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(newToken, encode([]byte(`{"alg":"`+algorithm+`","typ":"JWT","kid":"new"}`))+".") {
+				t.Errorf("new token not signed with the new key: %s", newToken)
+			}
+			for name, token := range map[string]string{"old": oldToken, "new": newToken} {
+				if _, err := during.Verify(token, now); err != nil {
+					t.Errorf("Verify %s token during rotation: %v", name, err)
+				}
+			}
+
+			after := newTestKeySet(t, algorithm, testKey("new", 2), "")
+			if _, err := after.Verify(newToken, now); err != nil {
+				t.Errorf("Verify new token after rotation: %v", err)
+			}
+			if _, err := after.Verify(oldToken, now); !errors.Is(err, ErrUnknownKey) {
+				t.Errorf("Verify old token after rotation error = %v, want %v", err, ErrUnknownKey)
+			}
+		})
+	}
+}
+
+func TestNewKeySet(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm string
+		spec      string
+		activeID  string
+	}{
+		{name: "unknown algorithm", algorithm: "RS256", spec: testKey("k1", 1)},
+		{name: "none", algorithm: "none", spec: testKey("k1", 1)},
+		{name: "no keys", algorithm: AlgHS256, spec: ""},
+		{name: "no kid", algorithm: AlgHS256, spec: "=" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))},
+		{name: "not base64", algorithm: AlgHS256, spec: "k1=!!!"},
+		{name: "short secret", algorithm: AlgHS256, spec: "k1=" + base64.StdEncoding.EncodeToString([]byte("short"))},
+		{name: "wrong seed size", algorithm: AlgEdDSA, spec: "k1=" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 64))},
+		{name: "missing active key", algorithm: AlgHS256, spec: testKey("k1", 1), activeID: "k2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewKeySet(tt.algorithm, testIssuer, tt.spec, tt.activeID)
+			if err == nil {
+				t.Error("NewKeySet accepted the key set")
+			}
+		})
+	}
+}
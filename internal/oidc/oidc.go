@@ -0,0 +1,529 @@
+// Package oidc implements the client side of the OpenID Connect
+// authorization code flow with PKCE. It only supports what we need to log
+// users in: discovery, the token exchange and ID token verification
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signing algorithms we accept for ID tokens
+const AlgRS256 = "RS256"
+const AlgES256 = "ES256"
+
+var (
+	ErrInvalidToken = errors.New("invalid id token")
+	ErrExpiredToken = errors.New("id token has expired")
+	ErrUnknownKey   = errors.New("id token signed with an unknown key")
+	ErrNonce        = errors.New("id token nonce does not match")
+)
+
+// How far the clocks of the provider and this server may drift apart
+const clockSkew = time.Minute
+
+// Don't hit the JWKS endpoint more than this often when we see a key ID we
+// don't know. A provider that has rotated its keys is picked up quickly,
+// but garbage tokens can't be used to hammer the provider
+const minKeyRefresh = time.Minute
+
+// Config describes our registration with the identity provider
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+// Claims are the ID token claims we use
+type Claims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	AuthorizedParty   string   `json:"azp"`
+	ExpiresAt         int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	EmailVerified     bool     `json:"email_verified"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+}
+
+// The aud claim is either a single string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if json.Unmarshal(b, &single) == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	err := json.Unmarshal(b, &many)
+	if err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// The parts of the discovery document we need
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// Provider talks to one identity provider. The discovery document and the
+// provider's signing keys are fetched on first use and cached
+type Provider struct {
+	config Config
+	client *http.Client
+
+	// mu guards the cache. It isn't held while talking to the provider,
+	// so a slow provider only holds up the logins waiting on that fetch
+	mu          sync.Mutex
+	metadata    *metadata
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+	fetches     flight
+}
+
+// flight lets callers that need the same fetch at the same time share it
+// instead of each making their own, like golang.org/x/sync/singleflight
+type flight struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	done chan struct{}
+	err  error
+}
+
+// Run fn, or if a call with the same key is already running, wait for that
+// one and return its error instead
+func (f *flight) do(ctx context.Context, key string, fn func() error) error {
+	f.mu.Lock()
+	if c, ok := f.calls[key]; ok {
+		f.mu.Unlock()
+		select {
+		case <-c.done:
+			return c.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	c := &call{done: make(chan struct{})}
+	if f.calls == nil {
+		f.calls = make(map[string]*call)
+	}
+	f.calls[key] = c
+	f.mu.Unlock()
+
+	c.err = fn()
+
+	f.mu.Lock()
+	delete(f.calls, key)
+	f.mu.Unlock()
+	close(c.done)
+
+	return c.err
+}
+
+// NewProvider returns a provider for config. Pass the http.Client to use
+// for talking to the provider, which lets tests point it at a local server
+func NewProvider(config Config, client *http.Client) *Provider {
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+	return &Provider{
+		config: config,
+		client: client,
+	}
+}
+
+// AuthCodeURL builds the URL to send the user to. state and nonce must be
+// random and remembered until the callback. challenge is the PKCE code
+// challenge from NewPKCE()
+func (p *Provider) AuthCodeURL(ctx context.Context, state string, nonce string, challenge string) (string, error) {
+	md, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {"openid email profile"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(md.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return md.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// Exchange trades an authorization code for the raw ID token
+func (p *Provider) Exchange(ctx context.Context, code string, verifier string) (string, error) {
+	md, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	// Public clients (no secret) identify themselves in the body
+	if p.config.ClientSecret == "" {
+		form.Set("client_id", p.config.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, md.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return "", fmt.Errorf("oidc: decoding token response: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc: token endpoint returned %d: %s %s", res.StatusCode, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("oidc: token response has no id_token")
+	}
+
+	return body.IDToken, nil
+}
+
+// Verify checks an ID token's signature against the provider's published
+// keys, then its issuer, audience, expiry and nonce, and returns its claims
+func (p *Provider) Verify(ctx context.Context, rawToken string, nonce string, now time.Time) (*Claims, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	headerJSON, err := decode(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	err = json.Unmarshal(headerJSON, &header)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	key, err := p.key(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := decode(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	// The algorithm has to match the type of key, so a token can't talk
+	// us into a weaker check
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Algorithm != AlgRS256 || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) != nil {
+			return nil, ErrInvalidToken
+		}
+	case *ecdsa.PublicKey:
+		if header.Algorithm != AlgES256 || len(signature) != 64 {
+			return nil, ErrInvalidToken
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return nil, ErrInvalidToken
+		}
+	default:
+		return nil, ErrInvalidToken
+	}
+
+	claimsJSON, err := decode(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims Claims
+	err = json.Unmarshal(claimsJSON, &claims)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if strings.TrimSuffix(claims.Issuer, "/") != p.config.Issuer {
+		return nil, ErrInvalidToken
+	}
+	if !slices.Contains(claims.Audience, p.config.ClientID) {
+		return nil, ErrInvalidToken
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.config.ClientID {
+		return nil, ErrInvalidToken
+	}
+	if claims.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+	if now.Add(-clockSkew).Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+	if claims.Nonce != nonce {
+		return nil, ErrNonce
+	}
+
+	return &claims, nil
+}
+
+// NewPKCE returns a PKCE code verifier and its S256 code challenge
+func NewPKCE() (string, string, error) {
+	verifier, err := RandomString()
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, encode(sum[:]), nil
+}
+
+// RandomString returns 32 random bytes, URL-safe base64 encoded. Used for
+// state, nonce and the PKCE verifier
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return encode(b), nil
+}
+
+// Fetch the discovery document once and keep it
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	md := p.metadata
+	p.mu.Unlock()
+	if md != nil {
+		return md, nil
+	}
+
+	err := p.fetches.do(ctx, "discovery", func() error {
+		var md metadata
+		err := p.getJSON(ctx, p.config.Issuer+"/.well-known/openid-configuration", &md)
+		if err != nil {
+			return err
+		}
+		// The spec requires the issuer in the document to be the one we asked
+		if strings.TrimSuffix(md.Issuer, "/") != p.config.Issuer {
+			return fmt.Errorf("oidc: discovery issuer %q does not match %q", md.Issuer, p.config.Issuer)
+		}
+		if md.AuthorizationEndpoint == "" || md.TokenEndpoint == "" || md.JWKSURI == "" {
+			return errors.New("oidc: discovery document is missing an endpoint")
+		}
+
+		p.mu.Lock()
+		p.metadata = &md
+		p.mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.metadata, nil
+}
+
+// Find the signing key with the given ID, refetching the JWKS if we don't
+// know it yet
+func (p *Provider) key(ctx context.Context, id string) (crypto.PublicKey, error) {
+	md, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	key, ok := p.keys[id]
+	fetched := p.keysFetched
+	p.mu.Unlock()
+
+	if ok {
+		return key, nil
+	}
+	if time.Since(fetched) < minKeyRefresh {
+		return nil, ErrUnknownKey
+	}
+
+	err = p.fetches.do(ctx, "jwks", func() error {
+		// Someone else's refresh may have finished since we looked
+		p.mu.Lock()
+		recent := time.Since(p.keysFetched) < minKeyRefresh
+		p.mu.Unlock()
+		if recent {
+			return nil
+		}
+
+		var jwks struct {
+			Keys []jsonWebKey `json:"keys"`
+		}
+		err := p.getJSON(ctx, md.JWKSURI, &jwks)
+		if err != nil {
+			return err
+		}
+
+		keys := make(map[string]crypto.PublicKey)
+		for _, jwk := range jwks.Keys {
+			if jwk.Use != "" && jwk.Use != "sig" {
+				continue
+			}
+			publicKey, err := jwk.publicKey()
+			if err != nil {
+				// Skip key types we don't understand
+				continue
+			}
+			keys[jwk.KeyID] = publicKey
+		}
+
+		p.mu.Lock()
+		p.keys = keys
+		p.keysFetched = time.Now()
+		p.mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	key, ok = p.keys[id]
+	p.mu.Unlock()
+
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 {
+			return nil, errors.New("oidc: invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		if jwk.Curve != "P-256" {
+			return nil, fmt.Errorf("oidc: unsupported curve %q", jwk.Curve)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("oidc: EC key is not on the curve")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("oidc: unsupported key type %q", jwk.KeyType)
+	}
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s returned %d", url, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(dst)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
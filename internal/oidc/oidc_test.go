@@ -0,0 +1,435 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testClientID = "bookclub"
+const testNonce = "the-nonce"
+
+// A stand-in identity provider serving discovery, the JWKS and the token
+// endpoint. The token endpoint hands back whatever idToken is set to
+type testIssuer struct {
+	server   *httptest.Server
+	rsaKey   *rsa.PrivateKey
+	ecKey    *ecdsa.PrivateKey
+	provider *Provider
+
+	mu         sync.Mutex
+	jwks       []jsonWebKey
+	jwksHits   int
+	jwksGate   chan struct{}
+	idToken    string
+	tokenForms []map[string]string
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ti := &testIssuer{rsaKey: rsaKey, ecKey: ecKey}
+	ti.jwks = []jsonWebKey{rsaJWK("rsa-1", &rsaKey.PublicKey), ecJWK("ec-1", &ecKey.PublicKey)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(metadata{
+			Issuer:                ti.server.URL,
+			AuthorizationEndpoint: ti.server.URL + "/authorize",
+			TokenEndpoint:         ti.server.URL + "/token",
+			JWKSURI:               ti.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		ti.mu.Lock()
+		ti.jwksHits++
+		gate := ti.jwksGate
+		ti.mu.Unlock()
+
+		// Tests hold the JWKS back to play a slow provider
+		if gate != nil {
+			<-gate
+		}
+
+		ti.mu.Lock()
+		defer ti.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"keys": ti.jwks})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		ti.mu.Lock()
+		defer ti.mu.Unlock()
+		r.ParseForm()
+		form := make(map[string]string)
+		for key := range r.PostForm {
+			form[key] = r.PostForm.Get(key)
+		}
+		ti.tokenForms = append(ti.tokenForms, form)
+		json.NewEncoder(w).Encode(map[string]string{"id_token": ti.idToken})
+	})
+
+	ti.server = httptest.NewServer(mux)
+	t.Cleanup(ti.server.Close)
+
+	ti.provider = NewProvider(Config{
+		Issuer:      ti.server.URL,
+		ClientID:    testClientID,
+		RedirectURL: "https://bookclub.example/callback",
+	}, ti.server.Client())
+
+	return ti
+}
+
+// Claims that pass every check. Tests change them to break one
+func (ti *testIssuer) claims() map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":            ti.server.URL,
+		"sub":            "user-1",
+		"aud":            testClientID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          testNonce,
+		"email":          "someone@example.com",
+		"email_verified": true,
+	}
+}
+
+func (ti *testIssuer) jwksFetches() int {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return ti.jwksHits
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) jsonWebKey {
+	return jsonWebKey{
+		KeyType: "RSA",
+		KeyID:   kid,
+		Use:     "sig",
+		N:       encode(key.N.Bytes()),
+		E:       encode(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) jsonWebKey {
+	return jsonWebKey{
+		KeyType: "EC",
+		KeyID:   kid,
+		Use:     "sig",
+		Curve:   "P-256",
+		X:       encode(key.X.FillBytes(make([]byte, 32))),
+		Y:       encode(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+// Sign claims as a JWT. alg goes in the header as given, so it can
+// disagree with the type of key
+func sign(t *testing.T, alg string, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signingInput := encode(header) + "." + encode(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+
+	return signingInput + "." + encode(signature)
+}
+
+func TestExchangeAndVerify(t *testing.T) {
+	ti := newTestIssuer(t)
+	ctx := context.Background()
+
+	authURL, err := ti.provider.AuthCodeURL(ctx, "the-state", testNonce, "the-challenge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL, ti.server.URL+"/authorize?") || !strings.Contains(authURL, "code_challenge=the-challenge") {
+		t.Errorf("AuthCodeURL = %q", authURL)
+	}
+
+	ti.idToken = sign(t, AlgRS256, "rsa-1", ti.rsaKey, ti.claims())
+
+	rawToken, err := ti.provider.Exchange(ctx, "the-code", "the-verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := ti.tokenForms[0]
+	if form["code"] != "the-code" || form["code_verifier"] != "the-verifier" || form["client_id"] != testClientID {
+		t.Errorf("token request form = %v", form)
+	}
+
+	claims, err := ti.provider.Verify(ctx, rawToken, testNonce, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "user-1" || claims.Email != "someone@example.com" || !claims.EmailVerified {
+		t.Errorf("claims = %+v", claims)
+	}
+
+	// ES256 works too
+	_, err = ti.provider.Verify(ctx, sign(t, AlgES256, "ec-1", ti.ecKey, ti.claims()), testNonce, time.Now())
+	if err != nil {
+		t.Errorf("ES256 token: %v", err)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	ti := newTestIssuer(t)
+
+	tests := []struct {
+		name   string
+		alg    string
+		kid    string
+		key    crypto.Signer
+		change func(claims map[string]any)
+		want   error
+	}{
+		{
+			name:   "wrong issuer",
+			change: func(claims map[string]any) { claims["iss"] = "https://evil.example" },
+			want:   ErrInvalidToken,
+		},
+		{
+			name:   "wrong audience",
+			change: func(claims map[string]any) { claims["aud"] = "someone-else" },
+			want:   ErrInvalidToken,
+		},
+		{
+			name:   "several audiences without azp",
+			change: func(claims map[string]any) { claims["aud"] = []string{testClientID, "someone-else"} },
+			want:   ErrInvalidToken,
+		},
+		{
+			name: "several audiences with someone else as azp",
+			change: func(claims map[string]any) {
+				claims["aud"] = []string{testClientID, "someone-else"}
+				claims["azp"] = "someone-else"
+			},
+			want: ErrInvalidToken,
+		},
+		{
+			name:   "expired",
+			change: func(claims map[string]any) { claims["exp"] = time.Now().Add(-2 * clockSkew).Unix() },
+			want:   ErrExpiredToken,
+		},
+		{
+			name:   "bad nonce",
+			change: func(claims map[string]any) { claims["nonce"] = "another-nonce" },
+			want:   ErrNonce,
+		},
+		{
+			name: "RSA key with ES256",
+			alg:  AlgES256,
+			want: ErrInvalidToken,
+		},
+		{
+			name: "EC key with RS256",
+			alg:  AlgRS256,
+			kid:  "ec-1",
+			key:  ti.ecKey,
+			want: ErrInvalidToken,
+		},
+		{
+			name: "alg none",
+			alg:  "none",
+			want: ErrInvalidToken,
+		},
+		{
+			name: "signed with another key",
+			key:  mustRSAKey(t),
+			want: ErrInvalidToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alg, kid, key := tt.alg, tt.kid, tt.key
+			if alg == "" {
+				alg = AlgRS256
+			}
+			if kid == "" {
+				kid = "rsa-1"
+			}
+			if key == nil {
+				key = ti.rsaKey
+			}
+			claims := ti.claims()
+			if tt.change != nil {
+				tt.change(claims)
+			}
+
+			_, err := ti.provider.Verify(context.Background(), sign(t, alg, kid, key, claims), testNonce, time.Now())
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyAcceptsAzpWithSeveralAudiences(t *testing.T) {
+	ti := newTestIssuer(t)
+
+	claims := ti.claims()
+	claims["aud"] = []string{"someone-else", testClientID}
+	claims["azp"] = testClientID
+
+	_, err := ti.provider.Verify(context.Background(), sign(t, AlgRS256, "rsa-1", ti.rsaKey, claims), testNonce, time.Now())
+	if err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+}
+
+// Tokens with a key ID we haven't seen make us fetch the JWKS again, but
+// no more than once a minute
+func TestUnknownKeyRefetchIsThrottled(t *testing.T) {
+	ti := newTestIssuer(t)
+	ctx := context.Background()
+
+	_, err := ti.provider.Verify(ctx, sign(t, AlgRS256, "rsa-1", ti.rsaKey, ti.claims()), testNonce, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ti.jwksFetches(); got != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1", got)
+	}
+
+	// The provider rotates in a new key
+	rotated := mustRSAKey(t)
+	ti.mu.Lock()
+	ti.jwks = append(ti.jwks, rsaJWK("rsa-2", &rotated.PublicKey))
+	ti.mu.Unlock()
+
+	for range 5 {
+		_, err = ti.provider.Verify(ctx, sign(t, AlgRS256, "rsa-2", rotated, ti.claims()), testNonce, time.Now())
+		if !errors.Is(err, ErrUnknownKey) {
+			t.Fatalf("Verify() error = %v, want %v", err, ErrUnknownKey)
+		}
+	}
+	if got := ti.jwksFetches(); got != 1 {
+		t.Fatalf("JWKS fetched %d times within a minute, want 1", got)
+	}
+
+	// Once the minute is up the new key is picked up
+	ti.provider.mu.Lock()
+	ti.provider.keysFetched = time.Now().Add(-minKeyRefresh)
+	ti.provider.mu.Unlock()
+
+	_, err = ti.provider.Verify(ctx, sign(t, AlgRS256, "rsa-2", rotated, ti.claims()), testNonce, time.Now())
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if got := ti.jwksFetches(); got != 2 {
+		t.Fatalf("JWKS fetched %d times, want 2", got)
+	}
+}
+
+// While the JWKS is being fetched for a new key, logins with keys we
+// already have carry on, and everyone after the new key shares the one fetch
+func TestSlowKeyRefetchDoesNotBlock(t *testing.T) {
+	ti := newTestIssuer(t)
+	ctx := context.Background()
+
+	_, err := ti.provider.Verify(ctx, sign(t, AlgRS256, "rsa-1", ti.rsaKey, ti.claims()), testNonce, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := mustRSAKey(t)
+	gate := make(chan struct{})
+	ti.mu.Lock()
+	ti.jwks = append(ti.jwks, rsaJWK("rsa-2", &rotated.PublicKey))
+	ti.jwksGate = gate
+	ti.mu.Unlock()
+
+	ti.provider.mu.Lock()
+	ti.provider.keysFetched = time.Now().Add(-minKeyRefresh)
+	ti.provider.mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ti.provider.Verify(ctx, sign(t, AlgRS256, "rsa-2", rotated, ti.claims()), testNonce, time.Now())
+			errs <- err
+		}()
+	}
+
+	// Wait for the fetch to reach the provider
+	for ti.jwksFetches() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	quick, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	_, err = ti.provider.Verify(quick, sign(t, AlgRS256, "rsa-1", ti.rsaKey, ti.claims()), testNonce, time.Now())
+	if err != nil {
+		t.Fatalf("Verify() with a known key during a refetch error = %v", err)
+	}
+
+	close(gate)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Verify() with the new key error = %v", err)
+		}
+	}
+	if got := ti.jwksFetches(); got != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", got)
+	}
+}
+
+func mustRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
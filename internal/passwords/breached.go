@@ -0,0 +1,82 @@
+package passwords
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Breached checks passwords against a local copy of a breached password
+// list split into k-anonymity range files, the format served by the Have I
+// Been Pwned range API and produced by its downloader. The SHA-1 of the
+// password is split into a five character prefix, which names the file,
+// and a suffix. Each file holds one SUFFIX:COUNT line per hash. Only the
+// one file for the prefix is read, so the list never has to fit in memory
+type Breached struct {
+	dir string
+}
+
+// NewBreached returns a checker reading range files from dir
+func NewBreached(dir string) (*Breached, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("breached password list %q is not a directory", dir)
+	}
+	return &Breached{dir: dir}, nil
+}
+
+func (b *Breached) Check(password string, account Account) (string, error) {
+	breached, err := b.Contains(password)
+	if err != nil {
+		return "", err
+	}
+	if breached {
+		return "has appeared in a data breach and can't be used, please choose another", nil
+	}
+	return "", nil
+}
+
+// Contains reports whether the password is on the list
+func (b *Breached) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	file, err := b.open(prefix)
+	if err != nil {
+		// No file means no breached password starts with this prefix
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), ":")
+		if strings.EqualFold(strings.TrimSpace(line), suffix) {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+// The downloader names files ABCDE.txt, a plain mirror of the API uses ABCDE
+func (b *Breached) open(prefix string) (*os.File, error) {
+	file, err := os.Open(filepath.Join(b.dir, prefix+".txt"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return os.Open(filepath.Join(b.dir, prefix))
+	}
+	return file, err
+}
@@ -0,0 +1,100 @@
+// Package passwords decides whether a new password is good enough. A
+// Policy is a list of checkers, each of which can reject the password
+package passwords
+
+import (
+	"strings"
+
+	"github.com/martinezmoises/Test3/internal/validator"
+)
+
+// Account holds what we know about the person choosing the password.
+// Passwords built from these are the first thing an attacker tries
+type Account struct {
+	Username string
+	Email    string
+}
+
+// A Checker looks at a password and returns a message describing what is
+// wrong with it, or an empty string if it is acceptable. The error is for
+// failures of the checker itself, like an unreadable breach list
+type Checker interface {
+	Check(password string, account Account) (string, error)
+}
+
+// CheckerFunc lets an ordinary function be used as a Checker
+type CheckerFunc func(password string, account Account) (string, error)
+
+func (f CheckerFunc) Check(password string, account Account) (string, error) {
+	return f(password, account)
+}
+
+// Policy runs its checkers in order and reports the first problem found
+type Policy struct {
+	checkers []Checker
+}
+
+func NewPolicy(checkers ...Checker) *Policy {
+	return &Policy{checkers: checkers}
+}
+
+// Validate adds an error under key if the password breaks the policy.
+// Call it after the basic length checks have passed
+func (p *Policy) Validate(v *validator.Validator, key string, password string, account Account) error {
+	for _, checker := range p.checkers {
+		message, err := checker.Check(password, account)
+		if err != nil {
+			return err
+		}
+		if message != "" {
+			v.AddError(key, message)
+			return nil
+		}
+	}
+	return nil
+}
+
+// MinStrength rejects passwords whose estimated strength score (0-4) is
+// below score. The account details count as known words
+func MinStrength(score int) Checker {
+	return CheckerFunc(func(password string, account Account) (string, error) {
+		if Estimate(password, accountInputs(account)...).Score < score {
+			return "is too easy to guess, try a longer password or an uncommon phrase", nil
+		}
+		return "", nil
+	})
+}
+
+// NoPersonalInfo rejects passwords that contain the username or the email
+// address (or the part of it before the @)
+func NoPersonalInfo() Checker {
+	return CheckerFunc(func(password string, account Account) (string, error) {
+		lower := strings.ToLower(password)
+
+		username := strings.ToLower(account.Username)
+		if len(username) >= 3 && strings.Contains(lower, username) {
+			return "must not contain your username", nil
+		}
+
+		email := strings.ToLower(account.Email)
+		local, _, _ := strings.Cut(email, "@")
+		if (email != "" && strings.Contains(lower, email)) || (len(local) >= 3 && strings.Contains(lower, local)) {
+			return "must not contain your email address", nil
+		}
+
+		return "", nil
+	})
+}
+
+// The words in the account details, for the strength estimate
+func accountInputs(account Account) []string {
+	inputs := strings.FieldsFunc(strings.ToLower(account.Username), func(r rune) bool {
+		return r == ' ' || r == '.' || r == '_' || r == '-'
+	})
+	local, domain, _ := strings.Cut(strings.ToLower(account.Email), "@")
+	inputs = append(inputs, local)
+	if name, _, found := strings.Cut(domain, "."); found {
+		inputs = append(inputs, name)
+	}
+	return inputs
+}
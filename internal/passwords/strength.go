@@ -0,0 +1,419 @@
+package passwords
+
+import (
+	_ "embed"
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// common.txt holds common passwords and words, most common first. A
+// word's line number is how many guesses it takes to reach it
+//
+//go:embed common.txt
+var commonList string
+
+var ranked = func() map[string]int {
+	words := strings.Fields(commonList)
+	m := make(map[string]int, len(words))
+	for i, word := range words {
+		if _, exists := m[word]; !exists {
+			m[word] = i + 1
+		}
+	}
+	return m
+}()
+
+// The longest word in the common list. Longer substrings can't be in it
+var longestRanked = func() int {
+	longest := 0
+	for word := range ranked {
+		longest = max(longest, len([]rune(word)))
+	}
+	return longest
+}()
+
+// Every prefix of a word in the common list, so undoing substitutions can
+// give up on a spelling as soon as it can't lead to a word
+var rankedPrefixes = prefixes(ranked)
+
+func prefixes(words map[string]int) map[string]bool {
+	m := make(map[string]bool)
+	for word := range words {
+		runes := []rune(word)
+		for i := 1; i <= len(runes); i++ {
+			m[string(runes[:i])] = true
+		}
+	}
+	return m
+}
+
+// Only this many runes of a password are looked at. The search for
+// patterns grows faster than the length, and this is far from cheap to
+// guess already, so the rest can't make a weak start acceptable
+const maxEstimateRunes = 64
+
+// Each character not covered by a pattern costs this many guesses
+const bruteforceCardinality = 10
+
+// The fewest guesses a pattern inside a longer password can be worth
+const minSubmatchGuesses = 50
+
+// Rows of the keyboard. Walking along them is a favourite pattern
+var keyboardRows = []string{"`1234567890-=", "qwertyuiop[]", "asdfghjkl;'", "zxcvbnm,./"}
+
+var yearRX = regexp.MustCompile(`(19|20)\d\d`)
+
+// Common character substitutions, undone before the dictionary lookup
+var leet = map[rune][]rune{
+	'4': {'a'}, '@': {'a'}, '8': {'b'}, '(': {'c'}, '3': {'e'}, '6': {'g'}, '9': {'g'},
+	'1': {'i', 'l'}, '!': {'i'}, '|': {'i', 'l'}, '0': {'o'}, '$': {'s'}, '5': {'s'},
+	'7': {'t'}, '+': {'t'}, '2': {'z'},
+}
+
+// Strength is an estimate of how many guesses an attacker who knows the
+// usual tricks needs, and the same number as a 0-4 score
+type Strength struct {
+	Guesses float64
+	Score   int
+}
+
+type match struct {
+	i, j    int // first and last rune of the match
+	guesses float64
+}
+
+// Estimate works out the strength of a password the way zxcvbn does: find
+// every dictionary word, sequence, keyboard walk, repeat and year in it,
+// then pick the cheapest way to cover the whole password with them. Parts
+// that don't match any pattern are counted as brute force. userInputs are
+// words like the username that an attacker would try first. Only the
+// first maxEstimateRunes runes count
+func Estimate(password string, userInputs ...string) Strength {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return Strength{Guesses: 1, Score: 0}
+	}
+	if len(runes) > maxEstimateRunes {
+		runes = runes[:maxEstimateRunes]
+	}
+
+	inputs := make(map[string]int)
+	for i, input := range userInputs {
+		input = strings.ToLower(input)
+		if len([]rune(input)) >= 3 {
+			inputs[input] = i + 1
+		}
+	}
+
+	guesses := estimate(runes, inputs, true)
+	return Strength{Guesses: guesses, Score: score(guesses)}
+}
+
+// The fewest guesses for runes. Repeats are only looked for at the top
+// level: the block of a repeat is estimated without them, which keeps the
+// work from multiplying
+func estimate(runes []rune, inputs map[string]int, withRepeats bool) float64 {
+	matches := dictionaryMatches(runes, inputs)
+	matches = append(matches, sequenceMatches(runes)...)
+	matches = append(matches, keyboardMatches(runes)...)
+	if withRepeats {
+		matches = append(matches, repeatMatches(runes, inputs)...)
+	}
+	matches = append(matches, yearMatches(string(runes))...)
+
+	n := len(runes)
+	for k := range matches {
+		if matches[k].i > 0 || matches[k].j < n-1 {
+			matches[k].guesses = math.Max(matches[k].guesses, minSubmatchGuesses)
+		}
+	}
+
+	// best[j] is the fewest guesses needed for the first j runes
+	best := make([]float64, n+1)
+	best[0] = 1
+	for j := 1; j <= n; j++ {
+		best[j] = best[j-1] * bruteforceCardinality
+		for _, m := range matches {
+			if m.j == j-1 {
+				best[j] = math.Min(best[j], best[m.i]*m.guesses)
+			}
+		}
+	}
+
+	return best[n]
+}
+
+func score(guesses float64) int {
+	switch {
+	case guesses < 1e3:
+		return 0
+	case guesses < 1e6:
+		return 1
+	case guesses < 1e8:
+		return 2
+	case guesses < 1e10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// Find words from the common list and the user inputs, forwards and
+// backwards, with any leet substitutions undone
+func dictionaryMatches(runes []rune, inputs map[string]int) []match {
+	var matches []match
+
+	longest := longestRanked
+	for input := range inputs {
+		longest = max(longest, len([]rune(input)))
+	}
+	inputPrefixes := prefixes(inputs)
+	isPrefix := func(s string) bool {
+		return rankedPrefixes[s] || inputPrefixes[s]
+	}
+
+	for i := range runes {
+		for j := i + 2; j < len(runes) && j-i < longest; j++ {
+			token := runes[i : j+1]
+			lower := toLower(token)
+			caseGuesses := uppercaseVariations(token)
+
+			for _, reversed := range []bool{false, true} {
+				word := lower
+				factor := caseGuesses
+				if reversed {
+					word = reverse(lower)
+					factor *= 2
+				}
+
+				for _, candidate := range unleet(word, isPrefix) {
+					rank, ok := lookup(candidate.word, inputs)
+					if !ok {
+						continue
+					}
+					guesses := float64(rank) * factor * candidate.factor
+					matches = append(matches, match{i: i, j: j, guesses: guesses})
+				}
+			}
+		}
+	}
+
+	return matches
+}
+
+func lookup(word string, inputs map[string]int) (int, bool) {
+	if rank, ok := inputs[word]; ok {
+		return rank, true
+	}
+	rank, ok := ranked[word]
+	return rank, ok
+}
+
+type unleeted struct {
+	word   string
+	factor float64
+}
+
+// Every way of undoing the substitutions in word that could still spell
+// a known word, with the extra guesses an attacker spends on trying
+// substitutions
+func unleet(word []rune, isPrefix func(string) bool) []unleeted {
+	results := []unleeted{{word: "", factor: 1}}
+	for _, r := range word {
+		options, ok := leet[r]
+		var next []unleeted
+		add := func(partial unleeted, r rune, factor float64) {
+			candidate := partial.word + string(r)
+			if isPrefix(candidate) {
+				next = append(next, unleeted{word: candidate, factor: partial.factor * factor})
+			}
+		}
+		for _, partial := range results {
+			add(partial, r, 1)
+			if ok {
+				for _, option := range options {
+					add(partial, option, 2)
+				}
+			}
+		}
+		if len(next) == 0 {
+			return nil
+		}
+		// Passwords made entirely of symbols could blow up here
+		if len(next) > 64 {
+			next = next[:64]
+		}
+		results = next
+	}
+	return results
+}
+
+// Capitalising the first letter or the whole word barely helps. Random
+// capitals are worth more
+func uppercaseVariations(token []rune) float64 {
+	upper, lower := 0, 0
+	for _, r := range token {
+		switch {
+		case unicode.IsUpper(r):
+			upper++
+		case unicode.IsLower(r):
+			lower++
+		}
+	}
+
+	if upper == 0 {
+		return 1
+	}
+	if lower == 0 || (upper == 1 && unicode.IsUpper(token[0])) || (upper == 1 && unicode.IsUpper(token[len(token)-1])) {
+		return 2
+	}
+
+	variations := 0.0
+	for k := 1; k <= min(upper, lower); k++ {
+		variations += binomial(upper+lower, k)
+	}
+	return variations
+}
+
+// Runs like abc, 6543 or aceg
+func sequenceMatches(runes []rune) []match {
+	var matches []match
+
+	for i := 0; i < len(runes)-2; i++ {
+		delta := runes[i+1] - runes[i]
+		if delta == 0 || delta > 2 || delta < -2 {
+			continue
+		}
+
+		j := i + 1
+		for j+1 < len(runes) && runes[j+1]-runes[j] == delta {
+			j++
+		}
+		if j-i < 2 {
+			continue
+		}
+
+		base := 26.0
+		switch {
+		case strings.ContainsRune("aAzZ019", runes[i]):
+			base = 4
+		case unicode.IsDigit(runes[i]):
+			base = 10
+		}
+		if delta < 0 {
+			base *= 2
+		}
+		for end := i + 2; end <= j; end++ {
+			matches = append(matches, match{i: i, j: end, guesses: base * float64(end-i+1)})
+		}
+	}
+
+	return matches
+}
+
+// Walks along a row of the keyboard, in either direction
+func keyboardMatches(runes []rune) []match {
+	var matches []match
+	lower := toLower(runes)
+
+	longest := 0
+	for _, row := range keyboardRows {
+		longest = max(longest, len(row))
+	}
+
+	for i := range lower {
+		for j := i + 3; j < len(lower) && j-i < longest; j++ {
+			token := string(lower[i : j+1])
+			for _, row := range keyboardRows {
+				if strings.Contains(row, token) || strings.Contains(string(reverse([]rune(row))), token) {
+					matches = append(matches, match{i: i, j: j, guesses: 10 * float64(len(row)) * float64(j-i+1)})
+					break
+				}
+			}
+		}
+	}
+
+	return matches
+}
+
+// The same character or block over and over, like aaaa or abcabcabc. A
+// repeat costs the guesses for the block times the number of copies
+func repeatMatches(runes []rune, inputs map[string]int) []match {
+	var matches []match
+
+	// Overlapping repeats like aaaaaa share their blocks
+	blockEstimates := make(map[string]float64)
+
+	for i := range runes {
+		for size := 1; i+2*size <= len(runes); size++ {
+			block := runes[i : i+size]
+			copies := 1
+			for i+(copies+1)*size <= len(runes) && string(runes[i+copies*size:i+(copies+1)*size]) == string(block) {
+				copies++
+			}
+			if copies < 2 || (size == 1 && copies < 3) {
+				continue
+			}
+
+			var blockGuesses float64
+			if size == 1 {
+				blockGuesses = bruteforceCardinality
+			} else {
+				var ok bool
+				blockGuesses, ok = blockEstimates[string(block)]
+				if !ok {
+					blockGuesses = estimate(block, inputs, false)
+					blockEstimates[string(block)] = blockGuesses
+				}
+			}
+			for c := 2; c <= copies; c++ {
+				if size == 1 && c < 3 {
+					continue
+				}
+				matches = append(matches, match{i: i, j: i + c*size - 1, guesses: blockGuesses * float64(c)})
+			}
+		}
+	}
+
+	return matches
+}
+
+// Recent years are one of the first things added to a word
+func yearMatches(password string) []match {
+	var matches []match
+
+	for _, loc := range yearRX.FindAllStringIndex(password, -1) {
+		// loc is in bytes, the matches are in runes
+		i := len([]rune(password[:loc[0]]))
+		matches = append(matches, match{i: i, j: i + 3, guesses: 120})
+	}
+
+	return matches
+}
+
+// Lowercase rune by rune so match offsets stay the same
+func toLower(runes []rune) []rune {
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+	return lower
+}
+
+func reverse(runes []rune) []rune {
+	reversed := make([]rune, len(runes))
+	for i, r := range runes {
+		reversed[len(runes)-1-i] = r
+	}
+	return reversed
+}
+
+func binomial(n, k int) float64 {
+	result := 1.0
+	for i := 1; i <= k; i++ {
+		result = result * float64(n-k+i) / float64(i)
+	}
+	return result
+}
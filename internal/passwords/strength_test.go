@@ -0,0 +1,71 @@
+package passwords
+
+import (
+	"math/rand/v2"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Passwords that used to make the estimate take seconds or never finish.
+// It runs on every registration, before anyone has logged in
+func worstCasePasswords() map[string]string {
+	rng := rand.New(rand.NewPCG(1, 2))
+	random := make([]byte, 500)
+	for i := range random {
+		random[i] = byte(' ' + rng.IntN(95))
+	}
+
+	return map[string]string{
+		"repeat":      strings.Repeat("a", 500),
+		"block":       strings.Repeat("ab1", 170),
+		"random":      string(random),
+		"leet":        strings.Repeat("4@8(3!|0$7", 50),
+		"max_allowed": strings.Repeat("a", 72),
+	}
+}
+
+func TestEstimateWorstCaseIsBounded(t *testing.T) {
+	for name, password := range worstCasePasswords() {
+		t.Run(name, func(t *testing.T) {
+			start := time.Now()
+			Estimate(password, "someone", "example")
+			// Far more than it should take, but far less than it used to
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("Estimate took %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	tests := []struct {
+		password string
+		maxScore int
+		minScore int
+	}{
+		{password: "password", maxScore: 0},
+		{password: "aaaaaaaaaaaa", maxScore: 1},
+		{password: "qwertyuiop", maxScore: 1},
+		{password: "p4ssw0rd", maxScore: 1},
+		{password: "someone2024", maxScore: 2},
+		{password: "correct horse battery staple jumps", minScore: 4, maxScore: 4},
+	}
+
+	for _, tt := range tests {
+		got := Estimate(tt.password, "someone").Score
+		if got < tt.minScore || got > tt.maxScore {
+			t.Errorf("Estimate(%q) score = %d, want %d to %d", tt.password, got, tt.minScore, tt.maxScore)
+		}
+	}
+}
+
+func BenchmarkEstimateWorstCase(b *testing.B) {
+	for name, password := range worstCasePasswords() {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				Estimate(password, "someone", "example")
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+// Package scheduler runs named jobs at regular intervals inside the API
+// process. Each run takes a Postgres advisory lock named after the job, so
+// when several instances of the API share a database a job never runs in
+// more than one of them at the same time
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// A Job is something to run every Interval. Each wait is stretched by a
+// random amount up to Jitter so that instances started together don't all
+// hit the database at once. A run is cancelled after Timeout, if set
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Jitter   time.Duration
+	Timeout  time.Duration
+	Run      func(ctx context.Context, logger *slog.Logger) error
+}
+
+type Scheduler struct {
+	db     *sql.DB
+	logger *slog.Logger
+	jobs   []Job
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func New(db *sql.DB, logger *slog.Logger) *Scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Scheduler{
+		db:     db,
+		logger: logger,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Add registers a job. Jobs have to be added before Start() is called
+func (s *Scheduler) Add(job Job) error {
+	if job.Name == "" || job.Run == nil {
+		return errors.New("scheduler: a job needs a name and a run function")
+	}
+	if job.Interval <= 0 {
+		return fmt.Errorf("scheduler: job %q needs a positive interval", job.Name)
+	}
+	for _, existing := range s.jobs {
+		if existing.Name == job.Name {
+			return fmt.Errorf("scheduler: duplicate job %q", job.Name)
+		}
+	}
+
+	s.jobs = append(s.jobs, job)
+	return nil
+}
+
+// Start runs every job in its own goroutine. The first run of each job
+// happens after a random delay of up to its jitter
+func (s *Scheduler) Start() {
+	for _, job := range s.jobs {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.loop(job)
+		}()
+
+		s.logger.Info("scheduled job", "job", job.Name, "interval", job.Interval.String())
+	}
+}
+
+// Stop cancels any running jobs and waits for them to return, or for ctx
+// to be done
+func (s *Scheduler) Stop(ctx context.Context) error {
+	s.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Scheduler) loop(job Job) {
+	wait := jitter(job.Jitter)
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		s.runOnce(job)
+		wait = job.Interval + jitter(job.Jitter)
+	}
+}
+
+// Run a job once if no other instance is running it right now
+func (s *Scheduler) runOnce(job Job) {
+	logger := s.logger.With("job", job.Name)
+
+	ctx := s.ctx
+	if job.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, job.Timeout)
+		defer cancel()
+	}
+
+	// Advisory locks belong to a database session, so the lock and unlock
+	// have to go through the same connection
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		logger.Error("failed to get a database connection for job", "error", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	key := lockKey(job.Name)
+
+	var locked bool
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&locked)
+	if err != nil {
+		logger.Error("failed to lock job", "error", err.Error())
+		return
+	}
+	if !locked {
+		logger.Debug("job is already running elsewhere, skipping")
+		return
+	}
+	defer func() {
+		// Unlock even if the job's context has run out
+		_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key)
+		if err != nil {
+			logger.Error("failed to unlock job", "error", err.Error())
+		}
+	}()
+
+	start := time.Now()
+	err = s.run(ctx, job, logger)
+	duration := time.Since(start)
+
+	if err != nil {
+		logger.Error("job failed", "duration", duration.String(), "error", err.Error())
+		return
+	}
+	logger.Info("job finished", "duration", duration.String())
+}
+
+// Call the job's function, turning a panic into an error so that one bad
+// run doesn't take the whole API down
+func (s *Scheduler) run(ctx context.Context, job Job, logger *slog.Logger) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return job.Run(ctx, logger)
+}
+
+// Advisory locks are keyed by a 64 bit integer, so hash the job name
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("scheduler:" + name))
+	return int64(h.Sum64())
+}
+
+func jitter(limit time.Duration) time.Duration {
+	if limit <= 0 {
+		return 0
+	}
+	return rand.N(limit)
+}
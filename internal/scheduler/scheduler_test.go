@@ -0,0 +1,336 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A stand-in for Postgres that only knows pg_try_advisory_lock() and
+// pg_advisory_unlock(), which is all the scheduler asks of the database
+type fakeLocks struct {
+	mu     sync.Mutex
+	locked map[int64]bool
+}
+
+func (f *fakeLocks) Connect(context.Context) (driver.Conn, error) { return &fakeConn{locks: f}, nil }
+func (f *fakeLocks) Driver() driver.Driver                        { return nil }
+
+func (f *fakeLocks) isLocked(key int64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.locked[key]
+}
+
+type fakeConn struct {
+	locks *fakeLocks
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{locks: c.locks, query: query}, nil
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+type fakeStmt struct {
+	locks *fakeLocks
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return 1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if !strings.Contains(s.query, "pg_advisory_unlock") {
+		return nil, errors.New("unexpected exec: " + s.query)
+	}
+	s.locks.mu.Lock()
+	defer s.locks.mu.Unlock()
+	delete(s.locks.locked, args[0].(int64))
+	return driver.RowsAffected(0), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if !strings.Contains(s.query, "pg_try_advisory_lock") {
+		return nil, errors.New("unexpected query: " + s.query)
+	}
+	s.locks.mu.Lock()
+	defer s.locks.mu.Unlock()
+	key := args[0].(int64)
+	if s.locks.locked[key] {
+		return &boolRows{value: false}, nil
+	}
+	s.locks.locked[key] = true
+	return &boolRows{value: true}, nil
+}
+
+type boolRows struct {
+	value bool
+	done  bool
+}
+
+func (r *boolRows) Columns() []string { return []string{"locked"} }
+func (r *boolRows) Close() error      { return nil }
+
+func (r *boolRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	dest[0] = r.value
+	r.done = true
+	return nil
+}
+
+func newTestScheduler(t *testing.T) (*Scheduler, *fakeLocks) {
+	t.Helper()
+
+	locks := &fakeLocks{locked: make(map[int64]bool)}
+	db := sql.OpenDB(locks)
+	t.Cleanup(func() { db.Close() })
+
+	return New(db, slog.New(slog.NewTextHandler(io.Discard, nil))), locks
+}
+
+func noop(context.Context, *slog.Logger) error { return nil }
+
+func TestAdd(t *testing.T) {
+	tests := []struct {
+		name string
+		job  Job
+		ok   bool
+	}{
+		{name: "valid", job: Job{Name: "cleanup", Interval: time.Minute, Run: noop}, ok: true},
+		{name: "no name", job: Job{Interval: time.Minute, Run: noop}},
+		{name: "no run function", job: Job{Name: "cleanup", Interval: time.Minute}},
+		{name: "no interval", job: Job{Name: "cleanup", Run: noop}},
+		{name: "negative interval", job: Job{Name: "cleanup", Interval: -time.Minute, Run: noop}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestScheduler(t)
+			err := s.Add(tt.job)
+			if (err == nil) != tt.ok {
+				t.Errorf("Add() error = %v, want ok %t", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestAddRejectsDuplicates(t *testing.T) {
+	s, _ := newTestScheduler(t)
+
+	err := s.Add(Job{Name: "cleanup", Interval: time.Minute, Run: noop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Add(Job{Name: "cleanup", Interval: time.Hour, Run: noop})
+	if err == nil {
+		t.Error("Add() accepted a second job with the same name")
+	}
+}
+
+func TestJitter(t *testing.T) {
+	tests := []struct {
+		limit time.Duration
+	}{
+		{limit: -time.Second},
+		{limit: 0},
+		{limit: 1},
+		{limit: time.Millisecond},
+		{limit: time.Hour},
+	}
+
+	for _, tt := range tests {
+		for range 1000 {
+			got := jitter(tt.limit)
+			if got < 0 || (tt.limit > 0 && got >= tt.limit) || (tt.limit <= 0 && got != 0) {
+				t.Fatalf("jitter(%v) = %v, want in [0, %v)", tt.limit, got, max(tt.limit, 0))
+			}
+		}
+	}
+}
+
+func TestLockKey(t *testing.T) {
+	if lockKey("expired-tokens") != lockKey("expired-tokens") {
+		t.Error("lockKey() isn't stable")
+	}
+
+	names := []string{"expired-tokens", "stale-login-data", "unactivated-accounts", "audit-retention", ""}
+	seen := make(map[int64]string)
+	for _, name := range names {
+		key := lockKey(name)
+		if other, found := seen[key]; found {
+			t.Errorf("lockKey(%q) = lockKey(%q)", name, other)
+		}
+		seen[key] = name
+	}
+}
+
+func TestRunRecoversPanic(t *testing.T) {
+	s, _ := newTestScheduler(t)
+
+	job := Job{Name: "broken", Interval: time.Minute, Run: func(context.Context, *slog.Logger) error {
+		panic("something broke")
+	}}
+
+	err := s.run(context.Background(), job, s.logger)
+	if err == nil || !strings.Contains(err.Error(), "something broke") {
+		t.Errorf("run() error = %v, want the panic", err)
+	}
+}
+
+// A panicking job keeps being scheduled, and releases its lock each time
+func TestPanickingJobKeepsRunning(t *testing.T) {
+	s, locks := newTestScheduler(t)
+
+	var runs atomic.Int32
+	err := s.Add(Job{Name: "broken", Interval: time.Millisecond, Run: func(context.Context, *slog.Logger) error {
+		runs.Add(1)
+		panic("something broke")
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Start()
+	waitFor(t, func() bool { return runs.Load() >= 3 })
+
+	err = s.Stop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locks.isLocked(lockKey("broken")) {
+		t.Error("lock still held after the job stopped")
+	}
+}
+
+// Someone else holding the lock means the run is skipped
+func TestRunOnceSkipsWhenLocked(t *testing.T) {
+	s, locks := newTestScheduler(t)
+	locks.locked[lockKey("cleanup")] = true
+
+	ran := false
+	s.runOnce(Job{Name: "cleanup", Interval: time.Minute, Run: func(context.Context, *slog.Logger) error {
+		ran = true
+		return nil
+	}})
+
+	if ran {
+		t.Error("job ran while another instance held its lock")
+	}
+	if !locks.isLocked(lockKey("cleanup")) {
+		t.Error("the other instance's lock was released")
+	}
+}
+
+func TestRunOnceTimeout(t *testing.T) {
+	s, _ := newTestScheduler(t)
+
+	var got error
+	s.runOnce(Job{Name: "slow", Interval: time.Minute, Timeout: 10 * time.Millisecond, Run: func(ctx context.Context, _ *slog.Logger) error {
+		<-ctx.Done()
+		got = ctx.Err()
+		return got
+	}})
+
+	if !errors.Is(got, context.DeadlineExceeded) {
+		t.Errorf("job context error = %v, want %v", got, context.DeadlineExceeded)
+	}
+}
+
+// Stop cancels a job that is halfway through and waits for it to return
+func TestStopCancelsRunningJob(t *testing.T) {
+	s, _ := newTestScheduler(t)
+
+	started := make(chan struct{})
+	var finished atomic.Bool
+	err := s.Add(Job{Name: "long", Interval: time.Hour, Run: func(ctx context.Context, _ *slog.Logger) error {
+		close(started)
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		finished.Store(true)
+		return ctx.Err()
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Start()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = s.Stop(ctx)
+	if err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if !finished.Load() {
+		t.Error("Stop() returned before the job did")
+	}
+}
+
+// A job that ignores cancellation doesn't hold Stop up past its context
+func TestStopGivesUp(t *testing.T) {
+	s, _ := newTestScheduler(t)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	err := s.Add(Job{Name: "stuck", Interval: time.Hour, Run: func(context.Context, *slog.Logger) error {
+		close(started)
+		<-release
+		return nil
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Start()
+	<-started
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = s.Stop(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Stop() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// Jobs that are only waiting for their next run stop straight away
+func TestStopWhileIdle(t *testing.T) {
+	s, _ := newTestScheduler(t)
+
+	err := s.Add(Job{Name: "later", Interval: time.Hour, Jitter: time.Hour, Run: noop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = s.Stop(ctx)
+	if err != nil {
+		t.Errorf("Stop() error = %v", err)
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,145 @@
+package totp
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA1 seed from RFC 6238 Appendix B, "12345678901234567890" in ASCII
+var rfcSecret = encoding.EncodeToString([]byte("12345678901234567890"))
+
+// RFC 6238 Appendix B, SHA1. The RFC uses 8 digits and we use 6, which are
+// the last 6 of the 8
+func TestCodeRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1111111111, want: "050471"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+		{unix: 20000000000, want: "353130"},
+	}
+
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code at %d: %v", tt.unix, err)
+		}
+		if got != tt.want {
+			t.Errorf("Code at %d = %q, want %q", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestCodeLowercaseSecret(t *testing.T) {
+	upper, err := Code(rfcSecret, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lower, err := Code(strings.ToLower(rfcSecret), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upper != lower {
+		t.Errorf("Code with lowercase secret = %q, want %q", lower, upper)
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+
+	tests := []struct {
+		name   string
+		offset int64
+		ok     bool
+	}{
+		{name: "current", offset: 0, ok: true},
+		{name: "one step behind", offset: -1, ok: true},
+		{name: "one step ahead", offset: 1, ok: true},
+		{name: "two steps behind", offset: -2, ok: false},
+		{name: "two steps ahead", offset: 2, ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := Code(rfcSecret, current+tt.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			step, ok := Validate(rfcSecret, code, now)
+			if ok != tt.ok {
+				t.Fatalf("Validate ok = %t, want %t", ok, tt.ok)
+			}
+			if ok && step != current+tt.offset {
+				t.Errorf("Validate step = %d, want %d", step, current+tt.offset)
+			}
+		})
+	}
+}
+
+func TestValidateRejects(t *testing.T) {
+	now := time.Unix(59, 0)
+
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+	}{
+		{name: "wrong code", secret: rfcSecret, code: "000000"},
+		{name: "too short", secret: rfcSecret, code: "28708"},
+		{name: "too long", secret: rfcSecret, code: "94287082"},
+		{name: "bad secret", secret: "not base32!", code: "287082"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := Validate(tt.secret, tt.code, now); ok {
+				t.Errorf("Validate(%q) accepted", tt.code)
+			}
+		})
+	}
+
+	// Apps often show the code in two groups of three
+	if _, ok := Validate(rfcSecret, "287 082", now); !ok {
+		t.Error("Validate rejected a code with a space in it")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Book Club", "someone@example.com", rfcSecret)
+
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Scheme != "otpauth" || parsed.Host != "totp" {
+		t.Errorf("URI = %q, want otpauth://totp/...", uri)
+	}
+	if want := "/Book Club:someone@example.com"; parsed.Path != want {
+		t.Errorf("label = %q, want %q", parsed.Path, want)
+	}
+	if want := "/Book%20Club:someone@example.com"; parsed.EscapedPath() != want {
+		t.Errorf("escaped label = %q, want %q", parsed.EscapedPath(), want)
+	}
+
+	want := map[string]string{
+		"secret":    rfcSecret,
+		"issuer":    "Book Club",
+		"algorithm": "SHA1",
+		"digits":    "6",
+		"period":    "30",
+	}
+	query := parsed.Query()
+	for key, value := range want {
+		if got := query.Get(key); got != value {
+			t.Errorf("%s = %q, want %q", key, got, value)
+		}
+	}
+}
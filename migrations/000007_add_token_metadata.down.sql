@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_tokens_user_scope;
+ALTER TABLE tokens DROP COLUMN IF EXISTS ip_address;
+ALTER TABLE tokens DROP COLUMN IF EXISTS user_agent;
+ALTER TABLE tokens DROP COLUMN IF EXISTS last_used_at;
+ALTER TABLE tokens DROP COLUMN IF EXISTS created_at;
@@ -0,0 +1,7 @@
+-- A family groups the access and refresh tokens issued from a single login.
+-- Rotating a refresh token keeps it in the same family, so presenting an
+-- already-used refresh token lets us revoke everything issued after it
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS family TEXT;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS used_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_tokens_family ON tokens (family);
@@ -0,0 +1,8 @@
+-- Revoked signed tokens. The id is either a token ID (jti) or a token
+-- family, and the row only needs to live as long as the token would have.
+-- Entries are written and checked against Go's clock, so the expiry is
+-- stored as an instant rather than a local time
+CREATE TABLE IF NOT EXISTS token_denylist (
+    id TEXT PRIMARY KEY,
+    expiry TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,7 @@
+-- Failed login attempts, keyed by 'email:<address>' or 'ip:<address>'
+CREATE TABLE IF NOT EXISTS login_throttles (
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL DEFAULT now(),
+    blocked_until TIMESTAMP NOT NULL DEFAULT now()
+);
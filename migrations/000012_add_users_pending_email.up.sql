@@ -0,0 +1,3 @@
+-- The address a user asked to switch to. It only replaces email once the
+-- confirmation token sent to it is used
+ALTER TABLE users ADD COLUMN IF NOT EXISTS pending_email TEXT;
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    -- The first characters of the key, so the owner can tell keys apart
+    prefix TEXT NOT NULL,
+    hash BYTEA NOT NULL UNIQUE,
+    -- The permission codes the key may use. Always a subset of what the
+    -- owner held when the key was created
+    permissions TEXT[] NOT NULL,
+    expiry TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    last_used_at TIMESTAMP,
+    CONSTRAINT api_keys_user_name_key UNIQUE (user_id, name)
+);
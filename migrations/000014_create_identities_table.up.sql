@@ -0,0 +1,21 @@
+-- Accounts at external identity providers that can log in as a user
+CREATE TABLE IF NOT EXISTS identities (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    -- The provider's issuer URL and its ID for the user
+    issuer TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    email TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    CONSTRAINT identities_issuer_subject_key UNIQUE (issuer, subject)
+);
+
+CREATE INDEX IF NOT EXISTS idx_identities_user ON identities (user_id);
+
+-- Logins that were sent to the provider and haven't come back yet
+CREATE TABLE IF NOT EXISTS oidc_logins (
+    state_hash BYTEA PRIMARY KEY,
+    nonce TEXT NOT NULL,
+    code_verifier TEXT NOT NULL,
+    expiry TIMESTAMP NOT NULL
+);
@@ -0,0 +1,4 @@
+ALTER TABLE users DROP COLUMN IF EXISTS ban_reason;
+ALTER TABLE users DROP COLUMN IF EXISTS banned_at;
+ALTER TABLE users DROP COLUMN IF EXISTS activated_before_deactivation;
+ALTER TABLE users DROP COLUMN IF EXISTS deactivated_at;
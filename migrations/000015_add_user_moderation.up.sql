@@ -0,0 +1,12 @@
+-- Set when an admin deactivates an account, so it isn't mistaken for one
+-- that was never activated
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deactivated_at TIMESTAMP;
+
+-- Deactivating an account clears activated, so remember whether it had
+-- been activated. Reactivating it then puts back what was there instead of
+-- activating an address nobody verified
+ALTER TABLE users ADD COLUMN IF NOT EXISTS activated_before_deactivation BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Banned users can't log in and their tokens and API keys stop working
+ALTER TABLE users ADD COLUMN IF NOT EXISTS banned_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS ban_reason TEXT NOT NULL DEFAULT '';
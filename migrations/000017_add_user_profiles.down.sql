@@ -0,0 +1,4 @@
+ALTER TABLE users DROP COLUMN IF EXISTS reviews_visibility;
+ALTER TABLE users DROP COLUMN IF EXISTS lists_visibility;
+ALTER TABLE users DROP COLUMN IF EXISTS avatar_url;
+ALTER TABLE users DROP COLUMN IF EXISTS bio;
@@ -0,0 +1,7 @@
+-- Optional profile details shown to other members
+ALTER TABLE users ADD COLUMN IF NOT EXISTS bio TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_url TEXT NOT NULL DEFAULT '';
+
+-- Who can see the user's reading lists and which reviews are theirs
+ALTER TABLE users ADD COLUMN IF NOT EXISTS lists_visibility TEXT NOT NULL DEFAULT 'public';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS reviews_visibility TEXT NOT NULL DEFAULT 'public';
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_audit_events_action;
+DROP INDEX IF EXISTS idx_audit_events_actor;
+DROP TRIGGER IF EXISTS audit_events_no_truncate ON audit_events;
+DROP TRIGGER IF EXISTS audit_events_no_change ON audit_events;
+DROP FUNCTION IF EXISTS purge_audit_events(INTERVAL);
+DROP FUNCTION IF EXISTS audit_events_append_only();
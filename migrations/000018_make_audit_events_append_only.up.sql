@@ -0,0 +1,60 @@
+-- The audit log can only be added to. The exceptions are the foreign
+-- keys being set to NULL when a user is deleted, which is how ON DELETE
+-- SET NULL works, and purge_audit_events() deleting old events
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'DELETE'
+        AND current_setting('audit_events.purge', true) = 'on'
+        AND OLD.created_at < localtimestamp - INTERVAL '30 days'
+    THEN
+        RETURN OLD;
+    END IF;
+
+    IF TG_OP = 'UPDATE'
+        AND (NEW.actor_id IS NULL OR NEW.actor_id = OLD.actor_id)
+        AND (NEW.target_user_id IS NULL OR NEW.target_user_id = OLD.target_user_id)
+        AND (NEW.id, NEW.created_at, NEW.action, NEW.outcome, NEW.ip_address, NEW.user_agent, NEW.details)
+            IS NOT DISTINCT FROM
+            (OLD.id, OLD.created_at, OLD.action, OLD.outcome, OLD.ip_address, OLD.user_agent, OLD.details)
+    THEN
+        RETURN NEW;
+    END IF;
+
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_events_no_change ON audit_events;
+CREATE TRIGGER audit_events_no_change
+    BEFORE UPDATE OR DELETE ON audit_events
+    FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+
+DROP TRIGGER IF EXISTS audit_events_no_truncate ON audit_events;
+CREATE TRIGGER audit_events_no_truncate
+    BEFORE TRUNCATE ON audit_events
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
+
+-- Delete events older than older_than and return how many went. The
+-- setting that lets the trigger allow it only lasts until the end of the
+-- transaction, and nothing from the last 30 days can go either way.
+-- created_at is a local time in the database's time zone, hence
+-- localtimestamp
+CREATE OR REPLACE FUNCTION purge_audit_events(older_than INTERVAL) RETURNS BIGINT AS $$
+DECLARE
+    purged BIGINT;
+BEGIN
+    IF older_than < INTERVAL '30 days' THEN
+        RAISE EXCEPTION 'audit events are kept for at least 30 days';
+    END IF;
+
+    PERFORM set_config('audit_events.purge', 'on', true);
+    DELETE FROM audit_events WHERE created_at < localtimestamp - older_than;
+    GET DIAGNOSTICS purged = ROW_COUNT;
+    PERFORM set_config('audit_events.purge', 'off', true);
+
+    RETURN purged;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor ON audit_events (actor_id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_action ON audit_events (action);
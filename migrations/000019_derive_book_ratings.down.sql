@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS reviews_book_rating ON reviews;
+DROP FUNCTION IF EXISTS reviews_refresh_book_rating();
+DROP FUNCTION IF EXISTS refresh_book_rating(INTEGER);
+ALTER TABLE books ALTER COLUMN average_rating DROP NOT NULL;
+ALTER TABLE books DROP COLUMN IF EXISTS ratings_count;
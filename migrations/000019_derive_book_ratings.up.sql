@@ -0,0 +1,55 @@
+ALTER TABLE books ADD COLUMN IF NOT EXISTS ratings_count INTEGER NOT NULL DEFAULT 0;
+
+-- Recalculate one book's rating from its reviews. The book is locked
+-- first: two reviews of the same book saved at the same time would
+-- otherwise each count the reviews before the other had committed, and
+-- whichever finished last would leave a rating missing a review. With the
+-- lock the second refresh waits, and its count runs as a new statement
+-- that sees the other review
+CREATE OR REPLACE FUNCTION refresh_book_rating(target_book_id INTEGER) RETURNS void AS $$
+BEGIN
+    PERFORM 1 FROM books WHERE id = target_book_id FOR UPDATE;
+
+    UPDATE books
+    SET average_rating = stats.average, ratings_count = stats.count
+    FROM (
+        SELECT COALESCE(ROUND(AVG(rating), 2), 0) AS average, COUNT(rating) AS count
+        FROM reviews
+        WHERE book_id = target_book_id
+    ) AS stats
+    WHERE books.id = target_book_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Keep the rating in step with every change to reviews, including the
+-- ones cascaded from deleting a user. A review moved to another book
+-- updates both books
+CREATE OR REPLACE FUNCTION reviews_refresh_book_rating() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        PERFORM refresh_book_rating(OLD.book_id);
+    END IF;
+    IF TG_OP = 'INSERT' OR (TG_OP = 'UPDATE' AND NEW.book_id <> OLD.book_id) THEN
+        PERFORM refresh_book_rating(NEW.book_id);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS reviews_book_rating ON reviews;
+CREATE TRIGGER reviews_book_rating
+    AFTER INSERT OR UPDATE OF book_id, rating OR DELETE ON reviews
+    FOR EACH ROW EXECUTE FUNCTION reviews_refresh_book_rating();
+
+-- Backfill
+UPDATE books
+SET average_rating = COALESCE(stats.average, 0), ratings_count = COALESCE(stats.count, 0)
+FROM books AS b
+LEFT JOIN (
+    SELECT book_id, ROUND(AVG(rating), 2) AS average, COUNT(rating) AS count
+    FROM reviews
+    GROUP BY book_id
+) AS stats ON stats.book_id = b.id
+WHERE books.id = b.id;
+
+ALTER TABLE books ALTER COLUMN average_rating SET NOT NULL;
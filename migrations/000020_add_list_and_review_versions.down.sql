@@ -0,0 +1,2 @@
+ALTER TABLE reviews DROP COLUMN IF EXISTS version;
+ALTER TABLE reading_lists DROP COLUMN IF EXISTS version;
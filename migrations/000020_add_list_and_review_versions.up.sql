@@ -0,0 +1,2 @@
+ALTER TABLE reading_lists ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+ALTER TABLE reviews ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
@@ -0,0 +1,2 @@
+-- The original ISBNs aren't kept, and the normalized ones are still valid,
+-- so there is nothing to undo
@@ -0,0 +1,57 @@
+-- Books are now stored under their ISBN-13. Strip the hyphens and spaces
+-- from the ISBNs already in the table and convert ISBN-10s whose check
+-- digit is right. When several books end up with the same ISBN-13, or
+-- another book already has it, only the first is converted. Books that
+-- still don't have a valid ISBN-13 are listed so they can be fixed by hand
+DO $$
+DECLARE
+    unconverted TEXT;
+BEGIN
+    WITH stripped AS (
+        SELECT id, isbn AS original, upper(regexp_replace(isbn, '[- ]', '', 'g')) AS isbn
+        FROM books
+    ),
+    converted AS (
+        SELECT id, original,
+            CASE
+                WHEN isbn !~ '^[0-9]{9}[0-9X]$' THEN isbn
+                WHEN ((
+                    SELECT SUM(substr(isbn, i, 1)::INT * (11 - i))
+                    FROM generate_series(1, 9) AS i
+                ) + CASE WHEN right(isbn, 1) = 'X' THEN 10 ELSE right(isbn, 1)::INT END) % 11 = 0
+                THEN prefix || ((10 - (
+                    SELECT SUM(substr(prefix, i, 1)::INT * CASE WHEN i % 2 = 1 THEN 1 ELSE 3 END)
+                    FROM generate_series(1, 12) AS i
+                ) % 10) % 10)::TEXT
+                ELSE isbn
+            END AS isbn
+        FROM stripped
+        CROSS JOIN LATERAL (SELECT '978' || left(stripped.isbn, 9) AS prefix) AS p
+    ),
+    changed AS (
+        SELECT id, isbn, row_number() OVER (PARTITION BY isbn ORDER BY id) AS n
+        FROM converted
+        WHERE isbn <> original
+    )
+    UPDATE books
+    SET isbn = changed.isbn
+    FROM changed
+    WHERE books.id = changed.id
+      AND changed.n = 1
+      AND NOT EXISTS (SELECT 1 FROM books AS other WHERE other.isbn = changed.isbn);
+
+    SELECT string_agg(id || ' (' || isbn || ')', ', ' ORDER BY id) INTO unconverted
+    FROM books
+    WHERE CASE
+        WHEN isbn ~ '^[0-9]{13}$' THEN (10 - (
+            SELECT SUM(substr(isbn, i, 1)::INT * CASE WHEN i % 2 = 1 THEN 1 ELSE 3 END)
+            FROM generate_series(1, 12) AS i
+        ) % 10) % 10 <> right(isbn, 1)::INT
+        ELSE TRUE
+    END;
+
+    IF unconverted IS NOT NULL THEN
+        RAISE NOTICE 'books without a valid ISBN-13, either invalid or another book has it: %', unconverted;
+    END IF;
+END;
+$$;
@@ -0,0 +1,17 @@
+-- array_to_string() is only STABLE, and a generated column can only use
+-- IMMUTABLE functions. Joining an array of text with a space doesn't
+-- depend on any setting, so it's safe to declare this one IMMUTABLE
+CREATE OR REPLACE FUNCTION books_authors_text(authors TEXT[]) RETURNS TEXT AS $$
+    SELECT array_to_string(authors, ' ');
+$$ LANGUAGE sql IMMUTABLE;
+
+-- Matches in the title count for the most, then authors, genre and
+-- description
+ALTER TABLE books ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('english', title), 'A') ||
+    setweight(to_tsvector('english', books_authors_text(authors)), 'B') ||
+    setweight(to_tsvector('english', genre), 'C') ||
+    setweight(to_tsvector('english', description), 'D')
+) STORED;
+
+CREATE INDEX IF NOT EXISTS books_search_vector_idx ON books USING GIN (search_vector);
@@ -0,0 +1,8 @@
+DROP TRIGGER IF EXISTS authors_books ON authors;
+DROP TRIGGER IF EXISTS book_authors_books ON book_authors;
+DROP FUNCTION IF EXISTS authors_refresh_books();
+DROP FUNCTION IF EXISTS book_authors_refresh_book();
+DROP FUNCTION IF EXISTS refresh_book_authors(INTEGER);
+DROP TABLE IF EXISTS book_authors;
+DROP TABLE IF EXISTS authors;
+DROP FUNCTION IF EXISTS normalize_author_name(TEXT);
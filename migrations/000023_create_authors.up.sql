@@ -0,0 +1,117 @@
+-- Two spellings of a name are the same author if they only differ in
+-- case, spacing and punctuation, e.g. "J.R.R. Tolkien" and "J. R. R. Tolkien".
+-- Only ASCII is touched, with the C collation, so the result doesn't depend
+-- on the database's locale. normalizeAuthorName() in internal/data/authors.go
+-- does the same in Go and has to be kept in step with this
+CREATE OR REPLACE FUNCTION normalize_author_name(name TEXT) RETURNS TEXT AS $$
+    SELECT regexp_replace(lower(name COLLATE "C"), '[^a-z0-9\u0080-\U0010FFFF]+', '', 'g');
+$$ LANGUAGE sql IMMUTABLE;
+
+CREATE TABLE IF NOT EXISTS authors (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    normalized_name TEXT GENERATED ALWAYS AS (normalize_author_name(name)) STORED UNIQUE,
+    bio TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    version INT NOT NULL DEFAULT 1
+);
+
+-- An author can't be deleted while they still have books
+CREATE TABLE IF NOT EXISTS book_authors (
+    book_id INTEGER NOT NULL REFERENCES books ON DELETE CASCADE,
+    author_id BIGINT NOT NULL REFERENCES authors ON DELETE RESTRICT,
+    role TEXT NOT NULL DEFAULT 'author' CHECK (role IN ('author', 'editor', 'translator')),
+    position INT NOT NULL,
+    PRIMARY KEY (book_id, author_id, role)
+);
+
+CREATE INDEX IF NOT EXISTS book_authors_author_id_idx ON book_authors (author_id);
+
+-- Backfill an author for every name in the existing arrays. Where a name
+-- is spelled more than one way the most used spelling wins
+INSERT INTO authors (name)
+SELECT DISTINCT ON (normalize_author_name(name)) name
+FROM (
+    SELECT btrim(name) AS name, COUNT(*) AS uses
+    FROM books, unnest(books.authors) AS name
+    GROUP BY btrim(name)
+) AS names
+WHERE normalize_author_name(name) <> ''
+ORDER BY normalize_author_name(name), uses DESC, name
+ON CONFLICT DO NOTHING;
+
+INSERT INTO book_authors (book_id, author_id, role, position)
+SELECT DISTINCT ON (books.id, authors.id) books.id, authors.id, 'author', names.position
+FROM books
+CROSS JOIN LATERAL unnest(books.authors) WITH ORDINALITY AS names(name, position)
+INNER JOIN authors ON authors.normalized_name = normalize_author_name(names.name)
+ORDER BY books.id, authors.id, names.position
+ON CONFLICT DO NOTHING;
+
+-- A name without a letter or digit in it (e.g. "?" or "-") has no author
+-- to link to. Books left without any authors, including those that never
+-- had any, are credited to "Unknown" so that they can still be edited
+-- without listing their authors again
+INSERT INTO authors (name)
+SELECT 'Unknown'
+WHERE EXISTS (
+    SELECT 1 FROM books
+    WHERE NOT EXISTS (SELECT 1 FROM book_authors WHERE book_authors.book_id = books.id)
+)
+ON CONFLICT DO NOTHING;
+
+INSERT INTO book_authors (book_id, author_id, role, position)
+SELECT books.id, authors.id, 'author', 1
+FROM books
+INNER JOIN authors ON authors.normalized_name = normalize_author_name('Unknown')
+WHERE NOT EXISTS (SELECT 1 FROM book_authors WHERE book_authors.book_id = books.id);
+
+-- books.authors stays as the names of a book's authors, in order, so
+-- searching and faceting keep working. It's rebuilt from book_authors
+CREATE OR REPLACE FUNCTION refresh_book_authors(target_book_id INTEGER) RETURNS void AS $$
+    UPDATE books
+    SET authors = COALESCE((
+        SELECT array_agg(authors.name ORDER BY book_authors.position)
+        FROM book_authors
+        INNER JOIN authors ON authors.id = book_authors.author_id
+        WHERE book_authors.book_id = target_book_id AND book_authors.role = 'author'
+    ), '{}')
+    WHERE id = target_book_id;
+$$ LANGUAGE sql;
+
+CREATE OR REPLACE FUNCTION book_authors_refresh_book() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        PERFORM refresh_book_authors(OLD.book_id);
+    END IF;
+    IF TG_OP = 'INSERT' OR (TG_OP = 'UPDATE' AND NEW.book_id <> OLD.book_id) THEN
+        PERFORM refresh_book_authors(NEW.book_id);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS book_authors_books ON book_authors;
+CREATE TRIGGER book_authors_books
+    AFTER INSERT OR UPDATE OR DELETE ON book_authors
+    FOR EACH ROW EXECUTE FUNCTION book_authors_refresh_book();
+
+-- Renaming an author renames them on all their books
+CREATE OR REPLACE FUNCTION authors_refresh_books() RETURNS trigger AS $$
+BEGIN
+    PERFORM refresh_book_authors(book_id)
+    FROM book_authors
+    WHERE author_id = NEW.id AND role = 'author';
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS authors_books ON authors;
+CREATE TRIGGER authors_books
+    AFTER UPDATE OF name ON authors
+    FOR EACH ROW WHEN (OLD.name IS DISTINCT FROM NEW.name)
+    EXECUTE FUNCTION authors_refresh_books();
+
+-- Rewrite the existing arrays, which drops the duplicates and the names
+-- without an author, and settles every name on one spelling
+SELECT refresh_book_authors(id) FROM books;